@@ -0,0 +1,378 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+const (
+	accountMaxErrors    = 5                // Accounts are disabled after that many consecutive failed placements
+	accountErrorBackoff = 10 * time.Second // Time an account isn't used after a failed placement
+	accountProxyRecheck = 10 * time.Second // Time until accounts with an unhealthy proxy are checked again
+)
+
+// A game account that is used to place pixels
+type botAccount struct {
+	Name        string
+	Game        string // Short name of the connection type the account belongs to
+	Fingerprint string
+	Token       string // Captcha token, it's only sent with the next placement
+	Proxy       string // Name of the proxy used for placing pixels, empty for direct connections
+
+	Disabled       bool // Disabled accounts aren't used. The configuration is only read on startup, use enableAccount to enable them at runtime
+	DisabledReason string
+	NextPlacement  time.Time // The account can't place pixels before this time
+	LastCooldown   float64   // Cooldown in seconds after the last successful placement, used to estimate how fast templates are completed
+	LastError      string
+	LastErrorTime  time.Time
+	ErrorCount     int // Consecutive failed placements
+}
+
+// Reason of a failed placement, it decides how the account is treated afterwards
+type placementErrorReason int
+
+const (
+	placementErrorOther    placementErrorReason = iota // Counts towards accountMaxErrors
+	placementErrorCooldown                             // The account has to wait longer, it isn't counted as error
+	placementErrorProxy                                // The game detected a proxy or VPN, the account is disabled
+	placementErrorCaptcha                              // The game wants a captcha to be solved
+)
+
+// Error returned by connectionPlacer.placePixel
+type placementError struct {
+	Reason  placementErrorReason
+	Wait    time.Duration // Time until the account can place again, if known
+	Message string
+}
+
+func (err *placementError) Error() string {
+	return err.Message
+}
+
+// Stores accounts in the configuration, together with their cooldown and error state.
+//
+// The list of accounts is kept in memory, as configuration changes aren't visible immediately.
+type accountStore struct {
+	sync.Mutex
+
+	Config   *configdb.Config
+	Proxies  *proxyManager  // Accounts with an unhealthy proxy aren't used. Can be nil
+	Captchas *captchaBroker // Forwards captchas to the user. Without it, captchas count as failed placements
+	Accounts []botAccount
+	Busy     map[string]bool // Accounts that are currently placing a pixel
+	Changed  chan struct{}   // Gets closed and replaced whenever an account changes
+}
+
+// Creates an account store that loads its accounts from the given configuration
+func newAccountStore(c *configdb.Config) *accountStore {
+	as := &accountStore{
+		Config:   c,
+		Accounts: []botAccount{},
+		Busy:     map[string]bool{},
+		Changed:  make(chan struct{}),
+	}
+
+	if err := c.Get(".accounts", &as.Accounts); err != nil {
+		as.Accounts = []botAccount{} // No accounts stored yet
+	}
+
+	return as
+}
+
+// Writes the accounts into the configuration, and wakes up everything that waits for an account.
+// The store has to be locked.
+func (as *accountStore) changed() error {
+	close(as.Changed)
+	as.Changed = make(chan struct{})
+
+	if err := as.Config.Set(".accounts", as.Accounts); err != nil {
+		return fmt.Errorf("Can't write configuration: %v", err)
+	}
+
+	return nil
+}
+
+// Returns all stored accounts
+func (as *accountStore) getAccounts() []botAccount {
+	as.Lock()
+	defer as.Unlock()
+
+	return append([]botAccount{}, as.Accounts...)
+}
+
+// Stores the given account.
+// An existing account with the same name will be overwritten.
+func (as *accountStore) setAccount(acc botAccount) error {
+	if acc.Name == "" {
+		return fmt.Errorf("Account name is missing")
+	}
+
+	as.Lock()
+	defer as.Unlock()
+
+	for i := range as.Accounts {
+		if as.Accounts[i].Name == acc.Name {
+			as.Accounts[i] = acc
+			return as.changed()
+		}
+	}
+	as.Accounts = append(as.Accounts, acc)
+
+	return as.changed()
+}
+
+// Removes an account
+func (as *accountStore) removeAccount(name string) error {
+	as.Lock()
+	defer as.Unlock()
+
+	for i := range as.Accounts {
+		if as.Accounts[i].Name == name {
+			as.Accounts = append(as.Accounts[:i], as.Accounts[i+1:]...)
+			return as.changed()
+		}
+	}
+
+	return fmt.Errorf("Account %v not found", name)
+}
+
+// Enables a disabled account again, and resets its error count
+func (as *accountStore) enableAccount(name string) error {
+	as.Lock()
+	defer as.Unlock()
+
+	for i := range as.Accounts {
+		if acc := &as.Accounts[i]; acc.Name == name {
+			acc.Disabled, acc.DisabledReason = false, ""
+			acc.ErrorCount = 0
+			return as.changed()
+		}
+	}
+
+	return fmt.Errorf("Account %v not found", name)
+}
+
+// Waits until an enabled account of the given game can place a pixel, and marks it as busy.
+// Accounts are skipped while their proxy is unhealthy.
+// The account has to be released afterwards.
+//
+// Returns an error if there is no enabled account for the game, or if quit is closed.
+func (as *accountStore) acquire(game string, quit <-chan struct{}) (botAccount, error) {
+	for {
+		as.Lock()
+		var next *botAccount
+		usable, proxyWait := false, false
+		for i := range as.Accounts {
+			acc := &as.Accounts[i]
+			if acc.Game != game || acc.Disabled {
+				continue
+			}
+			usable = true
+			if as.Busy[acc.Name] {
+				continue
+			}
+			if !as.Proxies.isHealthy(acc.Proxy) {
+				proxyWait = true
+				continue
+			}
+			if next == nil || acc.NextPlacement.Before(next.NextPlacement) {
+				next = acc
+			}
+		}
+		if !usable {
+			as.Unlock()
+			return botAccount{}, fmt.Errorf("There is no enabled account for %v", game)
+		}
+
+		var wait <-chan time.Time
+		if next != nil {
+			d := next.NextPlacement.Sub(time.Now())
+			if d <= 0 {
+				as.Busy[next.Name] = true
+				acc := *next
+				as.Unlock()
+				return acc, nil
+			}
+			if proxyWait && d > accountProxyRecheck {
+				d = accountProxyRecheck
+			}
+			wait = time.After(d)
+		} else if proxyWait {
+			wait = time.After(accountProxyRecheck) // Proxy health changes aren't signalled, check again later
+		}
+		changed := as.Changed
+		as.Unlock()
+
+		// Wait for the next account to get ready, or for any change of the accounts
+		select {
+		case <-wait:
+		case <-changed:
+		case <-quit:
+			return botAccount{}, fmt.Errorf("Stopped waiting for an account")
+		}
+	}
+}
+
+// Marks an account as not busy anymore, and updates its state from the placement result.
+// cooldown is the time until the next placement after a successful one.
+func (as *accountStore) release(name string, cooldown time.Duration, placeErr error) {
+	as.Lock()
+	defer as.Unlock()
+
+	delete(as.Busy, name)
+
+	var acc *botAccount
+	for i := range as.Accounts {
+		if as.Accounts[i].Name == name {
+			acc = &as.Accounts[i]
+		}
+	}
+	if acc == nil {
+		close(as.Changed) // The account got removed meanwhile, still wake up waiting placements
+		as.Changed = make(chan struct{})
+		return
+	}
+
+	acc.Token = "" // Tokens can only be used once
+
+	now := time.Now()
+	if placeErr == nil {
+		acc.NextPlacement = now.Add(cooldown)
+		acc.LastCooldown = cooldown.Seconds()
+		acc.ErrorCount = 0
+	} else if err, ok := placeErr.(*placementError); ok && err.Reason == placementErrorCooldown {
+		if err.Wait > 0 {
+			acc.NextPlacement = now.Add(err.Wait)
+		} else {
+			acc.NextPlacement = now.Add(accountErrorBackoff)
+		}
+	} else {
+		// Captchas count as failed placements too, so accounts whose captchas are never solved get disabled eventually
+		acc.LastError, acc.LastErrorTime = placeErr.Error(), now
+		acc.ErrorCount++
+		acc.NextPlacement = now.Add(accountErrorBackoff)
+		if ok && err.Wait > accountErrorBackoff {
+			acc.NextPlacement = now.Add(err.Wait)
+		}
+
+		switch {
+		case ok && err.Reason == placementErrorProxy:
+			acc.Disabled, acc.DisabledReason = true, fmt.Sprintf("Proxy detected: %v", placeErr)
+		case acc.ErrorCount >= accountMaxErrors:
+			acc.Disabled, acc.DisabledReason = true, fmt.Sprintf("%v failed placements in a row, last error: %v", acc.ErrorCount, placeErr)
+		}
+		if acc.Disabled {
+			log.Warnf("Account %v disabled: %v", acc.Name, acc.DisabledReason)
+		} else if ok && err.Reason == placementErrorCaptcha && as.Captchas != nil {
+			// Pause the account until the captcha is solved or expired
+			req := as.Captchas.request(acc.Name, acc.Game, err.Message)
+			acc.NextPlacement = req.Expires
+		}
+	}
+
+	if err := as.changed(); err != nil {
+		log.Warnf("Can't store state of account %v: %v", name, err)
+	}
+}
+
+// Attaches the solved captcha token to the next placement of the waiting account, and resumes it
+func (as *accountStore) solveCaptcha(id int, token string) error {
+	if as.Captchas == nil {
+		return fmt.Errorf("Captchas aren't forwarded")
+	}
+	if token == "" {
+		return fmt.Errorf("Token is missing")
+	}
+
+	req, err := as.Captchas.solve(id)
+	if err != nil {
+		return err
+	}
+
+	as.Lock()
+	defer as.Unlock()
+
+	for i := range as.Accounts {
+		if acc := &as.Accounts[i]; acc.Name == req.Account {
+			acc.Token = token
+			acc.NextPlacement = time.Now()
+			return as.changed()
+		}
+	}
+
+	return fmt.Errorf("Account %v not found", req.Account)
+}
+
+// Places pixels of a single game connection, using all enabled accounts of that game
+type placementScheduler struct {
+	Store  *accountStore
+	Placer connectionPlacer
+
+	Quit     chan struct{} // Closing this channel stops all waiting placements
+	QuitOnce sync.Once
+}
+
+// Maximum amount of accounts that are tried for a single pixel
+const placementMaxAttempts = 3
+
+func newPlacementScheduler(store *accountStore, placer connectionPlacer) *placementScheduler {
+	return &placementScheduler{
+		Store:  store,
+		Placer: placer,
+		Quit:   make(chan struct{}),
+	}
+}
+
+// Places a pixel with the next account that is ready.
+// This blocks until the pixel is placed, and can be called concurrently to use several accounts at once.
+// If the placement fails, it's retried with other accounts.
+func (s *placementScheduler) place(pos image.Point, col color.Color) error {
+	var lastErr error
+	for attempt := 0; attempt < placementMaxAttempts; attempt++ {
+		acc, err := s.Store.acquire(s.Placer.getShortName(), s.Quit)
+		if err != nil {
+			return err
+		}
+
+		cooldown, err := s.Placer.placePixel(acc, pos, col)
+		s.Store.release(acc.Name, cooldown, err)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Account %v can't place pixel at %v: %v", acc.Name, pos, err)
+		lastErr = err
+
+		// The account has to wait, try another one without counting the attempt
+		if err, ok := err.(*placementError); ok && err.Reason == placementErrorCooldown {
+			attempt--
+		}
+	}
+
+	return fmt.Errorf("Can't place pixel at %v: %v", pos, lastErr)
+}
+
+// Stops all waiting placements
+func (s *placementScheduler) Close() {
+	s.QuitOnce.Do(func() { close(s.Quit) })
+}
@@ -0,0 +1,226 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Game connection stand-in that places pixels with the results of Results, by account name
+type testPlacer struct {
+	testConnection
+
+	sync.Mutex
+	Results map[string][]error // Results of the next placements, nil means success
+	Placed  map[string]int     // Amount of successful placements by account name
+}
+
+func (p *testPlacer) placePixel(acc botAccount, pos image.Point, col color.Color) (time.Duration, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if results := p.Results[acc.Name]; len(results) > 0 {
+		p.Results[acc.Name] = results[1:]
+		if results[0] != nil {
+			return 0, results[0]
+		}
+	}
+	p.Placed[acc.Name]++
+	return time.Hour, nil
+}
+
+// Returns an account store with the given accounts, and the storage of its configuration
+func newTestAccountStore(t *testing.T, accs ...botAccount) (*accountStore, configdb.Storage) {
+	storage := configdb.UseDummyStorage("", map[string]interface{}{})
+	c, err := configdb.New([]configdb.Storage{storage})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+	as := newAccountStore(c)
+	for _, acc := range accs {
+		if err := as.setAccount(acc); err != nil {
+			t.Fatalf("Can't store account: %v", err)
+		}
+	}
+	return as, storage
+}
+
+func Test_placementScheduler(t *testing.T) {
+	as, storage := newTestAccountStore(t,
+		botAccount{Name: "a", Game: "test"},
+		botAccount{Name: "b", Game: "test"},
+		botAccount{Name: "c", Game: "other"},
+	)
+	placer := &testPlacer{Results: map[string][]error{}, Placed: map[string]int{}}
+	s := newPlacementScheduler(as, placer)
+	defer s.Close()
+
+	// Every account has a cooldown of an hour after placing, so both accounts of the game are used once
+	for i := 0; i < 2; i++ {
+		if err := s.place(image.Point{i, 0}, color.White); err != nil {
+			t.Fatalf("Can't place pixel: %v", err)
+		}
+	}
+	if placer.Placed["a"] != 1 || placer.Placed["b"] != 1 || placer.Placed["c"] != 0 {
+		t.Errorf("Placements by account: %v, want one by a and b", placer.Placed)
+	}
+
+	// The next placement waits for a ready account, until the scheduler is closed
+	done := make(chan error)
+	go func() { done <- s.place(image.Point{2, 0}, color.White) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Placement didn't wait for the cooldown: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Placement of closed scheduler succeeded")
+	}
+
+	// Changed accounts wake up waiting placements
+	s = newPlacementScheduler(as, placer)
+	defer s.Close()
+	go func() { done <- s.place(image.Point{2, 0}, color.White) }()
+	acc := as.getAccounts()[0]
+	acc.NextPlacement = time.Time{}
+	as.setAccount(acc)
+	if err := <-done; err != nil {
+		t.Errorf("Can't place pixel after account change: %v", err)
+	}
+
+	// The configuration contains the cooldown state
+	stored := []botAccount{}
+	if tree, err := storage.Read(); err != nil || tree.Get(".accounts", &stored) != nil || len(stored) != 3 || stored[0].NextPlacement.Before(time.Now()) {
+		t.Errorf("Stored accounts are %+v", stored)
+	}
+}
+
+func Test_placementSchedulerRetry(t *testing.T) {
+	as, _ := newTestAccountStore(t,
+		botAccount{Name: "failing", Game: "test"},
+		botAccount{Name: "working", Game: "test"},
+	)
+	placer := &testPlacer{Results: map[string][]error{}, Placed: map[string]int{}}
+	placer.Results["failing"] = []error{fmt.Errorf("Some error")}
+	s := newPlacementScheduler(as, placer)
+	defer s.Close()
+
+	if err := s.place(image.Point{}, color.White); err != nil {
+		t.Fatalf("Placement wasn't retried with another account: %v", err)
+	}
+	if placer.Placed["working"] != 1 {
+		t.Errorf("Placements by account: %v, want one by working", placer.Placed)
+	}
+	if acc := as.getAccounts()[0]; acc.ErrorCount != 1 || acc.LastError != "Some error" || acc.Disabled {
+		t.Errorf("Failed account has the wrong state: %+v", acc)
+	}
+
+	// Without any enabled account of the game, placements fail immediately
+	for _, acc := range as.getAccounts() {
+		acc.Disabled = true
+		as.setAccount(acc)
+	}
+	if err := s.place(image.Point{}, color.White); err == nil {
+		t.Errorf("Placement without enabled accounts succeeded")
+	}
+}
+
+func Test_accountStoreRelease(t *testing.T) {
+	as, _ := newTestAccountStore(t,
+		botAccount{Name: "proxy", Game: "test"},
+		botAccount{Name: "failing", Game: "test"},
+		botAccount{Name: "waiting", Game: "test"},
+	)
+	get := func(name string) botAccount {
+		for _, acc := range as.getAccounts() {
+			if acc.Name == name {
+				return acc
+			}
+		}
+		t.Fatalf("Account %v not found", name)
+		return botAccount{}
+	}
+
+	as.release("proxy", 0, &placementError{Reason: placementErrorProxy, Message: "You are using a proxy"})
+	if acc := get("proxy"); !acc.Disabled || acc.LastError != "You are using a proxy" {
+		t.Errorf("Account with proxy error wasn't disabled: %+v", acc)
+	}
+
+	as.release("waiting", 0, &placementError{Reason: placementErrorCooldown, Wait: time.Hour, Message: "Wait"})
+	if acc := get("waiting"); acc.Disabled || acc.ErrorCount != 0 || acc.NextPlacement.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Cooldown wasn't applied correctly: %+v", acc)
+	}
+
+	for i := 1; i <= accountMaxErrors; i++ {
+		as.release("failing", 0, fmt.Errorf("Error %v", i))
+		if acc := get("failing"); acc.ErrorCount != i || acc.Disabled != (i == accountMaxErrors) {
+			t.Errorf("Account has the wrong state after %v errors: %+v", i, acc)
+		}
+	}
+
+	if err := as.enableAccount("failing"); err != nil {
+		t.Errorf("Can't enable account: %v", err)
+	}
+	if acc := get("failing"); acc.Disabled || acc.DisabledReason != "" || acc.ErrorCount != 0 {
+		t.Errorf("Account wasn't enabled: %+v", acc)
+	}
+	if err := as.enableAccount("missing"); err == nil {
+		t.Errorf("Enabling a missing account succeeded")
+	}
+
+	// A success resets the error count
+	as.release("waiting", 0, fmt.Errorf("Error"))
+	as.release("waiting", time.Minute, nil)
+	if acc := get("waiting"); acc.ErrorCount != 0 {
+		t.Errorf("Error count wasn't reset: %+v", acc)
+	}
+}
+
+func Test_accountStoreProxyHealth(t *testing.T) {
+	dead := httptest.NewServer(nil)
+	dead.Close()
+	target := httptest.NewServer(nil)
+	defer target.Close()
+
+	pm, err := newProxyManager([]botProxy{{Name: "dead", URL: dead.URL}}, target.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("Can't create proxy manager: %v", err)
+	}
+	defer pm.Close()
+	waitFor(t, "health check", func() bool { return !pm.isHealthy("dead") })
+
+	as, _ := newTestAccountStore(t,
+		botAccount{Name: "proxied", Game: "test", Proxy: "dead"},
+		botAccount{Name: "direct", Game: "test", NextPlacement: time.Now().Add(100 * time.Millisecond)},
+	)
+	as.Proxies = pm
+
+	// The proxied account is ready earlier, but its proxy is unhealthy
+	acc, err := as.acquire("test", nil)
+	if err != nil || acc.Name != "direct" {
+		t.Errorf("acquire() = %v, %v, want account direct", acc.Name, err)
+	}
+}
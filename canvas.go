@@ -22,6 +22,7 @@ import (
 	"image/color"
 	"image/draw"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -55,6 +56,7 @@ type canvasEventListenerSubscribe struct {
 
 type canvasEventListenerUnsubscribe struct {
 	Listener canvasListener
+	Done     chan struct{} // Gets closed after all queued events of the listener are handled
 }
 
 type canvasEventListenerRects struct {
@@ -66,6 +68,10 @@ type canvasEventSetTime struct {
 	Time time.Time
 }
 
+type canvasEventSetSubscriber struct {
+	Subscriber canvasSubscriber
+}
+
 type canvasListener interface {
 	handleChunksChange(create, remove map[image.Rectangle]int) error
 
@@ -78,22 +84,84 @@ type canvasListener interface {
 	handleSetTime(t time.Time) error
 }
 
+// Gets told which chunks are inside of any listener rectangle, usually the game connection.
+// The methods are called from the broadcaster goroutine, so they must not block or call back into the canvas.
+type canvasSubscriber interface {
+	subscribe(rects []image.Rectangle)   // Chunk rectangles that are now inside of listener rectangles
+	unsubscribe(rects []image.Rectangle) // Chunk rectangles that aren't inside of any listener rectangle anymore
+}
+
 type canvasListenerState struct {
 	Rects                 []image.Rectangle       // Rectangles that the listener needs to be kept up to do date with. The canvas will keep those rectangles in sync with the game
 	VirtualChunks         map[image.Rectangle]int // Chunk rectangles with IDs that the listener knows of, only used when UseVirtualChunks is set
 	VirtualChunkIDCounter int                     // Counter for new chunk IDs
 	UseVirtualChunks      bool                    // True: Let the canvas manage chunks for the listener
+	Queue                 *canvasListenerQueue    // Events are delivered to the listener through this queue
+}
+
+// Policy that decides when chunks are deleted from memory
+type chunkRetention int
+
+const (
+	chunkRetentionDefault    chunkRetention = iota // Delete chunks that were invalid and not queried for some time
+	chunkRetentionNever                            // Never delete chunks. Used for replays, as the data can't be downloaded again
+	chunkRetentionDuration                         // Delete chunks that haven't been queried for RetentionDuration, even if they are valid
+	chunkRetentionRegistered                       // Delete chunks that are outside of all rectangles registered by listeners
+)
+
+// Options that are set on canvas creation
+type canvasOptions struct {
+	ChunkRetention         chunkRetention
+	ChunkRetentionDuration time.Duration    // Only used with chunkRetentionDuration
+	ColorModel             canvasColorModel // Format of the chunk images. Images are converted to it when they are set
+}
+
+// Returns the canvas options of live game connections from the configuration.
+// Missing or invalid values result in the default options.
+func canvasOptionsFromConfig() canvasOptions {
+	options := canvasOptions{}
+	if conf == nil {
+		return options
+	}
+
+	var retention string
+	conf.Get(".canvas.chunkRetention", &retention)
+	switch retention {
+	case "", "default":
+	case "never":
+		options.ChunkRetention = chunkRetentionNever
+	case "duration":
+		var minutes float64
+		if err := conf.Get(".canvas.chunkRetentionMinutes", &minutes); err != nil || minutes <= 0 {
+			log.Warnf("Invalid canvas.chunkRetentionMinutes, using default chunk retention")
+			break
+		}
+		options.ChunkRetention = chunkRetentionDuration
+		options.ChunkRetentionDuration = time.Duration(minutes * float64(time.Minute))
+	case "registered":
+		options.ChunkRetention = chunkRetentionRegistered
+	default:
+		log.Warnf("Unknown chunk retention %q, using default chunk retention", retention)
+	}
+
+	return options
 }
 
 type canvas struct {
+	PixelEvents uint64 // Amount of setPixel calls. Must be accessed atomically, and be the first field to ensure 64 bit alignment
+
 	sync.RWMutex
 	Closed      bool
 	ClosedMutex sync.RWMutex
 
 	ChunkSize pixelSize
 	Origin    image.Point     // Offset of the chunks in pixels. Positive values move the chunks to the top left.
-	Rect      image.Rectangle // Valid area of the canvas // TODO: Enforce canvas limit
+	Rect      image.Rectangle // Valid area of the canvas. Chunks, events and listener rectangles are clipped to it
 	Chunks    map[chunkCoordinate]*chunk
+	Options   canvasOptions
+
+	ListenerQueues map[canvasListener]*canvasListenerQueue // Queues of all subscribed listeners. Only used for metrics, the broadcaster goroutine manages its own list
+	ListenerRects  map[canvasListener][]image.Rectangle    // Rectangles registered by all listeners. Only used for chunkRetentionRegistered
 
 	Time time.Time
 
@@ -101,22 +169,38 @@ type canvas struct {
 	ChunkRequestChan chan *chunk      // Chunk download requests that go to the game connection
 }
 
-func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectangle) (*canvas, <-chan *chunk) {
+func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectangle, options canvasOptions) (*canvas, <-chan *chunk) {
 	can := &canvas{
 		ChunkSize:        chunkSize,
 		Origin:           origin,
-		Rect:             canvasRect,
+		Rect:             canvasRect.Canon(),
 		Chunks:           make(map[chunkCoordinate]*chunk),
+		Options:          options,
+		ListenerQueues:   make(map[canvasListener]*canvasListenerQueue),
+		ListenerRects:    make(map[canvasListener][]image.Rectangle),
 		EventChan:        make(chan interface{}), // TODO: Determine optimal chan size (Add waitGroup when channel buffering is enabled!)
 		ChunkRequestChan: make(chan *chunk, 500),
 	}
 
 	handleChunk := func(chunk *chunk, resetTime bool) {
-		switch chunk.getQueryState(resetTime) {
+		switch chunk.getQueryState(resetTime, can.Options) {
 		case chunkDelete:
 			can.Lock()
 			delete(can.Chunks, can.ChunkSize.getChunkCoord(chunk.Rect.Min, can.Origin))
 			can.Unlock()
+		case chunkDownloadFailed:
+			log.Warnf("Download of chunk at %v timed out", chunk.Rect)
+			can.ClosedMutex.RLock()
+			if !can.Closed {
+				can.EventChan <- canvasEventInvalidateRect{ // The chunk is already reset, just inform the listeners
+					Rect: chunk.Rect,
+				}
+			}
+			can.ClosedMutex.RUnlock()
+		case chunkCompress:
+			if err := chunk.compress(); err != nil {
+				log.Warnf("Can't compress chunk at %v: %v", chunk.Rect, err)
+			}
 		case chunkDownload:
 			select {
 			case can.ChunkRequestChan <- chunk: // Try to send a chunk request to the connection. If it fails --> bleh, retry next time
@@ -125,7 +209,25 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 		}
 	}
 
+	// Returns the time of the canvas.
+	// The broadcaster must not use getTime, as ClosedMutex.RLock would wait behind a pending Close, while the Close waits for the broadcaster
+	currentTime := func() time.Time {
+		can.RLock()
+		defer can.RUnlock()
+
+		return can.Time
+	}
+
 	rectQueryChan := make(chan image.Rectangle)
+	rectQueryQuit := make(chan struct{}) // Closing this stops the query goroutine and all pending requests. rectQueryChan itself is never closed, as there may be pending senders
+
+	// Sends a rectangle to the query goroutine, or gives up when the canvas is closed
+	requestRect := func(rect image.Rectangle) {
+		select {
+		case rectQueryChan <- rect:
+		case <-rectQueryQuit:
+		}
+	}
 
 	// Goroutine that handles chunk downloading (Queries the game connection for chunks)
 	go func() {
@@ -134,12 +236,10 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 
 		for {
 			select {
-			case rect, ok := <-rectQueryChan:
-				if !ok {
-					// Close goroutine, as the channel is gone
-					return
-				}
-				chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+			case <-rectQueryQuit:
+				return
+			case rect := <-rectQueryChan:
+				chunkRect := can.getChunkRectangle(rect)
 				chunks, err := can.getChunks(chunkRect, true, true)
 				if err == nil {
 					for _, chunk := range chunks {
@@ -149,6 +249,12 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 			case <-ticker.C: // Query all chunks for state changes regularly
 				chunks := can.getAllChunks()
 				for _, chunk := range chunks {
+					if can.Options.ChunkRetention == chunkRetentionRegistered && !can.isRegistered(chunk.Rect) {
+						can.Lock()
+						delete(can.Chunks, can.ChunkSize.getChunkCoord(chunk.Rect.Min, can.Origin))
+						can.Unlock()
+						continue
+					}
 					handleChunk(chunk, false) // Handle chunks, but don't reset their timer
 				}
 
@@ -156,19 +262,14 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 		}
 	}()
 
-	// Gets the list of virtual chunks that intersect with a given rectangle
+	// Gets the list of virtual chunks that intersect with a given rectangle.
+	// Virtual chunks have the same (clipped) rectangles as the real chunks.
 	getVirtualChunks := func(state *canvasListenerState, rect image.Rectangle, createNew bool) map[image.Rectangle]int {
 		vcs := map[image.Rectangle]int{}
-		chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+		chunkRect := can.getChunkRectangle(rect)
 		for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
 			for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
-				min := image.Point{ix*can.ChunkSize.X - can.Origin.X, iy*can.ChunkSize.Y - can.Origin.X}
-				max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
-
-				vc := image.Rectangle{
-					Min: min,
-					Max: max,
-				}
+				vc := can.getChunkPixelRect(chunkCoordinate{ix, iy})
 
 				vcID, ok := state.VirtualChunks[vc] // Get ID from already existing virtual chunk
 
@@ -187,14 +288,106 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 		return vcs
 	}
 
+	// Queues an event for a listener, and resynchronizes the listener if its queue overflowed and events got dropped
+	var sendImages func(state *canvasListenerState)
+	send := func(state *canvasListenerState, event canvasListenerEvent) {
+		if !state.Queue.push(event) {
+			state.Queue.pushForced(canvasListenerEventInvalidateAll{})
+			sendImages(state)
+			state.Queue.pushForced(canvasListenerEventSetTime{currentTime()})
+		}
+	}
+
+	// Sends the images of all chunks the listener knows of.
+	// That's either all chunks of the canvas, or the virtual chunks of the listener.
+	sendImages = func(state *canvasListenerState) {
+		if !state.UseVirtualChunks {
+			for _, chunk := range can.getAllChunks() {
+				img, valid, _, err := chunk.getImageCopy(false)
+				if err == nil {
+					state.Queue.pushForced(canvasListenerEventSetImage{img, valid, []int{}})
+				}
+			}
+			return
+		}
+
+		for rect, id := range state.VirtualChunks {
+			chunkCoord := can.ChunkSize.getChunkCoord(rect.Min, can.Origin)
+			chunk, err := can.getChunk(chunkCoord, false)
+			if err == nil {
+				img, valid, _, err := chunk.getImageCopy(false)
+				if err == nil {
+					state.Queue.pushForced(canvasListenerEventSetImage{img, valid, []int{id}})
+				}
+			}
+		}
+	}
+
+	// Returns the IDs of the virtual chunks of a listener as slice
+	getVirtualChunkIDs := func(state *canvasListenerState, rect image.Rectangle) []int {
+		vcsSlice := []int{}
+		for _, vc := range getVirtualChunks(state, rect, false) {
+			vcsSlice = append(vcsSlice, vc)
+		}
+		return vcsSlice
+	}
+
 	// Goroutine that handles event broadcasting to listeners
 	// It can directly broadcast events from the EventChan, or it can create new events for specific listeners.
 	// If requested (by the UseVirtualChunks flag) the goroutine will handle all the creation and deletion of (virtual) chunks for the listener.
+	// Events are not handled directly, but queued for each listener. See canvasListenerQueue.
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
 		listeners := map[canvasListener]*canvasListenerState{} // Events get forwarded to these listeners
-		defer close(rectQueryChan)
+		var subscriber canvasSubscriber
+		subscribed := map[image.Rectangle]struct{}{} // Chunk rectangles that are inside of any listener rectangle
+
+		// Updates the subscribed chunks after listener rectangles have changed, and informs the subscriber
+		updateSubscriptions := func() {
+			needed := map[image.Rectangle]struct{}{}
+			for _, state := range listeners {
+				for _, rect := range state.Rects {
+					chunkRect := can.getChunkRectangle(rect)
+					for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
+						for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
+							needed[can.getChunkPixelRect(chunkCoordinate{ix, iy})] = struct{}{}
+						}
+					}
+				}
+			}
+
+			added, removed := []image.Rectangle{}, []image.Rectangle{}
+			for rect := range needed {
+				if _, ok := subscribed[rect]; !ok {
+					added = append(added, rect)
+				}
+			}
+			for rect := range subscribed {
+				if _, ok := needed[rect]; !ok {
+					removed = append(removed, rect)
+				}
+			}
+			subscribed = needed
+
+			if subscriber != nil {
+				if len(removed) > 0 {
+					subscriber.unsubscribe(removed)
+				}
+				if len(added) > 0 {
+					subscriber.subscribe(added)
+				}
+			}
+		}
+		defer close(rectQueryQuit)
+		defer func() {
+			// Let the queues deliver their remaining events
+			for listener, state := range listeners {
+				state.Queue.close()
+				can.setListenerQueue(listener, nil)
+				can.setListenerRects(listener, nil)
+			}
+		}()
 
 		for {
 			select {
@@ -207,122 +400,124 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 				switch event := event.(type) {
 				case canvasEventSetPixel:
 					//log.Tracef("pixel %v\n", event.Pos)
-					for listener, state := range listeners {
+					for _, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleSetPixel(event.Pos, event.Color, 0)
+							send(state, canvasListenerEventSetPixel{event.Pos, event.Color, 0})
 							continue
 						}
 						vcs := getVirtualChunks(state, image.Rectangle{event.Pos, event.Pos.Add(image.Point{1, 1})}, false)
 						for _, vc := range vcs { // Assume that at most one virtual chunk is returned
 							//log.Tracef("pixel %v at vcID %v\n", event.Pos, vc)
-							listener.handleSetPixel(event.Pos, event.Color, vc)
+							send(state, canvasListenerEventSetPixel{event.Pos, event.Color, vc})
 							break
 						}
 					}
 				case canvasEventSetImage:
-					for listener, state := range listeners {
+					for _, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleSetImage(event.Image, true, []int{})
+							send(state, canvasListenerEventSetImage{event.Image, true, []int{}})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Image.Bounds(), false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleSetImage(event.Image, true, vcsSlice)
+						if vcsSlice := getVirtualChunkIDs(state, event.Image.Bounds()); len(vcsSlice) > 0 {
+							send(state, canvasListenerEventSetImage{event.Image, true, vcsSlice})
 						}
 					}
 				case canvasEventInvalidateRect:
-					for listener, state := range listeners {
+					for _, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleInvalidateRect(event.Rect, []int{})
+							send(state, canvasListenerEventInvalidateRect{event.Rect, []int{}})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleInvalidateRect(event.Rect, vcsSlice)
+						if vcsSlice := getVirtualChunkIDs(state, event.Rect); len(vcsSlice) > 0 {
+							send(state, canvasListenerEventInvalidateRect{event.Rect, vcsSlice})
 						}
 					}
 				case canvasEventInvalidateAll:
-					for listener := range listeners {
-						listener.handleInvalidateAll()
+					for _, state := range listeners {
+						send(state, canvasListenerEventInvalidateAll{})
 					}
 				case canvasEventRevalidate:
-					for listener, state := range listeners {
+					for _, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleRevalidateRect(event.Rect, []int{})
+							send(state, canvasListenerEventRevalidateRect{event.Rect, []int{}})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleRevalidateRect(event.Rect, vcsSlice)
+						if vcsSlice := getVirtualChunkIDs(state, event.Rect); len(vcsSlice) > 0 {
+							send(state, canvasListenerEventRevalidateRect{event.Rect, vcsSlice})
 						}
 					}
 				case canvasEventSignalDownload:
-					for listener, state := range listeners {
+					for _, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleSignalDownload(event.Rect, []int{})
+							send(state, canvasListenerEventSignalDownload{event.Rect, []int{}})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleSignalDownload(event.Rect, vcsSlice)
+						if vcsSlice := getVirtualChunkIDs(state, event.Rect); len(vcsSlice) > 0 {
+							send(state, canvasListenerEventSignalDownload{event.Rect, vcsSlice})
 						}
 					}
 				case canvasEventSetTime:
-					for listener := range listeners {
-						listener.handleSetTime(event.Time)
+					for _, state := range listeners {
+						send(state, canvasListenerEventSetTime{event.Time})
+					}
+				case canvasEventSetSubscriber:
+					subscriber = event.Subscriber
+					if subscriber != nil && len(subscribed) > 0 {
+						rects := []image.Rectangle{}
+						for rect := range subscribed {
+							rects = append(rects, rect)
+						}
+						subscriber.subscribe(rects)
 					}
 				case canvasEventListenerSubscribe:
 					//log.Tracef("Listener %v subscribed", event.Listener)
-					listeners[event.Listener] = &canvasListenerState{
+					var queue *canvasListenerQueue
+					if state, ok := listeners[event.Listener]; ok {
+						queue = state.Queue // Subscribed twice, keep the queue so events are still delivered in order
+					} else {
+						queue = newCanvasListenerQueue(event.Listener)
+					}
+					state := &canvasListenerState{
 						UseVirtualChunks:      event.UseVirtualChunks,
 						VirtualChunkIDCounter: 1,
+						Queue:                 queue,
 					}
+					listeners[event.Listener] = state
+					can.setListenerQueue(event.Listener, state.Queue)
 
 					// If the canvas doesn't handle the listeners chunks, just send all chunks for initialization
-					if !event.UseVirtualChunks {
-						chunks := can.getAllChunks()
-						for _, chunk := range chunks {
-							img, valid, _, err := chunk.getImageCopy(false)
-							if err == nil {
-								event.Listener.handleSetImage(img, valid, []int{})
-							}
-						}
-					}
+					sendImages(state)
 
-					t, err := can.getTime()
-					if err == nil {
-						event.Listener.handleSetTime(t)
-					}
+					send(state, canvasListenerEventSetTime{currentTime()})
 
 				case canvasEventListenerUnsubscribe:
 					//log.Tracef("Listener %v unsubscribed", event.Listener)
+					state, ok := listeners[event.Listener]
+					if !ok {
+						close(event.Done)
+						break
+					}
 					delete(listeners, event.Listener)
+					can.setListenerQueue(event.Listener, nil)
+					can.setListenerRects(event.Listener, nil)
+					updateSubscriptions()
+					state.Queue.close()
+					go func(queue *canvasListenerQueue, done chan struct{}) {
+						<-queue.Done
+						close(done)
+					}(state.Queue, event.Done)
 				case canvasEventListenerRects:
 					state, ok := listeners[event.Listener]
 					if ok {
 						//log.Tracef("Listener %v changed rects to %v", event.Listener, event.Rects)
 
 						state.Rects = event.Rects
+						can.setListenerRects(event.Listener, event.Rects)
+						updateSubscriptions() // Before the download requests, so the subscriber knows the chunks when they are downloaded
 
 						// Make download query for rects
 						for _, rect := range state.Rects {
-							go func(rect image.Rectangle) { rectQueryChan <- rect }(rect) // Async download request
+							go requestRect(rect) // Async download request
 						}
 
 						if !state.UseVirtualChunks {
@@ -357,7 +552,7 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 						state.VirtualChunks = neededChunks
 
 						if len(createChunks) > 0 || len(removeChunks) > 0 {
-							event.Listener.handleChunksChange(createChunks, removeChunks)
+							send(state, canvasListenerEventChunksChange{createChunks, removeChunks})
 						}
 
 						// Additionally send images for the new chunks if possible
@@ -367,7 +562,7 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 							if err == nil {
 								img, valid, _, err := chunk.getImageCopy(false)
 								if err == nil {
-									event.Listener.handleSetImage(img, valid, []int{id})
+									send(state, canvasListenerEventSetImage{img, valid, []int{id}})
 								}
 							}
 						}
@@ -379,7 +574,7 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 			case <-ticker.C: // Query all rects every minute
 				for _, state := range listeners {
 					for _, rect := range state.Rects {
-						go func(rect image.Rectangle) { rectQueryChan <- rect }(rect) // Async download request
+						go requestRect(rect) // Async download request
 					}
 				}
 			}
@@ -414,22 +609,87 @@ func (can *canvas) subscribeListener(l canvasListener, useVirtualChunks bool) er
 	return nil
 }
 
+// Unsubscribes a listener from canvas events.
+//
+// This blocks until all queued events are handled by the listener.
+// Don't call this function from the same context that handles events, or it will cause a deadlock.
 func (can *canvas) unsubscribeListener(l canvasListener) error {
 	can.ClosedMutex.RLock()
-	defer can.ClosedMutex.RUnlock()
 	if can.Closed {
+		can.ClosedMutex.RUnlock()
 		return fmt.Errorf("Canvas is closed")
 	}
 
 	// Forward event to broadcaster goroutine, even if there isn't a chunk.
+	done := make(chan struct{})
 	can.EventChan <- canvasEventListenerUnsubscribe{
 		Listener: l,
+		Done:     done,
 	}
+	can.ClosedMutex.RUnlock()
+
+	<-done
 
 	return nil
 }
 
+// Stores or removes the queue of a listener for metrics
+func (can *canvas) setListenerQueue(l canvasListener, queue *canvasListenerQueue) {
+	can.Lock()
+	defer can.Unlock()
+
+	if queue == nil {
+		delete(can.ListenerQueues, l)
+	} else {
+		can.ListenerQueues[l] = queue
+	}
+}
+
+// Stores or removes the registered rectangles of a listener
+func (can *canvas) setListenerRects(l canvasListener, rects []image.Rectangle) {
+	can.Lock()
+	defer can.Unlock()
+
+	if rects == nil {
+		delete(can.ListenerRects, l)
+	} else {
+		can.ListenerRects[l] = rects
+	}
+}
+
+// Returns whether the rectangle intersects with any rectangle registered by a listener
+func (can *canvas) isRegistered(rect image.Rectangle) bool {
+	can.RLock()
+	defer can.RUnlock()
+
+	for _, rects := range can.ListenerRects {
+		for _, r := range rects {
+			if r.Overlaps(rect) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the amount of queued events, summed up by listener name
+func (can *canvas) getListenerQueueLengths() map[string]int {
+	can.RLock()
+	queues := []*canvasListenerQueue{}
+	for _, queue := range can.ListenerQueues {
+		queues = append(queues, queue)
+	}
+	can.RUnlock()
+
+	lengths := map[string]int{}
+	for _, queue := range queues {
+		lengths[queue.Options.Name] += queue.length()
+	}
+	return lengths
+}
+
 // Register a number of rectangles that the listener needs to be kept up to date with.
+// The rectangles are clipped to the canvas.
 //
 // This function will silently fail if the listener isn't subscribed already.
 //
@@ -444,7 +704,23 @@ func (can *canvas) registerRects(l canvasListener, rects []image.Rectangle) erro
 	// Forward event to broadcaster goroutine, even if there isn't a chunk.
 	can.EventChan <- canvasEventListenerRects{
 		Listener: l,
-		Rects:    rects,
+		Rects:    can.clipRects(rects),
+	}
+
+	return nil
+}
+
+// Sets the subscriber that gets told which chunks are inside of listener rectangles.
+// It's immediately informed about all currently subscribed chunks.
+func (can *canvas) setSubscriber(sub canvasSubscriber) error {
+	can.ClosedMutex.RLock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return fmt.Errorf("Canvas is closed")
+	}
+
+	can.EventChan <- canvasEventSetSubscriber{
+		Subscriber: sub,
 	}
 
 	return nil
@@ -465,14 +741,11 @@ func (can *canvas) getChunk(coord chunkCoordinate, createIfNonexistent bool) (*c
 	}
 
 	if createIfNonexistent {
-		min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.X}
-		max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
-		chunk := newChunk(
-			image.Rectangle{
-				Min: min,
-				Max: max,
-			},
-		)
+		rect := can.getChunkPixelRect(coord)
+		if rect.Empty() {
+			return nil, fmt.Errorf("Chunk at %v is outside of the canvas %v", coord, can.Rect)
+		}
+		chunk := newChunk(rect)
 
 		can.Chunks[coord] = chunk
 
@@ -482,8 +755,69 @@ func (can *canvas) getChunk(coord chunkCoordinate, createIfNonexistent bool) (*c
 	return nil, fmt.Errorf("Chunk at %v does not exist", coord)
 }
 
+// Returns the pixel rectangle of the chunk at the given coordinate, clipped to the canvas.
+// The result is empty if the chunk is completely outside of the canvas.
+func (can *canvas) getChunkPixelRect(coord chunkCoordinate) image.Rectangle {
+	min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.Y}
+	max := min.Add(image.Point(can.ChunkSize))
+
+	return image.Rectangle{min, max}.Intersect(can.Rect)
+}
+
+// Converts a pixel rectangle into the rectangle of all chunks that intersect with it.
+// Only chunks inside of the canvas are included.
+func (can *canvas) getChunkRectangle(rect image.Rectangle) chunkRectangle {
+	rect = rect.Canon().Intersect(can.Rect)
+	if rect.Empty() {
+		return chunkRectangle{}
+	}
+
+	return can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+}
+
+// Converts a pixel rectangle into the rectangle of all chunks that are completely inside of it.
+// As chunks are clipped to the canvas, chunks at the border only need to be covered inside of the canvas.
+func (can *canvas) getInnerChunkRectangle(rect image.Rectangle) chunkRectangle {
+	rect = rect.Canon()
+	if rect.Intersect(can.Rect).Empty() {
+		return chunkRectangle{}
+	}
+
+	// Extend the rectangle to the chunk grid, wherever it reaches the border of the canvas
+	outer := can.ChunkSize.getOuterChunkRect(can.Rect, can.Origin).getPixelRectangle(can.ChunkSize, can.Origin)
+	if rect.Min.X <= can.Rect.Min.X {
+		rect.Min.X = outer.Min.X
+	}
+	if rect.Min.Y <= can.Rect.Min.Y {
+		rect.Min.Y = outer.Min.Y
+	}
+	if rect.Max.X >= can.Rect.Max.X {
+		rect.Max.X = outer.Max.X
+	}
+	if rect.Max.Y >= can.Rect.Max.Y {
+		rect.Max.Y = outer.Max.Y
+	}
+
+	return can.ChunkSize.getInnerChunkRect(rect, can.Origin)
+}
+
+// Clips the rectangles to the canvas. Rectangles that are completely outside are removed.
+func (can *canvas) clipRects(rects []image.Rectangle) []image.Rectangle {
+	clipped := []image.Rectangle{}
+	for _, rect := range rects {
+		rect = rect.Canon().Intersect(can.Rect)
+		if !rect.Empty() {
+			clipped = append(clipped, rect)
+		}
+	}
+
+	return clipped
+}
+
+// Returns all chunks inside the given chunk rectangle.
+// Chunk coordinates outside of the canvas are skipped.
 func (can *canvas) getChunks(rect chunkRectangle, createIfNonexistent, ignoreNonexistent bool) ([]*chunk, error) {
-	rectTemp := rect.Canon()
+	rectTemp := rect.Canon().Intersect(can.ChunkSize.getOuterChunkRect(can.Rect, can.Origin).Rectangle)
 	chunks := []*chunk{}
 
 	for iy := rectTemp.Min.Y; iy < rectTemp.Max.Y; iy++ {
@@ -515,6 +849,32 @@ func (can *canvas) getAllChunks() []*chunk {
 	return chunks
 }
 
+// Returns the amount of chunks by their state.
+// Compressed chunks are also counted as valid.
+func (can *canvas) getChunkStats() (valid, downloading, invalid, compressed int) {
+	for _, chunk := range can.getAllChunks() {
+		if chunk.isCompressed() {
+			compressed++
+		}
+		chunkValid, chunkDownloading := chunk.getState()
+		switch {
+		case chunkValid:
+			valid++
+		case chunkDownloading:
+			downloading++
+		default:
+			invalid++
+		}
+	}
+
+	return
+}
+
+// Returns the amount of pixel changes the canvas has received
+func (can *canvas) getPixelEvents() uint64 {
+	return atomic.LoadUint64(&can.PixelEvents)
+}
+
 func (can *canvas) getPixel(pos image.Point) (color.Color, error) {
 	chunkCoord := can.ChunkSize.getChunkCoord(pos, can.Origin)
 
@@ -544,6 +904,12 @@ func (can *canvas) setPixel(pos image.Point, col color.Color) error {
 		return fmt.Errorf("Canvas is closed")
 	}
 
+	if !pos.In(can.Rect) {
+		return fmt.Errorf("Position %v is outside of the canvas %v", pos, can.Rect)
+	}
+
+	atomic.AddUint64(&can.PixelEvents, 1)
+
 	// Forward event to broadcaster goroutine, even if there isn't a chunk. But send it after the chunk has been updated
 	defer func() {
 		can.EventChan <- canvasEventSetPixel{
@@ -575,16 +941,23 @@ func (can *canvas) setImage(img image.Image, createIfNonexistent, ignoreNonexist
 		return fmt.Errorf("Canvas is closed")
 	}
 
-	chunkRect := can.ChunkSize.getInnerChunkRect(img.Bounds(), can.Origin)
+	chunkRect := can.getInnerChunkRectangle(img.Bounds())
 	chunks, err := can.getChunks(chunkRect, createIfNonexistent, ignoreNonexistent)
 	if err != nil {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", img.Bounds(), err)
 	}
 
-	// Copy image, because the chunks will use a subimage of this copy. Otherwise the original image will be edited
-	imgCopy, err := copyImage(img)
+	// Convert image into the format of the canvas
+	imgCopy, err := can.Options.ColorModel.convertImage(img)
 	if err != nil {
-		return fmt.Errorf("Can't copy image at %v: %v", img.Bounds(), err)
+		return fmt.Errorf("Can't convert image at %v to color model %v: %v", img.Bounds(), can.Options.ColorModel, err)
+	}
+
+	// Copy image, because the chunks will use a subimage of this copy. Otherwise the original image will be edited
+	if imgCopy == img {
+		if imgCopy, err = copyImage(img); err != nil {
+			return fmt.Errorf("Can't copy image at %v: %v", img.Bounds(), err)
+		}
 	}
 
 	for _, chunk := range chunks {
@@ -638,6 +1011,7 @@ func (can *canvas) getImageCopy(rect image.Rectangle, onlyIfValid, ignoreNonexis
 
 // Invalidates all chunks the rectangle intersects with.
 // This will only affect existing chunks.
+// The rectangle is clipped to the canvas, the event will contain the clipped rectangle.
 //
 // This should be used to signal connection loss or something that caused specific chunks to go out of sync.
 func (can *canvas) invalidateRect(rect image.Rectangle) error {
@@ -647,6 +1021,11 @@ func (can *canvas) invalidateRect(rect image.Rectangle) error {
 		return fmt.Errorf("Canvas is closed")
 	}
 
+	rect = rect.Canon().Intersect(can.Rect)
+	if rect.Empty() {
+		return nil // Nothing to do outside of the canvas
+	}
+
 	// Forward event to broadcaster goroutine. But send after chunks have been invalidated
 	defer func() {
 		can.EventChan <- canvasEventInvalidateRect{
@@ -654,7 +1033,7 @@ func (can *canvas) invalidateRect(rect image.Rectangle) error {
 		}
 	}()
 
-	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+	chunkRect := can.getChunkRectangle(rect)
 	chunks, err := can.getChunks(chunkRect, false, true)
 	if err != nil {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
@@ -677,6 +1056,11 @@ func (can *canvas) revalidateRect(rect image.Rectangle) error {
 		return fmt.Errorf("Canvas is closed")
 	}
 
+	rect = rect.Canon().Intersect(can.Rect)
+	if rect.Empty() {
+		return nil // Nothing to do outside of the canvas
+	}
+
 	// Forward event to broadcaster goroutine. But send after chunks have been revalidated
 	defer func() {
 		can.EventChan <- canvasEventRevalidate{
@@ -684,7 +1068,7 @@ func (can *canvas) revalidateRect(rect image.Rectangle) error {
 		}
 	}()
 
-	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+	chunkRect := can.getChunkRectangle(rect)
 	chunks, err := can.getChunks(chunkRect, false, true)
 	if err != nil {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
@@ -754,16 +1138,17 @@ func (can *canvas) getTime() (time.Time, error) {
 	return can.Time, nil
 }
 
-// Returns true if the all intersecting chunks are valid and existent
+// Returns true if the all intersecting chunks are valid and existent.
+// Only the part of the rectangle that is inside of the canvas is checked.
 func (can *canvas) isValid(rect image.Rectangle) bool {
-	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+	chunkRect := can.getChunkRectangle(rect)
 	chunks, err := can.getChunks(chunkRect, false, false)
 	if err != nil {
 		return false
 	}
 
 	for _, chunk := range chunks {
-		if !chunk.Valid {
+		if !chunk.isValid() {
 			return false
 		}
 	}
@@ -789,6 +1174,11 @@ func (can *canvas) signalDownload(rect image.Rectangle) ([]*chunk, error) {
 		return nil, fmt.Errorf("Canvas is closed")
 	}
 
+	rect = rect.Canon().Intersect(can.Rect)
+	if rect.Empty() {
+		return []*chunk{}, nil // Nothing to do outside of the canvas
+	}
+
 	// Forward event to broadcaster goroutine. But send after chunks have been flagged
 	defer func() {
 		can.EventChan <- canvasEventSignalDownload{
@@ -796,7 +1186,7 @@ func (can *canvas) signalDownload(rect image.Rectangle) ([]*chunk, error) {
 		}
 	}()
 
-	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+	chunkRect := can.getChunkRectangle(rect)
 	chunks, err := can.getChunks(chunkRect, true, true)
 	if err != nil {
 		return nil, fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
@@ -813,10 +1203,41 @@ func (can *canvas) signalDownload(rect image.Rectangle) ([]*chunk, error) {
 	return downloading, nil
 }
 
-func (can *canvas) Close() {
+// Signals that the download of the chunks inside the rectangle failed.
+// Those chunks are reset to invalid, and will be downloaded again after some delay.
+// Connections should call this when they can't call setImage() after signalDownload().
+func (can *canvas) failDownload(rect image.Rectangle) error {
 	can.ClosedMutex.RLock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return fmt.Errorf("Canvas is closed")
+	}
+
+	rect = rect.Canon().Intersect(can.Rect)
+	if rect.Empty() {
+		return nil // Nothing to do outside of the canvas
+	}
+
+	// Only existing chunks can be downloading, so there is no need to go through all chunk coordinates of the rectangle
+	for _, chunk := range can.getAllChunks() {
+		if !chunk.Rect.Overlaps(rect) {
+			continue
+		}
+		if chunk.failDownload() {
+			// Forward event to broadcaster goroutine, so listeners know the chunk isn't downloading anymore
+			can.EventChan <- canvasEventInvalidateRect{
+				Rect: chunk.Rect,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (can *canvas) Close() {
+	can.ClosedMutex.Lock()
 	can.Closed = true // Prevent any new events from happening
-	can.ClosedMutex.RUnlock()
+	can.ClosedMutex.Unlock()
 
 	close(can.EventChan) // This will stop the goroutine after all events are processed
 
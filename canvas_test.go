@@ -18,10 +18,362 @@ package main
 
 import (
 	"image"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_newCanvas(t *testing.T) {
-	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect, canvasOptions{})
 	defer can.Close()
 }
+
+// Listener that stores the received chunk rectangles and invalidated rectangles
+type testRectListener struct {
+	testListener
+
+	sync.Mutex
+	Chunks      map[image.Rectangle]int
+	Invalidated []image.Rectangle
+}
+
+func (l *testRectListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for rect, id := range create {
+		l.Chunks[rect] = id
+	}
+	for rect := range remove {
+		delete(l.Chunks, rect)
+	}
+	return nil
+}
+
+func (l *testRectListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.Invalidated = append(l.Invalidated, rect)
+	return nil
+}
+
+func Test_canvasBounds(t *testing.T) {
+	// The edges of the canvas don't align with the chunk grid
+	canvasRect := image.Rect(-100, -100, 100, 50)
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, canvasRect, canvasOptions{})
+	defer can.Close()
+
+	if _, err := can.getChunk(chunkCoordinate{5, 5}, true); err == nil {
+		t.Errorf("Chunk outside of the canvas was created")
+	}
+	chu, err := can.getChunk(chunkCoordinate{-2, -2}, true)
+	if err != nil {
+		t.Fatalf("Can't create chunk at the border: %v", err)
+	}
+	if want := image.Rect(-100, -100, -64, -64); chu.Rect != want {
+		t.Errorf("Border chunk has rectangle %v, want %v", chu.Rect, want)
+	}
+
+	if err := can.setPixel(image.Point{100, 0}, pixelcanvasioPalette[1]); err == nil {
+		t.Errorf("Pixel outside of the canvas was set")
+	}
+
+	chunks, err := can.signalDownload(image.Rect(-1000, -1000, 1000, 1000))
+	if err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if len(chunks) != 4*3 {
+		t.Errorf("signalDownload() returned %v chunks, want %v", len(chunks), 4*3)
+	}
+	for _, chu := range can.getAllChunks() {
+		if !chu.Rect.In(canvasRect) || chu.Rect.Empty() {
+			t.Errorf("Chunk %v is not inside of the canvas", chu.Rect)
+		}
+	}
+
+	// An image that covers the canvas exactly has to validate all chunks, including the smaller ones at the border
+	img := image.NewPaletted(canvasRect, pixelcanvasioPalette)
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	if !can.isValid(image.Rect(-1000, -1000, 1000, 1000)) {
+		t.Errorf("Canvas isn't valid after setting an image that covers it")
+	}
+
+	if chunks, err := can.signalDownload(image.Rect(200, 200, 300, 300)); err != nil || len(chunks) != 0 {
+		t.Errorf("signalDownload() outside of the canvas = %v, %v, want no chunks", chunks, err)
+	}
+
+	// Listeners only get rectangles inside of the canvas
+	l := &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l, true)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{image.Rect(-1000, -1000, 1000, 1000), image.Rect(500, 500, 600, 600)})
+	can.invalidateRect(image.Rect(-1000, 0, 0, 1000))
+	can.invalidateRect(image.Rect(500, 500, 600, 600))
+
+	waitFor(t, "invalidation", func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return len(l.Invalidated) > 0
+	})
+
+	l.Lock()
+	defer l.Unlock()
+	if len(l.Chunks) != 4*3 {
+		t.Errorf("Listener got %v chunks, want %v", len(l.Chunks), 4*3)
+	}
+	for rect := range l.Chunks {
+		if !rect.In(canvasRect) {
+			t.Errorf("Listener got chunk %v outside of the canvas", rect)
+		}
+	}
+	if want := []image.Rectangle{image.Rect(-100, 0, 0, 50)}; !reflect.DeepEqual(l.Invalidated, want) {
+		t.Errorf("Listener got invalidated rectangles %v, want %v", l.Invalidated, want)
+	}
+}
+
+func Test_canvasOrigin(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 32}, image.Point{5, 10}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	chu, err := can.getChunk(chunkCoordinate{1, 1}, true)
+	if err != nil {
+		t.Fatalf("Can't create chunk: %v", err)
+	}
+	if want := image.Rect(59, 22, 123, 54); chu.Rect != want {
+		t.Errorf("Chunk has rectangle %v, want %v", chu.Rect, want)
+	}
+	if coord := can.ChunkSize.getChunkCoord(chu.Rect.Min, can.Origin); coord != (chunkCoordinate{1, 1}) {
+		t.Errorf("Chunk rectangle maps to coordinate %v, want %v", coord, chunkCoordinate{1, 1})
+	}
+}
+
+func Test_chunkRetention(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		valid   bool
+		options canvasOptions
+		want    chunkQueryResult
+	}{
+		{"Default invalid", false, canvasOptions{}, chunkDelete},
+		{"Default valid", true, canvasOptions{}, chunkCompress},
+		{"Never invalid", false, canvasOptions{ChunkRetention: chunkRetentionNever}, chunkDownload},
+		{"Duration valid", true, canvasOptions{ChunkRetention: chunkRetentionDuration, ChunkRetentionDuration: 30 * time.Minute}, chunkDelete},
+		{"Duration not expired", true, canvasOptions{ChunkRetention: chunkRetentionDuration, ChunkRetentionDuration: 2 * time.Hour}, chunkCompress},
+		{"Registered invalid", false, canvasOptions{ChunkRetention: chunkRetentionRegistered}, chunkDownload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chu := newChunk(image.Rect(0, 0, 64, 64))
+			if tt.valid {
+				chu.signalDownload()
+				if _, err := chu.setImage(image.NewPaletted(chu.Rect, pixelcanvasioPalette)); err != nil {
+					t.Fatalf("setImage() failed: %v", err)
+				}
+			}
+			chu.LastQueryTime, chu.LastInvalidationTime, chu.LastChangeTime = old, old, old
+
+			if got := chu.getQueryState(false, tt.options); got != tt.want {
+				t.Errorf("getQueryState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_canvasIsRegistered(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{ChunkRetention: chunkRetentionRegistered})
+	defer can.Close()
+
+	l := &testListener{}
+	can.subscribeListener(l, false)
+	can.registerRects(l, []image.Rectangle{image.Rect(0, 0, 10, 10)})
+
+	waitFor(t, "registered rectangles", func() bool { return can.isRegistered(image.Rect(0, 0, 64, 64)) })
+	if can.isRegistered(image.Rect(64, 0, 128, 64)) {
+		t.Errorf("Chunk outside of the registered rectangles is registered")
+	}
+
+	can.unsubscribeListener(l)
+	if can.isRegistered(image.Rect(0, 0, 64, 64)) {
+		t.Errorf("Rectangles of unsubscribed listener are still registered")
+	}
+}
+
+// Subscriber that stores the subscribed chunk rectangles
+type testSubscriber struct {
+	sync.Mutex
+	Subscribed map[image.Rectangle]bool
+}
+
+func (sub *testSubscriber) subscribe(rects []image.Rectangle) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	for _, rect := range rects {
+		sub.Subscribed[rect] = true
+	}
+}
+
+func (sub *testSubscriber) unsubscribe(rects []image.Rectangle) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	for _, rect := range rects {
+		delete(sub.Subscribed, rect)
+	}
+}
+
+func (sub *testSubscriber) get() map[image.Rectangle]bool {
+	sub.Lock()
+	defer sub.Unlock()
+
+	result := map[image.Rectangle]bool{}
+	for rect := range sub.Subscribed {
+		result[rect] = true
+	}
+	return result
+}
+
+func Test_canvasSubscriber(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-100, -100, 100, 100), canvasOptions{})
+	defer can.Close()
+
+	l1, l2 := &testListener{}, &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l1, false)
+	can.subscribeListener(l2, true)
+	can.registerRects(l1, []image.Rectangle{image.Rect(0, 0, 10, 10)})
+
+	// Existing subscriptions are sent when the subscriber is set
+	sub := &testSubscriber{Subscribed: map[image.Rectangle]bool{}}
+	can.setSubscriber(sub)
+	waitFor(t, "initial subscription", func() bool {
+		return reflect.DeepEqual(sub.get(), map[image.Rectangle]bool{image.Rect(0, 0, 64, 64): true})
+	})
+
+	// Chunks are clipped to the canvas, and shared chunks are only unsubscribed when no listener needs them
+	can.registerRects(l2, []image.Rectangle{image.Rect(-70, 0, 70, 10)})
+	waitFor(t, "subscription of second listener", func() bool {
+		return reflect.DeepEqual(sub.get(), map[image.Rectangle]bool{
+			image.Rect(-100, 0, -64, 64): true,
+			image.Rect(-64, 0, 0, 64):    true,
+			image.Rect(0, 0, 64, 64):     true,
+			image.Rect(64, 0, 100, 64):   true,
+		})
+	})
+	can.unsubscribeListener(l2)
+	waitFor(t, "unsubscription", func() bool {
+		return reflect.DeepEqual(sub.get(), map[image.Rectangle]bool{image.Rect(0, 0, 64, 64): true})
+	})
+
+	can.registerRects(l1, nil)
+	waitFor(t, "empty subscriptions", func() bool { return len(sub.get()) == 0 })
+}
+
+// Game connection stand-in, that fails the first download of every chunk and succeeds afterwards
+type testFailingConnection struct {
+	sync.Mutex
+	Canvas   *canvas
+	Attempts map[image.Rectangle]int
+	Quit     chan struct{}
+}
+
+func (con *testFailingConnection) run(chunkRequests <-chan *chunk) {
+	for {
+		select {
+		case chu := <-chunkRequests:
+			if chu.getQueryState(false, con.Canvas.Options) != chunkDownload {
+				continue
+			}
+			if _, err := con.Canvas.signalDownload(chu.Rect); err != nil {
+				continue
+			}
+			con.Lock()
+			con.Attempts[chu.Rect]++
+			attempts := con.Attempts[chu.Rect]
+			con.Unlock()
+
+			if attempts == 1 {
+				con.Canvas.failDownload(chu.Rect)
+			} else {
+				con.Canvas.setImage(image.NewPaletted(chu.Rect, pixelcanvasioPalette), false, true)
+			}
+		case <-con.Quit:
+			return
+		}
+	}
+}
+
+func Test_canvasDownloadRetry(t *testing.T) {
+	can, chunkRequests := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	con := &testFailingConnection{Canvas: can, Attempts: map[image.Rectangle]int{}, Quit: make(chan struct{})}
+	go con.run(chunkRequests)
+	defer close(con.Quit)
+
+	rect := image.Rect(0, 0, 64, 64)
+	l := &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l, true)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{rect})
+
+	// The failed download has to be reported to the listener, and the chunk has to wait before it's retried
+	waitFor(t, "failed download", func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return len(l.Invalidated) > 0
+	})
+	chu, err := can.getChunk(chunkCoordinate{0, 0}, false)
+	if err != nil {
+		t.Fatalf("Chunk doesn't exist: %v", err)
+	}
+	if valid, downloading := chu.getState(); valid || downloading {
+		t.Errorf("Chunk is valid: %v, downloading: %v after a failed download", valid, downloading)
+	}
+	if got := chu.getQueryState(false, can.Options); got != chunkKeep {
+		t.Errorf("getQueryState() = %v right after a failed download, want %v", got, chunkKeep)
+	}
+
+	// After the delay, the download is retried
+	chu.Lock()
+	chu.RetryTime = time.Now()
+	chu.Unlock()
+	can.registerRects(l, []image.Rectangle{rect})
+	waitFor(t, "retried download", func() bool { return can.isValid(rect) })
+
+	chu.RLock()
+	defer chu.RUnlock()
+	if chu.DownloadFailures != 0 {
+		t.Errorf("Chunk has %v download failures after a successful download", chu.DownloadFailures)
+	}
+}
+
+func Test_chunkDownloadTimeout(t *testing.T) {
+	chu := newChunk(image.Rect(0, 0, 64, 64))
+
+	delays := []time.Duration{}
+	for i := 0; i < 10; i++ {
+		if !chu.signalDownload() {
+			t.Fatalf("Can't signal download")
+		}
+		chu.DownloadDeadline = time.Now().Add(-time.Second) // Let the download time out
+		if got := chu.getQueryState(false, canvasOptions{}); got != chunkDownloadFailed {
+			t.Fatalf("getQueryState() = %v for a stuck download, want %v", got, chunkDownloadFailed)
+		}
+		delays = append(delays, time.Until(chu.RetryTime))
+		chu.RetryTime = time.Time{}
+	}
+
+	if delays[0] > chunkRetryDelayMin || delays[1] <= chunkRetryDelayMin {
+		t.Errorf("Retry delays %v don't grow exponentially", delays)
+	}
+	if last := delays[len(delays)-1]; last > chunkRetryDelayMax || last < chunkRetryDelayMax-time.Second {
+		t.Errorf("Last retry delay is %v, want %v", last, chunkRetryDelayMax)
+	}
+}
@@ -0,0 +1,237 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"time"
+)
+
+// Pixel that changed between two points in time
+type canvasDiffPixel struct {
+	Pos           image.Point
+	Before, After color.Color
+}
+
+// Changes of a rectangle between two points in time
+type canvasDiff struct {
+	Rect   image.Rectangle
+	Pixels []canvasDiffPixel
+	Image  *image.RGBA // Unchanged pixels are faded out, changed pixels are drawn with their new color
+}
+
+// Compares two images inside of the given rectangle.
+// Transparent pixels are treated as unknown, as they belong to chunks that weren't available.
+func diffImages(before, after image.Image, rect image.Rectangle) *canvasDiff {
+	diff := &canvasDiff{
+		Rect:  rect,
+		Image: image.NewRGBA(rect),
+	}
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			colBefore := color.RGBAModel.Convert(before.At(x, y)).(color.RGBA)
+			colAfter := color.RGBAModel.Convert(after.At(x, y)).(color.RGBA)
+
+			if colBefore != colAfter && colBefore.A != 0 && colAfter.A != 0 {
+				diff.Pixels = append(diff.Pixels, canvasDiffPixel{
+					Pos:    image.Point{x, y},
+					Before: colBefore,
+					After:  colAfter,
+				})
+				diff.Image.SetRGBA(x, y, colAfter)
+				continue
+			}
+
+			// Fade out unchanged pixels, so that the changes stand out
+			diff.Image.SetRGBA(x, y, color.RGBA{colAfter.R/4 + 191, colAfter.G/4 + 191, colAfter.B/4 + 191, 255})
+		}
+	}
+
+	return diff
+}
+
+// Replays the recordings of a connection up to the given time, and returns the image of the rectangle at that point.
+// It fails if the replay doesn't reach the time within the timeout.
+func canvasDiskReaderImage(shortName string, t time.Time, rect image.Rectangle, timeout time.Duration) (*image.RGBA, error) {
+	con, can, err := newCanvasDiskReader(shortName)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+	cdr := con.(*canvasDiskReader)
+
+	cdr.setReplayTime(t)
+
+	// The reader sets the canvas time to the destination time, once all events up to it are replayed
+	deadline := time.Now().Add(timeout)
+	for {
+		canTime, err := can.getTime()
+		if err != nil {
+			return nil, fmt.Errorf("Can't get time of replay: %v", err)
+		}
+		if canTime.Equal(t) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Replay didn't reach %v within %v, it stopped at %v", t, timeout, canTime)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return can.getImageCopy(rect, false, true)
+}
+
+// Returns the changes of a rectangle between two points in time of a recording
+func diffRecording(shortName string, from, to time.Time, rect image.Rectangle, timeout time.Duration) (*canvasDiff, error) {
+	before, err := canvasDiskReaderImage(shortName, from, rect, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't replay %v to %v: %v", shortName, from, err)
+	}
+	after, err := canvasDiskReaderImage(shortName, to, rect, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't replay %v to %v: %v", shortName, to, err)
+	}
+
+	return diffImages(before, after, rect), nil
+}
+
+// Returns the image of the rectangle stored in a snapshot file
+func canvasSnapshotImage(filePath string, rect image.Rectangle) (*image.RGBA, error) {
+	snap, err := loadCanvasSnapshotFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	can, _, err := newCanvasFromSnapshot(snap, canvasOptions{ChunkRetention: chunkRetentionNever})
+	if err != nil {
+		return nil, err
+	}
+	defer can.Close()
+
+	return can.getImageCopy(rect, false, true)
+}
+
+// Returns the changes of a rectangle between two snapshot files
+func diffSnapshots(fromPath, toPath string, rect image.Rectangle) (*canvasDiff, error) {
+	before, err := canvasSnapshotImage(fromPath, rect)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read snapshot %v: %v", fromPath, err)
+	}
+	after, err := canvasSnapshotImage(toPath, rect)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read snapshot %v: %v", toPath, err)
+	}
+
+	return diffImages(before, after, rect), nil
+}
+
+// Writes the changed pixels as CSV, one pixel per line
+func (diff *canvasDiff) writeCSV(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "x,y,before,after"); err != nil {
+		return err
+	}
+	for _, pixel := range diff.Pixels {
+		before, after := color.RGBAModel.Convert(pixel.Before).(color.RGBA), color.RGBAModel.Convert(pixel.After).(color.RGBA)
+		if _, err := fmt.Fprintf(w, "%d,%d,#%02x%02x%02x,#%02x%02x%02x\n", pixel.Pos.X, pixel.Pos.Y, before.R, before.G, before.B, after.R, after.G, after.B); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Command line tool that writes the changes between two points in time.
+//
+//	D3pixelbot diff -recording pixelcanvasio -from 2019-06-01T22:00:00Z -to 2019-06-02T08:00:00Z -rect 0,0,256,256
+//	D3pixelbot diff -fromsnapshot a.pixsnap -tosnapshot b.pixsnap -rect 0,0,256,256
+func cliDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	recording := flags.String("recording", "", "Short name of the recorded connection, e.g. pixelcanvasio")
+	fromString := flags.String("from", "", "Start time in RFC3339 format")
+	toString := flags.String("to", "", "End time in RFC3339 format")
+	fromSnapshot := flags.String("fromsnapshot", "", "Snapshot file of the start state, instead of a recording")
+	toSnapshot := flags.String("tosnapshot", "", "Snapshot file of the end state, instead of a recording")
+	rectString := flags.String("rect", "", "Rectangle to compare, in the form minX,minY,maxX,maxY")
+	imagePath := flags.String("image", "diff.png", "Output path of the diff image")
+	csvPath := flags.String("csv", "", "Optional output path of the list of changed pixels")
+	timeout := flags.Duration("timeout", time.Minute, "Maximum time to replay a recording up to each point in time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var rect image.Rectangle
+	if _, err := fmt.Sscanf(*rectString, "%d,%d,%d,%d", &rect.Min.X, &rect.Min.Y, &rect.Max.X, &rect.Max.Y); err != nil {
+		return fmt.Errorf("Can't parse rectangle %q: %v", *rectString, err)
+	}
+	rect = rect.Canon()
+	if rect.Empty() {
+		return fmt.Errorf("Rectangle %v is empty", rect)
+	}
+
+	var diff *canvasDiff
+	switch {
+	case *fromSnapshot != "" && *toSnapshot != "":
+		var err error
+		if diff, err = diffSnapshots(*fromSnapshot, *toSnapshot, rect); err != nil {
+			return err
+		}
+	case *recording != "":
+		from, err := time.Parse(time.RFC3339, *fromString)
+		if err != nil {
+			return fmt.Errorf("Can't parse start time: %v", err)
+		}
+		to, err := time.Parse(time.RFC3339, *toString)
+		if err != nil {
+			return fmt.Errorf("Can't parse end time: %v", err)
+		}
+		if diff, err = diffRecording(*recording, from, to, rect, *timeout); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Either a recording or two snapshots have to be given")
+	}
+
+	f, err := os.Create(*imagePath)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", *imagePath, err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, diff.Image); err != nil {
+		return fmt.Errorf("Can't write image to %v: %v", *imagePath, err)
+	}
+
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			return fmt.Errorf("Can't create file %v: %v", *csvPath, err)
+		}
+		defer f.Close()
+		if err := diff.writeCSV(f); err != nil {
+			return fmt.Errorf("Can't write pixels to %v: %v", *csvPath, err)
+		}
+	}
+
+	log.Infof("Found %v changed pixels in %v", len(diff.Pixels), rect)
+
+	return nil
+}
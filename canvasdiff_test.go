@@ -0,0 +1,88 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_diffImages(t *testing.T) {
+	rect := image.Rect(0, 0, 4, 4)
+	before := image.NewRGBA(rect)
+	after := image.NewRGBA(rect)
+	for i := range before.Pix {
+		before.Pix[i], after.Pix[i] = 255, 255
+	}
+
+	after.Set(1, 1, color.RGBA{255, 0, 0, 255}) // Changed
+	before.Set(2, 2, color.Transparent)         // Unknown before, not a change
+	after.Set(2, 2, color.RGBA{0, 255, 0, 255})
+
+	diff := diffImages(before, after, rect)
+	if len(diff.Pixels) != 1 || diff.Pixels[0].Pos != (image.Point{1, 1}) {
+		t.Fatalf("diffImages() found changes %v, want one at %v", diff.Pixels, image.Point{1, 1})
+	}
+	if got := diff.Image.RGBAAt(1, 1); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Changed pixel is drawn as %v", got)
+	}
+	if got := diff.Image.RGBAAt(0, 0); got == (color.RGBA{255, 0, 0, 255}) || got.A != 255 {
+		t.Errorf("Unchanged pixel is drawn as %v", got)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := diff.writeCSV(buf); err != nil {
+		t.Fatalf("writeCSV() failed: %v", err)
+	}
+	if want := "x,y,before,after\n1,1,#ffffff,#ff0000\n"; buf.String() != want {
+		t.Errorf("writeCSV() = %q, want %q", buf.String(), want)
+	}
+}
+
+func Test_diffSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	can := newTestSnapshotCanvas(t)
+	defer can.Close()
+
+	fromPath, toPath := filepath.Join(dir, "from.pixsnap"), filepath.Join(dir, "to.pixsnap")
+	if err := can.saveSnapshotFile(fromPath); err != nil {
+		t.Fatalf("saveSnapshotFile() failed: %v", err)
+	}
+	can.setPixel(image.Point{10, 10}, pixelcanvasioPalette[5])
+	can.setPixel(image.Point{11, 10}, pixelcanvasioPalette[0]) // Same color as before
+	if err := can.saveSnapshotFile(toPath); err != nil {
+		t.Fatalf("saveSnapshotFile() failed: %v", err)
+	}
+
+	diff, err := diffSnapshots(fromPath, toPath, image.Rect(0, 0, 200, 64))
+	if err != nil {
+		t.Fatalf("diffSnapshots() failed: %v", err)
+	}
+	if len(diff.Pixels) != 1 || diff.Pixels[0].Pos != (image.Point{10, 10}) {
+		t.Errorf("diffSnapshots() found changes %v, want one at %v", diff.Pixels, image.Point{10, 10})
+	}
+}
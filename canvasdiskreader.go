@@ -70,7 +70,7 @@ func newCanvasDiskReader(shortName string) (connection, *canvas, error) {
 
 	cdr.TimeChan <- cdr.Recordings[0].StartTime
 
-	cdr.Canvas, _ = newCanvas(cdr.ChunkSize, cdr.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	cdr.Canvas, _ = newCanvas(cdr.ChunkSize, cdr.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32), canvasOptions{ChunkRetention: chunkRetentionNever}) // Keep all chunks, as they can't be downloaded again
 
 	cdr.QuitWaitGroup.Add(1)
 	go func() {
@@ -438,6 +438,10 @@ func (cdr *canvasDiskReader) getName() string {
 	return fmt.Sprintf("Replay of %v", cdr.ShortName)
 }
 
+// Recordings contain all pixel changes, there is nothing to subscribe to
+func (cdr *canvasDiskReader) subscribe(rects []image.Rectangle)   {}
+func (cdr *canvasDiskReader) unsubscribe(rects []image.Rectangle) {}
+
 func (cdr *canvasDiskReader) getOnlinePlayers() int {
 	return 0
 }
@@ -64,7 +64,12 @@ func (can *canvas) newCanvasDiskWriter(shortName string) (*canvasDiskWriter, err
 	}
 
 	cdw.File = f
-	zipWriter, err := gzip.NewWriterLevel(f, gzip.DefaultCompression)
+	countingWriter := &metricCountingWriter{
+		Writer:  f,
+		Counter: metricRecordingBytes,
+		Labels:  metricLabels("connection", shortName),
+	}
+	zipWriter, err := gzip.NewWriterLevel(countingWriter, gzip.DefaultCompression)
 	if err != nil {
 		f.Close()
 		return nil, fmt.Errorf("Can't initialize compression %v: %v", filePath, err)
@@ -119,6 +124,15 @@ func (cdw *canvasDiskWriter) setListeningRects(rects []image.Rectangle) error {
 	return nil
 }
 
+// Recordings have to contain every event, so the canvas has to wait for the disk writer if necessary
+func (cdw *canvasDiskWriter) getQueueOptions() canvasListenerQueueOptions {
+	return canvasListenerQueueOptions{
+		Name:     "recorder",
+		Size:     10000,
+		Overflow: canvasOverflowBlock,
+	}
+}
+
 func (cdw *canvasDiskWriter) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
 	cdw.ClosedMutex.RLock()
 	defer cdw.ClosedMutex.RUnlock()
@@ -303,9 +317,9 @@ func (cdw *canvasDiskWriter) Close() {
 	cdw.Canvas.unsubscribeListener(cdw)
 	cdw.handleInvalidateAll()
 
-	cdw.ClosedMutex.RLock()
+	cdw.ClosedMutex.Lock()
 	cdw.Closed = true // Prevent any new events from happening
-	cdw.ClosedMutex.RUnlock()
+	cdw.ClosedMutex.Unlock()
 
 	cdw.ZipWriter.Close()
 	cdw.File.Close()
@@ -0,0 +1,313 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+)
+
+// What happens when the queue of a listener is full
+type canvasOverflowPolicy int
+
+const (
+	canvasOverflowBlock      canvasOverflowPolicy = iota // Wait until the listener has handled enough events. This stalls all other listeners of the canvas
+	canvasOverflowDropResync                             // Drop all queued events, and send the current state of all known chunks afterwards
+	canvasOverflowCoalesce                               // Remove pixel and image events that are overwritten by newer ones. Blocks if nothing can be removed
+)
+
+const canvasListenerQueueDefaultSize = 1000
+
+// Queue settings of a listener
+type canvasListenerQueueOptions struct {
+	Name     string // Used in metrics, defaults to the type of the listener
+	Size     int    // Maximum amount of queued events, defaults to canvasListenerQueueDefaultSize
+	Overflow canvasOverflowPolicy
+}
+
+// Listeners can implement this to change their queue settings.
+// Without it, they get a queue with the default size that blocks on overflow.
+type canvasListenerQueueConfig interface {
+	getQueueOptions() canvasListenerQueueOptions
+}
+
+// Events that are queued for a specific listener
+type canvasListenerEvent interface {
+	deliver(l canvasListener) error
+}
+
+type canvasListenerEventChunksChange struct {
+	Create, Remove map[image.Rectangle]int
+}
+
+func (e canvasListenerEventChunksChange) deliver(l canvasListener) error {
+	return l.handleChunksChange(e.Create, e.Remove)
+}
+
+type canvasListenerEventInvalidateAll struct{}
+
+func (e canvasListenerEventInvalidateAll) deliver(l canvasListener) error {
+	return l.handleInvalidateAll()
+}
+
+type canvasListenerEventInvalidateRect struct {
+	Rect  image.Rectangle
+	VCIDs []int
+}
+
+func (e canvasListenerEventInvalidateRect) deliver(l canvasListener) error {
+	return l.handleInvalidateRect(e.Rect, e.VCIDs)
+}
+
+type canvasListenerEventSetImage struct {
+	Image image.Image
+	Valid bool
+	VCIDs []int
+}
+
+func (e canvasListenerEventSetImage) deliver(l canvasListener) error {
+	return l.handleSetImage(e.Image, e.Valid, e.VCIDs)
+}
+
+type canvasListenerEventSetPixel struct {
+	Pos   image.Point
+	Color color.Color
+	VCID  int
+}
+
+func (e canvasListenerEventSetPixel) deliver(l canvasListener) error {
+	return l.handleSetPixel(e.Pos, e.Color, e.VCID)
+}
+
+type canvasListenerEventSignalDownload struct {
+	Rect  image.Rectangle
+	VCIDs []int
+}
+
+func (e canvasListenerEventSignalDownload) deliver(l canvasListener) error {
+	return l.handleSignalDownload(e.Rect, e.VCIDs)
+}
+
+type canvasListenerEventRevalidateRect struct {
+	Rect  image.Rectangle
+	VCIDs []int
+}
+
+func (e canvasListenerEventRevalidateRect) deliver(l canvasListener) error {
+	return l.handleRevalidateRect(e.Rect, e.VCIDs)
+}
+
+type canvasListenerEventSetTime struct {
+	Time time.Time
+}
+
+func (e canvasListenerEventSetTime) deliver(l canvasListener) error {
+	return l.handleSetTime(e.Time)
+}
+
+// Bounded event queue of a single listener.
+// Events are pushed by the broadcaster goroutine of the canvas, and delivered by a goroutine of the queue.
+// This way a slow listener can't delay other listeners, depending on the overflow policy.
+type canvasListenerQueue struct {
+	sync.Mutex
+	Cond *sync.Cond // Signals changes of Events and Closed
+
+	Listener canvasListener
+	Options  canvasListenerQueueOptions
+	Labels   string // Metric labels
+
+	Events []canvasListenerEvent
+	Closed bool
+	Done   chan struct{} // Gets closed after all events are delivered and the queue is closed
+}
+
+// Creates a queue for the given listener, and starts delivering events.
+func newCanvasListenerQueue(l canvasListener) *canvasListenerQueue {
+	options := canvasListenerQueueOptions{}
+	if lc, ok := l.(canvasListenerQueueConfig); ok {
+		options = lc.getQueueOptions()
+	}
+	if options.Name == "" {
+		options.Name = fmt.Sprintf("%T", l)
+	}
+	if options.Size <= 0 {
+		options.Size = canvasListenerQueueDefaultSize
+	}
+
+	q := &canvasListenerQueue{
+		Listener: l,
+		Options:  options,
+		Labels:   metricLabels("listener", options.Name),
+		Done:     make(chan struct{}),
+	}
+	q.Cond = sync.NewCond(&q.Mutex)
+
+	go q.worker()
+
+	return q
+}
+
+// Delivers queued events until the queue is closed and empty
+func (q *canvasListenerQueue) worker() {
+	defer close(q.Done)
+
+	for {
+		q.Lock()
+		for len(q.Events) == 0 && !q.Closed {
+			q.Cond.Wait()
+		}
+		if len(q.Events) == 0 {
+			q.Unlock()
+			return
+		}
+		event := q.Events[0]
+		q.Events[0] = nil // Don't keep a reference to delivered images
+		q.Events = q.Events[1:]
+		q.Cond.Broadcast() // Wake up a blocked push
+		q.Unlock()
+
+		event.deliver(q.Listener)
+	}
+}
+
+// Adds an event to the queue, and handles overflows according to the policy.
+//
+// Returns false if queued events were dropped, in that case the listener has to be resynchronized by the caller.
+func (q *canvasListenerQueue) push(event canvasListenerEvent) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.Closed {
+		return true
+	}
+
+	for len(q.Events) >= q.Options.Size {
+		switch q.Options.Overflow {
+		case canvasOverflowDropResync:
+			q.Events = append(q.Events, event)
+			q.drop()
+			q.Cond.Broadcast()
+			return false
+		case canvasOverflowCoalesce:
+			if q.coalesce() > 0 {
+				continue
+			}
+		}
+		q.Cond.Wait()
+	}
+
+	q.Events = append(q.Events, event)
+	q.Cond.Broadcast()
+
+	return true
+}
+
+// Adds an event to the queue, even if it is full.
+// Used for events that resynchronize the listener.
+func (q *canvasListenerQueue) pushForced(event canvasListenerEvent) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.Closed {
+		return
+	}
+
+	q.Events = append(q.Events, event)
+	q.Cond.Broadcast()
+}
+
+// Removes all events, except the ones that change the virtual chunks of the listener.
+// Without those, the listener would get out of sync with the virtual chunk IDs.
+// The queue has to be locked.
+func (q *canvasListenerQueue) drop() {
+	kept := []canvasListenerEvent{}
+	for _, event := range q.Events {
+		if _, ok := event.(canvasListenerEventChunksChange); ok {
+			kept = append(kept, event)
+		}
+	}
+
+	metricListenerDroppedEvents.add(q.Labels, float64(len(q.Events)-len(kept)))
+	q.Events = kept
+}
+
+// Removes pixel and image events that are completely overwritten by newer events.
+// Returns the amount of removed events.
+// The queue has to be locked.
+func (q *canvasListenerQueue) coalesce() int {
+	pixels := map[image.Point]struct{}{} // Pixels that are set by newer events
+	rects := []image.Rectangle{}         // Rectangles that are set by newer images
+
+	covered := func(rect image.Rectangle) bool {
+		for _, r := range rects {
+			if rect.In(r) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Go from the newest to the oldest event
+	kept := make([]canvasListenerEvent, len(q.Events))
+	keptIndex := len(kept)
+	for i := len(q.Events) - 1; i >= 0; i-- {
+		switch event := q.Events[i].(type) {
+		case canvasListenerEventSetPixel:
+			if _, ok := pixels[event.Pos]; ok || covered(image.Rectangle{event.Pos, event.Pos.Add(image.Point{1, 1})}) {
+				continue
+			}
+			pixels[event.Pos] = struct{}{}
+		case canvasListenerEventSetImage:
+			bounds := event.Image.Bounds()
+			if covered(bounds) {
+				continue
+			}
+			rects = append(rects, bounds)
+		}
+		keptIndex--
+		kept[keptIndex] = q.Events[i]
+	}
+
+	removed := keptIndex
+	if removed > 0 {
+		metricListenerCoalescedEvents.add(q.Labels, float64(removed))
+		q.Events = kept[keptIndex:]
+	}
+
+	return removed
+}
+
+// Returns the amount of queued events
+func (q *canvasListenerQueue) length() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.Events)
+}
+
+// Stops accepting new events.
+// Already queued events are still delivered, Done is closed afterwards.
+func (q *canvasListenerQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.Closed = true
+	q.Cond.Broadcast()
+}
@@ -0,0 +1,158 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+// Listener that counts events, and can be blocked to simulate a slow listener
+type testQueueListener struct {
+	testListener
+	Options canvasListenerQueueOptions
+	Block   chan struct{} // If set, every handler waits until this is closed
+
+	sync.Mutex
+	Pixels         int
+	InvalidateAlls int
+	Images         int
+}
+
+func (l *testQueueListener) getQueueOptions() canvasListenerQueueOptions {
+	return l.Options
+}
+
+func (l *testQueueListener) wait() {
+	if l.Block != nil {
+		<-l.Block
+	}
+}
+
+func (l *testQueueListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	l.wait()
+	l.Lock()
+	defer l.Unlock()
+	l.Pixels++
+	return nil
+}
+
+func (l *testQueueListener) handleInvalidateAll() error {
+	l.wait()
+	l.Lock()
+	defer l.Unlock()
+	l.InvalidateAlls++
+	return nil
+}
+
+func (l *testQueueListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	l.wait()
+	l.Lock()
+	defer l.Unlock()
+	l.Images++
+	return nil
+}
+
+func Test_canvasListenerQueueSlowListener(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	can.signalDownload(image.Rect(0, 0, 64, 64))
+	can.setImage(image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette), false, false)
+
+	slow := &testQueueListener{
+		Options: canvasListenerQueueOptions{Name: "slowtest", Size: 10, Overflow: canvasOverflowDropResync},
+		Block:   make(chan struct{}),
+	}
+	fast := &testQueueListener{}
+	droppedBefore := metricListenerDroppedEvents.get(metricLabels("listener", "slowtest")) // Counters are global, and may contain values of earlier test runs
+	can.subscribeListener(slow, false)
+	can.subscribeListener(fast, false)
+
+	// The fast listener has to get all events, while the slow one is stuck
+	for i := 0; i < 100; i++ {
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[i%16])
+	}
+	waitFor(t, "pixels of the fast listener", func() bool {
+		fast.Lock()
+		defer fast.Unlock()
+		return fast.Pixels == 100
+	})
+
+	if dropped := metricListenerDroppedEvents.get(metricLabels("listener", "slowtest")) - droppedBefore; dropped == 0 {
+		t.Errorf("No events were dropped")
+	}
+
+	// After the slow listener continues, it has to be resynchronized
+	close(slow.Block)
+	if err := can.unsubscribeListener(slow); err != nil {
+		t.Fatalf("Can't unsubscribe listener: %v", err)
+	}
+	can.unsubscribeListener(fast)
+
+	slow.Lock()
+	defer slow.Unlock()
+	if slow.InvalidateAlls == 0 || slow.Images < 2 {
+		t.Errorf("Slow listener got %v invalidate events and %v images, it wasn't resynchronized", slow.InvalidateAlls, slow.Images)
+	}
+	if slow.Pixels >= 100 {
+		t.Errorf("Slow listener got %v pixels, no events were dropped", slow.Pixels)
+	}
+}
+
+func Test_canvasListenerQueueCoalesce(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)
+	newerImg := image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)
+
+	q := &canvasListenerQueue{
+		Labels: metricLabels("listener", "coalescetest"),
+		Events: []canvasListenerEvent{
+			canvasListenerEventSetPixel{Pos: image.Point{1, 1}},                           // Overwritten by the image
+			canvasListenerEventSetImage{Image: img, Valid: true},                          // Overwritten by the newer image
+			canvasListenerEventSetPixel{Pos: image.Point{100, 100}},                       // Overwritten by the newer pixel
+			canvasListenerEventChunksChange{},                                             // Kept
+			canvasListenerEventSetImage{Image: newerImg, Valid: true},                     // Kept
+			canvasListenerEventSetPixel{Pos: image.Point{1, 1}},                           // Kept, it's newer than the image
+			canvasListenerEventSetPixel{Pos: image.Point{100, 100}, Color: color.White},   // Kept
+			canvasListenerEventInvalidateRect{Rect: image.Rect(0, 0, 64, 64), VCIDs: nil}, // Kept
+		},
+	}
+
+	coalescedBefore := metricListenerCoalescedEvents.get(metricLabels("listener", "coalescetest")) // Counters are global, and may contain values of earlier test runs
+	if removed := q.coalesce(); removed != 3 {
+		t.Errorf("coalesce() removed %v events, want %v", removed, 3)
+	}
+	if len(q.Events) != 5 {
+		t.Fatalf("Got %v remaining events, want %v", len(q.Events), 5)
+	}
+	if _, ok := q.Events[0].(canvasListenerEventChunksChange); !ok {
+		t.Errorf("First event is %T, want canvasListenerEventChunksChange", q.Events[0])
+	}
+	if event, ok := q.Events[3].(canvasListenerEventSetPixel); !ok || event.Color != color.White {
+		t.Errorf("Newest pixel event wasn't kept")
+	}
+	if coalesced := metricListenerCoalescedEvents.get(metricLabels("listener", "coalescetest")) - coalescedBefore; coalesced != 3 {
+		t.Errorf("Coalesced events metric increased by %v, want %v", coalesced, 3)
+	}
+
+	// Nothing to remove anymore
+	if removed := q.coalesce(); removed != 0 {
+		t.Errorf("Second coalesce() removed %v events, want %v", removed, 0)
+	}
+}
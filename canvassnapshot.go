@@ -0,0 +1,377 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/image/bmp"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// The in-memory state of a canvas at some point in time
+type canvasSnapshot struct {
+	Time      time.Time
+	ChunkSize pixelSize
+	Origin    image.Point
+	Rect      image.Rectangle
+	Chunks    []canvasSnapshotChunk
+}
+
+type canvasSnapshotChunk struct {
+	Image image.Image // Bounds are the rectangle of the chunk
+	Valid bool
+}
+
+// Returns the path of the snapshot file of a game
+func canvasSnapshotPath(shortName string) string {
+	return filepath.Join(wd, "snapshots", shortName+".pixsnap")
+}
+
+// Returns whether snapshots should be stored and restored for live connections
+func canvasSnapshotsEnabled() bool {
+	var enabled bool
+	return conf != nil && conf.Get(".canvas.snapshots", &enabled) == nil && enabled
+}
+
+// Copies the images and states of all chunks that contain image data
+func (can *canvas) getSnapshot() (*canvasSnapshot, error) {
+	t, err := can.getTime()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &canvasSnapshot{
+		Time:      t,
+		ChunkSize: can.ChunkSize,
+		Origin:    can.Origin,
+		Rect:      can.Rect,
+	}
+
+	for _, chunk := range can.getAllChunks() {
+		img, valid, _, err := chunk.getImageCopy(false)
+		if err != nil {
+			continue // Chunks without image data
+		}
+		snap.Chunks = append(snap.Chunks, canvasSnapshotChunk{
+			Image: img,
+			Valid: valid,
+		})
+	}
+
+	return snap, nil
+}
+
+// Creates a new canvas with the properties and chunks of the snapshot
+func newCanvasFromSnapshot(snap *canvasSnapshot, options canvasOptions) (*canvas, <-chan *chunk, error) {
+	can, chunkRequests := newCanvas(snap.ChunkSize, snap.Origin, snap.Rect, options)
+
+	if err := can.restoreSnapshot(snap, true); err != nil {
+		can.Close()
+		return nil, nil, err
+	}
+
+	return can, chunkRequests, nil
+}
+
+// Restores the chunks of the snapshot.
+// The chunk size and origin of the snapshot have to match the canvas.
+//
+// If keepValidity is true, all chunks are overwritten and get the validity that is stored in the snapshot.
+// Otherwise the chunks are restored as invalid, and only if they don't contain valid or downloading data.
+// That's used to show the last known state of live canvases until it is downloaded.
+func (can *canvas) restoreSnapshot(snap *canvasSnapshot, keepValidity bool) error {
+	if snap.ChunkSize != can.ChunkSize || snap.Origin != can.Origin {
+		return fmt.Errorf("Snapshot chunk size %v and origin %v differ from the canvas %v and %v", snap.ChunkSize, snap.Origin, can.ChunkSize, can.Origin)
+	}
+
+	if keepValidity {
+		can.setTime(snap.Time)
+	}
+
+	return can.restoreChunks(snap.Chunks, keepValidity)
+}
+
+// Overwrites the chunks with the given images. See restoreSnapshot().
+func (can *canvas) restoreChunks(chunks []canvasSnapshotChunk, keepValidity bool) error {
+	can.ClosedMutex.RLock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return fmt.Errorf("Canvas is closed")
+	}
+
+	for _, snapChunk := range chunks {
+		bounds := snapChunk.Image.Bounds()
+		if !bounds.In(can.Rect) {
+			log.Warnf("Snapshot chunk at %v is outside of the canvas", bounds)
+			continue
+		}
+		chunk, err := can.getChunk(can.ChunkSize.getChunkCoord(bounds.Min, can.Origin), true)
+		if err != nil {
+			log.Warnf("Can't get chunk for snapshot chunk at %v: %v", bounds, err)
+			continue
+		}
+
+		img, err := can.Options.ColorModel.convertImage(snapChunk.Image)
+		if err != nil {
+			log.Warnf("Can't convert chunk at %v to color model %v: %v", bounds, can.Options.ColorModel, err)
+			continue
+		}
+
+		valid := snapChunk.Valid && keepValidity
+		resultImg, err := chunk.restoreImage(img, valid, keepValidity)
+		if err != nil {
+			log.Warnf("Can't restore chunk at %v: %v", bounds, err)
+			continue
+		}
+		if resultImg == nil {
+			continue // The chunk contains newer data
+		}
+
+		// Forward events to broadcaster goroutine
+		can.EventChan <- canvasEventSetImage{
+			Image: resultImg,
+		}
+		if !valid {
+			can.EventChan <- canvasEventInvalidateRect{
+				Rect: chunk.Rect,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Writes a gzip compressed snapshot file of the canvas
+func (can *canvas) saveSnapshotFile(filePath string) error {
+	snap, err := can.getSnapshot()
+	if err != nil {
+		return fmt.Errorf("Can't get snapshot: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return fmt.Errorf("Can't create directory for %v: %v", filePath, err)
+	}
+
+	// Write into a temporary file first, so a crash doesn't destroy the previous snapshot
+	tempPath := filePath + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", tempPath, err)
+	}
+
+	zipWriter := gzip.NewWriter(f)
+	if err := snap.write(zipWriter); err != nil {
+		zipWriter.Close()
+		f.Close()
+		return fmt.Errorf("Can't write snapshot to %v: %v", tempPath, err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("Can't write snapshot to %v: %v", tempPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Can't write snapshot to %v: %v", tempPath, err)
+	}
+
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return fmt.Errorf("Can't rename %v to %v: %v", tempPath, filePath, err)
+	}
+
+	return nil
+}
+
+// Reads a snapshot file that was written by saveSnapshotFile()
+func loadCanvasSnapshotFile(filePath string) (*canvasSnapshot, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open file %v: %v", filePath, err)
+	}
+	defer f.Close()
+
+	zipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decompress %v: %v", filePath, err)
+	}
+	defer zipReader.Close()
+
+	snap, err := readCanvasSnapshot(zipReader)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read snapshot from %v: %v", filePath, err)
+	}
+
+	return snap, nil
+}
+
+// Writes the snapshot in its binary format
+func (snap *canvasSnapshot) write(w io.Writer) error {
+	err := binary.Write(w, binary.LittleEndian, struct {
+		MagicNumber             [4]byte
+		Version                 uint16 // File format version
+		Time                    int64
+		ChunkWidth, ChunkHeight uint32
+		OriginX, OriginY        int32 // Origin/Offset of the chunks
+		MinX, MinY, MaxX, MaxY  int32 // Rectangle of the canvas
+		_                       uint32
+		_                       uint32
+	}{
+		MagicNumber: [4]byte{'P', 'S', 'N', 'P'},
+		Version:     1,
+		Time:        snap.Time.UnixNano(),
+		ChunkWidth:  uint32(snap.ChunkSize.X),
+		ChunkHeight: uint32(snap.ChunkSize.Y),
+		OriginX:     int32(snap.Origin.X),
+		OriginY:     int32(snap.Origin.Y),
+		MinX:        int32(snap.Rect.Min.X),
+		MinY:        int32(snap.Rect.Min.Y),
+		MaxX:        int32(snap.Rect.Max.X),
+		MaxY:        int32(snap.Rect.Max.Y),
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeCanvasSnapshotChunks(w, snap.Chunks)
+}
+
+// Reads a snapshot in its binary format
+func readCanvasSnapshot(r io.Reader) (*canvasSnapshot, error) {
+	var dat struct {
+		MagicNumber             [4]byte
+		Version                 uint16
+		Time                    int64
+		ChunkWidth, ChunkHeight uint32
+		OriginX, OriginY        int32
+		MinX, MinY, MaxX, MaxY  int32
+		_                       uint32
+		_                       uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+		return nil, fmt.Errorf("Error while reading header: %v", err)
+	}
+	if dat.MagicNumber != [4]byte{'P', 'S', 'N', 'P'} {
+		return nil, fmt.Errorf("Wrong file format")
+	}
+	if dat.Version > 1 {
+		return nil, fmt.Errorf("Version is newer")
+	}
+
+	chunks, err := readCanvasSnapshotChunks(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &canvasSnapshot{
+		Time:      time.Unix(0, dat.Time),
+		ChunkSize: pixelSize{int(dat.ChunkWidth), int(dat.ChunkHeight)},
+		Origin:    image.Point{int(dat.OriginX), int(dat.OriginY)},
+		Rect:      image.Rect(int(dat.MinX), int(dat.MinY), int(dat.MaxX), int(dat.MaxY)),
+		Chunks:    chunks,
+	}, nil
+}
+
+// Writes a list of chunks.
+// The format doesn't depend on the rest of the snapshot file, so it can be embedded into other files.
+func writeCanvasSnapshotChunks(w io.Writer, chunks []canvasSnapshotChunk) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(chunks))); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		rawBuffer := &bytes.Buffer{}
+		if err := bmp.Encode(rawBuffer, chunk.Image); err != nil {
+			return fmt.Errorf("Can't encode image at %v: %v", chunk.Image.Bounds(), err)
+		}
+
+		bounds := chunk.Image.Bounds()
+		var valid uint8
+		if chunk.Valid {
+			valid = 1
+		}
+		err := binary.Write(w, binary.LittleEndian, struct {
+			X, Y  int32
+			Valid uint8
+			Size  uint32
+		}{
+			X:     int32(bounds.Min.X),
+			Y:     int32(bounds.Min.Y),
+			Valid: valid,
+			Size:  uint32(rawBuffer.Len()),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(rawBuffer.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads a list of chunks that was written by writeCanvasSnapshotChunks()
+func readCanvasSnapshotChunks(r io.Reader) ([]canvasSnapshotChunk, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("Error while reading chunk count: %v", err)
+	}
+
+	chunks := []canvasSnapshotChunk{}
+	for i := uint32(0); i < count; i++ {
+		var dat struct {
+			X, Y  int32
+			Valid uint8
+			Size  uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+			return nil, fmt.Errorf("Error while reading chunk: %v", err)
+		}
+		rawBytes := make([]byte, dat.Size)
+		if _, err := io.ReadFull(r, rawBytes); err != nil {
+			return nil, fmt.Errorf("Error while reading chunk image: %v", err)
+		}
+		img, err := bmp.Decode(bytes.NewReader(rawBytes))
+		if err != nil {
+			return nil, fmt.Errorf("Error while decoding chunk image: %v", err)
+		}
+
+		// Move image to X and Y
+		switch img := img.(type) {
+		case *image.Paletted:
+			img.Rect = img.Rect.Add(image.Point{int(dat.X), int(dat.Y)})
+		case *image.RGBA:
+			img.Rect = img.Rect.Add(image.Point{int(dat.X), int(dat.Y)})
+		default:
+			return nil, fmt.Errorf("Unknown internal image type %T", img)
+		}
+
+		chunks = append(chunks, canvasSnapshotChunk{
+			Image: img,
+			Valid: dat.Valid != 0,
+		})
+	}
+
+	return chunks, nil
+}
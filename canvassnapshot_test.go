@@ -0,0 +1,151 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a canvas with one valid and one invalid chunk
+func newTestSnapshotCanvas(t *testing.T) *canvas {
+	t.Helper()
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	can.setTime(time.Unix(1234, 0))
+
+	for _, rect := range []image.Rectangle{image.Rect(0, 0, 64, 64), image.Rect(64, 0, 128, 64)} {
+		img := image.NewPaletted(rect, pixelcanvasioPalette)
+		img.SetColorIndex(rect.Min.X+1, 2, 3)
+		can.signalDownload(rect)
+		if err := can.setImage(img, false, false); err != nil {
+			t.Fatalf("Can't set image: %v", err)
+		}
+	}
+	can.invalidateRect(image.Rect(64, 0, 128, 64))
+
+	return can
+}
+
+func Test_canvasSnapshot(t *testing.T) {
+	can := newTestSnapshotCanvas(t)
+	defer can.Close()
+
+	snap, err := can.getSnapshot()
+	if err != nil {
+		t.Fatalf("getSnapshot() failed: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := snap.write(buf); err != nil {
+		t.Fatalf("write() failed: %v", err)
+	}
+	readSnap, err := readCanvasSnapshot(buf)
+	if err != nil {
+		t.Fatalf("readCanvasSnapshot() failed: %v", err)
+	}
+	if !readSnap.Time.Equal(time.Unix(1234, 0)) || readSnap.ChunkSize != can.ChunkSize || readSnap.Rect != can.Rect || len(readSnap.Chunks) != 2 {
+		t.Fatalf("Read snapshot %v differs from the canvas", readSnap)
+	}
+
+	// A canvas created from the snapshot has the same state
+	restored, _, err := newCanvasFromSnapshot(readSnap, canvasOptions{})
+	if err != nil {
+		t.Fatalf("newCanvasFromSnapshot() failed: %v", err)
+	}
+	defer restored.Close()
+
+	if !restored.isValid(image.Rect(0, 0, 64, 64)) || restored.isValid(image.Rect(64, 0, 128, 64)) {
+		t.Errorf("Restored chunks have the wrong validity")
+	}
+	for _, pos := range []image.Point{{1, 2}, {65, 2}} {
+		if index, err := restored.getPixelIndex(pos); err != nil || index != 3 {
+			t.Errorf("getPixelIndex(%v) = %v, %v, want 3", pos, index, err)
+		}
+	}
+	if tm, _ := restored.getTime(); !tm.Equal(time.Unix(1234, 0)) {
+		t.Errorf("Restored canvas has time %v", tm)
+	}
+}
+
+func Test_canvasSnapshotRestoreLive(t *testing.T) {
+	source := newTestSnapshotCanvas(t)
+	defer source.Close()
+	snap, err := source.getSnapshot()
+	if err != nil {
+		t.Fatalf("getSnapshot() failed: %v", err)
+	}
+
+	// A live canvas that already has newer valid data in one chunk
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+	can.signalDownload(image.Rect(0, 0, 64, 64))
+	can.setImage(image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette), false, false)
+
+	if err := can.restoreSnapshot(snap, false); err != nil {
+		t.Fatalf("restoreSnapshot() failed: %v", err)
+	}
+
+	if index, err := can.getPixelIndex(image.Point{1, 2}); err != nil || index != 0 {
+		t.Errorf("Valid chunk got overwritten, getPixelIndex() = %v, %v", index, err)
+	}
+	if index, err := can.getPixelIndex(image.Point{65, 2}); err != nil || index != 3 {
+		t.Errorf("Missing chunk wasn't restored, getPixelIndex() = %v, %v", index, err)
+	}
+	if can.isValid(image.Rect(64, 0, 128, 64)) {
+		t.Errorf("Chunks of a live canvas have to be restored as invalid")
+	}
+
+	// Different chunk geometry
+	other, _ := newCanvas(pixelSize{32, 32}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer other.Close()
+	if err := other.restoreSnapshot(snap, false); err == nil {
+		t.Errorf("Snapshot with different chunk size was restored")
+	}
+}
+
+func Test_canvasSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	can := newTestSnapshotCanvas(t)
+	defer can.Close()
+
+	filePath := filepath.Join(dir, "snapshots", "test.pixsnap")
+	if err := can.saveSnapshotFile(filePath); err != nil {
+		t.Fatalf("saveSnapshotFile() failed: %v", err)
+	}
+	snap, err := loadCanvasSnapshotFile(filePath)
+	if err != nil {
+		t.Fatalf("loadCanvasSnapshotFile() failed: %v", err)
+	}
+	if len(snap.Chunks) != 2 {
+		t.Errorf("Loaded snapshot has %v chunks, want %v", len(snap.Chunks), 2)
+	}
+
+	if _, err := loadCanvasSnapshotFile(filepath.Join(dir, "nonexistent.pixsnap")); err == nil {
+		t.Errorf("Loading a nonexistent snapshot didn't fail")
+	}
+}
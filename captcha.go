@@ -0,0 +1,209 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+const captchaDefaultTimeout = 2 * time.Minute
+
+// A captcha that has to be solved by the user, before the account can place pixels again
+type captchaRequest struct {
+	ID      int
+	Account string // Name of the paused account
+	Game    string // Short name of the connection type
+	Message string // Error message of the game
+	Created time.Time
+	Expires time.Time // The account is used again after this time, even without solved captcha
+}
+
+// Type of a captcha event
+type captchaEventType string
+
+const (
+	captchaEventRequired captchaEventType = "CaptchaRequired"
+	captchaEventSolved   captchaEventType = "CaptchaSolved"
+	captchaEventExpired  captchaEventType = "CaptchaExpired"
+)
+
+// Receives captcha events, e.g. to show them to the user.
+// Implementations must not block.
+type captchaNotifier interface {
+	notifyCaptcha(event captchaEventType, req captchaRequest)
+}
+
+// Keeps track of captchas that wait for the user, and forwards their events to all notifiers
+type captchaBroker struct {
+	sync.Mutex
+
+	Timeout   time.Duration // Time the user has to solve a captcha
+	Pending   map[int]*captchaPending
+	NextID    int
+	Notifiers map[captchaNotifier]struct{}
+}
+
+type captchaPending struct {
+	Request captchaRequest
+	Timer   *time.Timer
+}
+
+func newCaptchaBroker(timeout time.Duration) *captchaBroker {
+	return &captchaBroker{
+		Timeout:   timeout,
+		Pending:   map[int]*captchaPending{},
+		NextID:    1,
+		Notifiers: map[captchaNotifier]struct{}{},
+	}
+}
+
+// Creates a captcha broker with the timeout and webhook of the captcha section of the configuration
+func newCaptchaBrokerFromConfig(c *configdb.Config) *captchaBroker {
+	timeoutSeconds, webhook := captchaDefaultTimeout.Seconds(), ""
+	c.Get(".captcha.timeoutSeconds", &timeoutSeconds)
+	c.Get(".captcha.webhook", &webhook)
+
+	b := newCaptchaBroker(time.Duration(timeoutSeconds * float64(time.Second)))
+	if webhook != "" {
+		b.addNotifier(&captchaWebhook{URL: webhook, Client: &http.Client{Timeout: 10 * time.Second}})
+	}
+
+	return b
+}
+
+func (b *captchaBroker) addNotifier(n captchaNotifier) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.Notifiers[n] = struct{}{}
+}
+
+func (b *captchaBroker) removeNotifier(n captchaNotifier) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.Notifiers, n)
+}
+
+// Sends an event to all notifiers. The broker has to be locked
+func (b *captchaBroker) notify(event captchaEventType, req captchaRequest) {
+	for n := range b.Notifiers {
+		n.notifyCaptcha(event, req)
+	}
+}
+
+// Creates a captcha request for the given account, and notifies the user.
+// If the account already waits for a captcha, that request is returned instead.
+func (b *captchaBroker) request(account, game, message string) captchaRequest {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, pending := range b.Pending {
+		if pending.Request.Account == account {
+			return pending.Request
+		}
+	}
+
+	now := time.Now()
+	req := captchaRequest{
+		ID:      b.NextID,
+		Account: account,
+		Game:    game,
+		Message: message,
+		Created: now,
+		Expires: now.Add(b.Timeout),
+	}
+	b.NextID++
+
+	b.Pending[req.ID] = &captchaPending{
+		Request: req,
+		Timer: time.AfterFunc(b.Timeout, func() {
+			b.Lock()
+			defer b.Unlock()
+
+			if pending, ok := b.Pending[req.ID]; ok && pending.Request == req {
+				delete(b.Pending, req.ID)
+				log.Infof("Captcha %v of account %v expired", req.ID, req.Account)
+				b.notify(captchaEventExpired, req)
+			}
+		}),
+	}
+
+	log.Infof("Account %v has to solve a captcha (ID %v)", account, req.ID)
+	b.notify(captchaEventRequired, req)
+
+	return req
+}
+
+// Removes the captcha request with the given ID, as it got solved
+func (b *captchaBroker) solve(id int) (captchaRequest, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	pending, ok := b.Pending[id]
+	if !ok {
+		return captchaRequest{}, fmt.Errorf("Captcha %v not found, it may have expired", id)
+	}
+	pending.Timer.Stop()
+	delete(b.Pending, id)
+
+	b.notify(captchaEventSolved, pending.Request)
+
+	return pending.Request, nil
+}
+
+// Returns all captchas that wait for the user, sorted by ID
+func (b *captchaBroker) getPending() []captchaRequest {
+	b.Lock()
+	defer b.Unlock()
+
+	reqs := []captchaRequest{}
+	for _, pending := range b.Pending {
+		reqs = append(reqs, pending.Request)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].ID < reqs[j].ID })
+
+	return reqs
+}
+
+// Posts captcha events as JSON to a URL
+type captchaWebhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (wh *captchaWebhook) notifyCaptcha(event captchaEventType, req captchaRequest) {
+	body := struct {
+		Event   captchaEventType
+		Request captchaRequest
+	}{event, req}
+
+	go func() {
+		statusCode, _, _, err := postJSON(wh.Client, wh.URL, "", body)
+		if err != nil {
+			log.Warnf("Can't send captcha event to webhook: %v", err)
+		} else if statusCode >= 300 {
+			log.Warnf("Webhook returned status code %v for captcha event", statusCode)
+		}
+	}()
+}
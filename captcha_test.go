@@ -0,0 +1,169 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records all captcha events
+type testCaptchaNotifier struct {
+	sync.Mutex
+	Events []captchaEventType
+}
+
+func (n *testCaptchaNotifier) notifyCaptcha(event captchaEventType, req captchaRequest) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.Events = append(n.Events, event)
+}
+
+func (n *testCaptchaNotifier) count() int {
+	n.Lock()
+	defer n.Unlock()
+
+	return len(n.Events)
+}
+
+func Test_captchaBroker(t *testing.T) {
+	b := newCaptchaBroker(50 * time.Millisecond)
+	n := &testCaptchaNotifier{}
+	b.addNotifier(n)
+
+	req := b.request("a", "test", "Captcha needed")
+	if again := b.request("a", "test", "Captcha needed"); again != req {
+		t.Errorf("Second request of the same account created a new captcha %+v", again)
+	}
+	if pending := b.getPending(); len(pending) != 1 || pending[0] != req {
+		t.Errorf("getPending() = %v, want only %+v", pending, req)
+	}
+
+	if _, err := b.solve(req.ID); err != nil {
+		t.Errorf("Can't solve captcha: %v", err)
+	}
+	if _, err := b.solve(req.ID); err == nil {
+		t.Errorf("Captcha was solved twice")
+	}
+
+	// Unsolved captchas expire
+	b.request("b", "test", "Captcha needed")
+	waitFor(t, "captcha expiry", func() bool { return n.count() == 4 })
+	if len(b.getPending()) != 0 {
+		t.Errorf("Expired captcha is still pending")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	want := []captchaEventType{captchaEventRequired, captchaEventSolved, captchaEventRequired, captchaEventExpired}
+	for i := range want {
+		if n.Events[i] != want[i] {
+			t.Errorf("Events are %v, want %v", n.Events, want)
+			break
+		}
+	}
+}
+
+func Test_accountStoreCaptcha(t *testing.T) {
+	as, _ := newTestAccountStore(t, botAccount{Name: "a", Game: "test"})
+	as.Captchas = newCaptchaBroker(time.Hour)
+
+	acc, err := as.acquire("test", nil)
+	if err != nil {
+		t.Fatalf("Can't acquire account: %v", err)
+	}
+	as.release(acc.Name, 0, &placementError{Reason: placementErrorCaptcha, Message: "You must provide a token"})
+
+	acc = as.getAccounts()[0]
+	pending := as.Captchas.getPending()
+	if len(pending) != 1 || acc.NextPlacement.Before(time.Now().Add(59*time.Minute)) || acc.ErrorCount != 1 {
+		t.Fatalf("Account wasn't paused for the captcha: %+v, pending %v", acc, pending)
+	}
+
+	if err := as.solveCaptcha(pending[0].ID, "solved"); err != nil {
+		t.Fatalf("Can't solve captcha: %v", err)
+	}
+	acc, err = as.acquire("test", nil)
+	if err != nil || acc.Token != "solved" {
+		t.Fatalf("Account with solved captcha = %+v, %v, want token %q", acc, err, "solved")
+	}
+
+	// The token is only used once
+	as.release(acc.Name, time.Minute, nil)
+	if acc := as.getAccounts()[0]; acc.Token != "" || acc.ErrorCount != 0 {
+		t.Errorf("Token or error count wasn't reset after the placement: %+v", acc)
+	}
+
+	// Accounts whose captchas are never solved get disabled
+	for i := 1; i <= accountMaxErrors; i++ {
+		as.release(acc.Name, 0, &placementError{Reason: placementErrorCaptcha, Message: "You must provide a token"})
+	}
+	if acc := as.getAccounts()[0]; !acc.Disabled {
+		t.Errorf("Account with unsolved captchas wasn't disabled: %+v", acc)
+	}
+}
+
+func Test_placementSchedulerCaptcha(t *testing.T) {
+	as, _ := newTestAccountStore(t, botAccount{Name: "a", Game: "test"})
+	as.Captchas = newCaptchaBroker(time.Millisecond)
+	captchaErr := &placementError{Reason: placementErrorCaptcha, Message: "You must provide a token"}
+	placer := &testPlacer{Results: map[string][]error{"a": {captchaErr, captchaErr, captchaErr, nil}}, Placed: map[string]int{}}
+	s := newPlacementScheduler(as, placer)
+	defer s.Close()
+
+	// Expired captchas count as attempts, so the placement gives up
+	if err := s.place(image.Point{}, color.White); err == nil {
+		t.Errorf("Placement succeeded, although all attempts needed a captcha")
+	}
+	if acc := as.getAccounts()[0]; acc.ErrorCount != placementMaxAttempts {
+		t.Errorf("Account has %v errors, want %v", acc.ErrorCount, placementMaxAttempts)
+	}
+}
+
+func Test_captchaWebhook(t *testing.T) {
+	received := make(chan captchaEventType, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Event   captchaEventType
+			Request captchaRequest
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Request.Account != "a" {
+			t.Errorf("Webhook received invalid body %+v: %v", body, err)
+		}
+		received <- body.Event
+	}))
+	defer srv.Close()
+
+	wh := &captchaWebhook{URL: srv.URL, Client: srv.Client()}
+	wh.notifyCaptcha(captchaEventRequired, captchaRequest{ID: 1, Account: "a"})
+
+	select {
+	case event := <-received:
+		if event != captchaEventRequired {
+			t.Errorf("Webhook received event %v, want %v", event, captchaEventRequired)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Webhook wasn't called")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"sync"
 	"time"
 )
@@ -27,6 +28,11 @@ import (
 const (
 	chunkDeleteNoQueryDuration = 5 * time.Minute
 	chunkDeleteInvalidDuration = 5 * time.Minute
+	chunkCompressDuration      = 2 * time.Minute // Valid chunks that haven't changed for this duration are compressed
+
+	chunkDownloadTimeout = 2 * time.Minute // Downloads that take longer than this are considered failed
+	chunkRetryDelayMin   = 5 * time.Second // Delay before the first retry of a failed download. It doubles with every failure
+	chunkRetryDelayMax   = 5 * time.Minute // Maximum delay between retries
 )
 
 type pixelQueueElement struct {
@@ -37,13 +43,18 @@ type pixelQueueElement struct {
 type chunk struct {
 	sync.RWMutex
 
-	Rect  image.Rectangle
-	Image image.Image // TODO: Compress or unload image when not needed
+	Rect       image.Rectangle
+	Image      image.Image      // Nil while the chunk is compressed
+	Compressed *compressedImage // Compressed image data of idle chunks. Use getImage() or decompress() to access the image
 
 	PixelQueue           []pixelQueueElement // Queued pixels, that are set while the image is downloading
 	Valid, Downloading   bool                // Valid: Data is in sync with the game. Downloading: Data is being downloaded. Both flags can't be true at the same time
 	LastQueryTime        time.Time           // Point in time, when that chunk was queried last. If this chunk hasn't been queried for some period, it will be unloaded.
 	LastInvalidationTime time.Time           // Point in time, when that chunk was invalidated last.
+	LastChangeTime       time.Time           // Point in time, when the image data was changed last. If this chunk hasn't changed for some period, it will be compressed.
+	DownloadDeadline     time.Time           // Point in time, when the current download is considered failed.
+	DownloadFailures     int                 // Amount of consecutive failed downloads. Reset by a successful download.
+	RetryTime            time.Time           // Point in time, when a failed download may be retried.
 }
 
 // Create new empty chunk with rect
@@ -56,6 +67,7 @@ func newChunk(rect image.Rectangle) *chunk {
 		PixelQueue:           []pixelQueueElement{},
 		LastQueryTime:        time.Now(),
 		LastInvalidationTime: time.Now(),
+		LastChangeTime:       time.Now(),
 	}
 
 	return chunk
@@ -69,7 +81,12 @@ func (chu *chunk) getPixel(pos image.Point) (color.Color, error) {
 		return nil, fmt.Errorf("Position is outside of the chunk")
 	}
 
-	return chu.Image.At(pos.X, pos.Y), nil // TODO: Make this call secure, it causes a runtime error when it tries to retrieve an index outside the palette.
+	img, err := chu.getImage()
+	if err != nil {
+		return nil, err
+	}
+
+	return img.At(pos.X, pos.Y), nil // TODO: Make this call secure, it causes a runtime error when it tries to retrieve an index outside the palette.
 }
 
 func (chu *chunk) getPixelIndex(pos image.Point) (uint8, error) {
@@ -80,7 +97,12 @@ func (chu *chunk) getPixelIndex(pos image.Point) (uint8, error) {
 		return 0, fmt.Errorf("Position is outside of the chunk")
 	}
 
-	img, ok := chu.Image.(*image.Paletted)
+	chuImg, err := chu.getImage()
+	if err != nil {
+		return 0, err
+	}
+
+	img, ok := chuImg.(*image.Paletted)
 	if !ok {
 		return 0, fmt.Errorf("Chunk is not paletted")
 	}
@@ -97,14 +119,15 @@ func (chu *chunk) setPixel(pos image.Point, col color.Color) error {
 	}
 
 	if chu.Valid {
-		switch img := chu.Image.(type) {
-		case *image.RGBA:
-			img.Set(pos.X, pos.Y, col)
-		case *image.Paletted:
-			img.Set(pos.X, pos.Y, col)
-		default:
-			return fmt.Errorf("Incompatible chunk image type %T", img)
+		if err := chu.decompress(); err != nil {
+			return err
+		}
+		img, ok := chu.Image.(draw.Image)
+		if !ok {
+			return fmt.Errorf("Incompatible chunk image type %T", chu.Image)
 		}
+		img.Set(pos.X, pos.Y, col)
+		chu.LastChangeTime = time.Now()
 	}
 
 	// If chunk is downloading, append to queue to draw them later
@@ -126,6 +149,10 @@ func (chu *chunk) setPixelIndex(pos image.Point, colorIndex uint8) error {
 		return fmt.Errorf("Position is outside of the chunk")
 	}
 
+	if err := chu.decompress(); err != nil {
+		return err
+	}
+
 	img, ok := chu.Image.(*image.Paletted)
 	if !ok {
 		return fmt.Errorf("Chunk is not paletted")
@@ -137,6 +164,7 @@ func (chu *chunk) setPixelIndex(pos image.Point, colorIndex uint8) error {
 
 	if chu.Valid {
 		img.SetColorIndex(pos.X, pos.Y, colorIndex)
+		chu.LastChangeTime = time.Now()
 	}
 
 	// If chunk is downloading, append to queue to draw them later
@@ -176,11 +204,17 @@ func (chu *chunk) setImage(srcImg image.Image) (image.Image, error) {
 		return nil, fmt.Errorf("Can't create sub image: %v", err)
 	}
 
+	if err := chu.decompress(); err != nil {
+		return nil, err
+	}
+	chu.LastChangeTime = time.Now()
+
 	// If images are equal, copy nothing
 	if compareImages(chu.Image, subImg) && len(chu.PixelQueue) == 0 { // TODO: Make it work if there are elements in the pixel queue. They need to be put after the revalidate event
 		chu.PixelQueue = []pixelQueueElement{}
 		chu.Downloading = false
 		chu.Valid = true
+		chu.DownloadFailures = 0
 
 		return nil, nil // Return no image copy, this will cause the canvas to send a revalidate event
 	}
@@ -188,20 +222,20 @@ func (chu *chunk) setImage(srcImg image.Image) (image.Image, error) {
 	chu.Image = subImg // This will share pixels with the srcImage
 
 	// Replay all the queued pixels
-	for _, pqe := range chu.PixelQueue {
-		switch img := chu.Image.(type) {
-		case *image.RGBA:
-			img.Set(pqe.Pos.X, pqe.Pos.Y, pqe.Color)
-		case *image.Paletted:
+	if len(chu.PixelQueue) > 0 {
+		img, ok := chu.Image.(draw.Image)
+		if !ok {
+			return nil, fmt.Errorf("Incompatible chunk image type %T", chu.Image)
+		}
+		for _, pqe := range chu.PixelQueue {
 			img.Set(pqe.Pos.X, pqe.Pos.Y, pqe.Color)
-		default:
-			return nil, fmt.Errorf("Incompatible chunk image type %T", img)
 		}
 	}
 
 	chu.PixelQueue = []pixelQueueElement{}
 	chu.Downloading = false
 	chu.Valid = true
+	chu.DownloadFailures = 0
 
 	// Create copy of the subimage (in the most recent state)
 	cpyImg, err := copyImageReduced(chu.Image)
@@ -212,6 +246,42 @@ func (chu *chunk) setImage(srcImg image.Image) (image.Image, error) {
 	return cpyImg, nil
 }
 
+// Replaces the image of the chunk with the given image and validity, e.g. from a snapshot.
+// If force is false, chunks that are valid or downloading are not changed, and nil is returned.
+// The result image is an up to date subimage copy.
+func (chu *chunk) restoreImage(srcImg image.Image, valid, force bool) (image.Image, error) {
+	chu.Lock()
+	defer chu.Unlock()
+
+	if !chu.Rect.In(srcImg.Bounds()) {
+		return nil, fmt.Errorf("The image doesn't fill the chunk completely")
+	}
+	if !force && (chu.Valid || chu.Downloading) {
+		return nil, nil
+	}
+
+	// Copy the image, so the chunk doesn't share pixels with the snapshot
+	subImg, err := subImage(srcImg, chu.Rect)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create sub image: %v", err)
+	}
+	cpyImg, err := copyImageReduced(subImg)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't copy image: %v", err)
+	}
+
+	chu.Image, chu.Compressed = cpyImg, nil
+	chu.PixelQueue = []pixelQueueElement{}
+	chu.Downloading = false
+	chu.Valid = valid
+	chu.LastChangeTime = time.Now()
+	if !valid {
+		chu.LastInvalidationTime = time.Now()
+	}
+
+	return copyImageReduced(chu.Image)
+}
+
 func (chu *chunk) getImageCopy(onlyIfValid bool) (image.Image, bool, bool, error) {
 	chu.RLock()
 	defer chu.RUnlock()
@@ -220,6 +290,15 @@ func (chu *chunk) getImageCopy(onlyIfValid bool) (image.Image, bool, bool, error
 		return nil, false, false, fmt.Errorf("Chunk is not valid")
 	}
 
+	// Decompressed images don't share memory with the chunk, so there is no need to copy them
+	if chu.Compressed != nil {
+		img, err := chu.Compressed.decompress()
+		if err != nil {
+			return nil, false, false, fmt.Errorf("Couldn't decompress image: %v", err)
+		}
+		return img, chu.Valid, chu.Downloading, nil
+	}
+
 	cpyImg, err := copyImageReduced(chu.Image)
 	if err != nil {
 		return nil, false, false, fmt.Errorf("Couldn't copy image: %v", err)
@@ -228,6 +307,22 @@ func (chu *chunk) getImageCopy(onlyIfValid bool) (image.Image, bool, bool, error
 	return cpyImg, chu.Valid, chu.Downloading, nil
 }
 
+// Returns whether the chunk is in sync with the game.
+func (chu *chunk) isValid() bool {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.Valid
+}
+
+// Returns the valid and downloading flag of the chunk
+func (chu *chunk) getState() (valid, downloading bool) {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.Valid, chu.Downloading
+}
+
 // Invalidates the image, which shows that this chunk contains old or completely wrong data.
 //
 // setImage() or revalidate() has to be used to signal that the chunk is valid again (in sync with the game).
@@ -251,6 +346,7 @@ func (chu *chunk) revalidate() {
 	chu.PixelQueue = []pixelQueueElement{}
 	chu.Downloading = false
 	chu.Valid = true
+	chu.DownloadFailures = 0
 
 	return
 }
@@ -269,7 +365,40 @@ func (chu *chunk) signalDownload() bool {
 	}
 
 	chu.PixelQueue = []pixelQueueElement{} // Empty queue on new download.
-	chu.Downloading = true                 // TODO: Fix chunks getting stuck in downloading state. Reset downloading state if the download failed!
+	chu.Downloading = true
+	chu.DownloadDeadline = time.Now().Add(chunkDownloadTimeout)
+
+	return true
+}
+
+// Signals that the download of the chunk failed.
+// The chunk stays invalid, and a new download will be suggested after an exponentially growing delay.
+// Returns false if the chunk wasn't downloading.
+func (chu *chunk) failDownload() bool {
+	chu.Lock()
+	defer chu.Unlock()
+
+	return chu.failDownloadLocked()
+}
+
+// Same as failDownload(), but the chunk has to be locked for writing.
+func (chu *chunk) failDownloadLocked() bool {
+	if !chu.Downloading {
+		return false
+	}
+
+	chu.PixelQueue = []pixelQueueElement{}
+	chu.Downloading = false
+	chu.DownloadFailures++
+
+	delay := chunkRetryDelayMin
+	for i := 1; i < chu.DownloadFailures && delay < chunkRetryDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > chunkRetryDelayMax {
+		delay = chunkRetryDelayMax
+	}
+	chu.RetryTime = time.Now().Add(delay)
 
 	return true
 }
@@ -279,22 +408,30 @@ type chunkQueryResult int
 const (
 	chunkKeep chunkQueryResult = iota
 	chunkDownload
-	chunkCompress // TODO: Compress chunk after some time
+	chunkCompress
 	chunkDelete
+	chunkDownloadFailed // The download took too long, and the chunk has been reset. Listeners have to be informed
 )
 
 // Query a chunk and reset its timer.
-// The result suggests whether a chunk should be downloaded, kept or deleted.
+// The result suggests whether a chunk should be downloaded, compressed, kept or deleted.
 // The canvas handles the result.
-func (chu *chunk) getQueryState(resetTime bool) chunkQueryResult {
+// The chunk retention of the options decides when a chunk should be deleted, chunkRetentionRegistered is handled by the canvas.
+func (chu *chunk) getQueryState(resetTime bool, options canvasOptions) chunkQueryResult {
 	chu.Lock()
 	defer chu.Unlock()
 
-	// TODO: Add option to not delete old chunks (For replay)
-	// TODO: Add option to ignore chunkDeleteInvalidDuration
-	// Delete chunks that were invalid for some time and haven't been queried for some time
-	if !chu.Valid && chu.LastInvalidationTime.Add(chunkDeleteInvalidDuration).Before(time.Now()) && chu.LastQueryTime.Add(chunkDeleteNoQueryDuration).Before(time.Now()) {
-		return chunkDelete
+	switch options.ChunkRetention {
+	case chunkRetentionDefault:
+		// Delete chunks that were invalid for some time and haven't been queried for some time
+		if !chu.Valid && chu.LastInvalidationTime.Add(chunkDeleteInvalidDuration).Before(time.Now()) && chu.LastQueryTime.Add(chunkDeleteNoQueryDuration).Before(time.Now()) {
+			return chunkDelete
+		}
+	case chunkRetentionDuration:
+		// Delete chunks that haven't been queried for some time, no matter if they are valid
+		if chu.LastQueryTime.Add(options.ChunkRetentionDuration).Before(time.Now()) {
+			return chunkDelete
+		}
 	}
 
 	// Only set the time when the chunk is not downloading. So it will be deleted after some time if it is "stuck"
@@ -302,10 +439,84 @@ func (chu *chunk) getQueryState(resetTime bool) chunkQueryResult {
 		chu.LastQueryTime = time.Now()
 	}
 
-	// Suggest downloading of the chunk if it is invalid and not downloading already
+	// Reset chunks that are stuck in the downloading state
+	if chu.Downloading && chu.DownloadDeadline.Before(time.Now()) {
+		chu.failDownloadLocked()
+		return chunkDownloadFailed
+	}
+
+	// Suggest downloading of the chunk if it is invalid and not downloading already, unless a failed download has to wait before it's retried
 	if !chu.Valid && !chu.Downloading {
+		if chu.RetryTime.After(time.Now()) {
+			return chunkKeep
+		}
 		return chunkDownload
 	}
 
+	// Suggest compression of valid chunks that haven't changed for some time
+	if chu.Valid && !chu.Downloading && chu.Compressed == nil && chu.LastChangeTime.Add(chunkCompressDuration).Before(time.Now()) {
+		return chunkCompress
+	}
+
 	return chunkKeep
 }
+
+// Returns the image of the chunk, or a decompressed copy of it if the chunk is compressed.
+// The chunk has to be locked at least for reading.
+func (chu *chunk) getImage() (image.Image, error) {
+	if chu.Compressed == nil {
+		return chu.Image, nil
+	}
+
+	img, err := chu.Compressed.decompress()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decompress image: %v", err)
+	}
+
+	return img, nil
+}
+
+// Decompresses the image of the chunk, if it is compressed.
+// The chunk has to be locked for writing.
+func (chu *chunk) decompress() error {
+	if chu.Compressed == nil {
+		return nil
+	}
+
+	img, err := chu.Compressed.decompress()
+	if err != nil {
+		return fmt.Errorf("Couldn't decompress image: %v", err)
+	}
+
+	chu.Image, chu.Compressed = img, nil
+
+	return nil
+}
+
+// Compresses the image of the chunk to reduce its memory footprint.
+// It will be decompressed automatically when it changes.
+func (chu *chunk) compress() error {
+	chu.Lock()
+	defer chu.Unlock()
+
+	if chu.Compressed != nil || !chu.Valid || chu.Downloading {
+		return nil
+	}
+
+	compressed, err := compressImage(chu.Image)
+	if err != nil {
+		return fmt.Errorf("Couldn't compress image: %v", err)
+	}
+
+	chu.Image, chu.Compressed = nil, compressed
+
+	return nil
+}
+
+// Returns whether the image of the chunk is compressed.
+func (chu *chunk) isCompressed() bool {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.Compressed != nil
+}
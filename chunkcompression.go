@@ -0,0 +1,152 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+type compressedImageFormat uint8
+
+const (
+	compressedImagePaletted4 compressedImageFormat = iota + 1 // Two palette indices per byte, only for palettes with up to 16 colors
+	compressedImagePaletted8                                  // One palette index per byte
+	compressedImageRGBA                                       // 4 bytes per pixel
+)
+
+// Image data that is packed and compressed with flate.
+// Used to reduce the memory footprint of chunks that haven't changed for some time.
+type compressedImage struct {
+	Rect    image.Rectangle
+	Format  compressedImageFormat
+	Palette color.Palette // Only used by paletted formats
+	Data    []byte
+}
+
+// Packs and compresses a paletted or RGBA image.
+func compressImage(img image.Image) (*compressedImage, error) {
+	ci := &compressedImage{
+		Rect: img.Bounds(),
+	}
+
+	var raw []byte
+	switch img := img.(type) {
+	case *image.Paletted:
+		ci.Palette = append(color.Palette{}, img.Palette...)
+		width, height := img.Rect.Dx(), img.Rect.Dy()
+		if len(img.Palette) <= 16 {
+			ci.Format = compressedImagePaletted4
+			rowLen := (width + 1) / 2
+			raw = make([]byte, rowLen*height)
+			for iy := 0; iy < height; iy++ {
+				row := img.Pix[iy*img.Stride : iy*img.Stride+width]
+				packed := raw[iy*rowLen : iy*rowLen+rowLen]
+				for ix, index := range row {
+					packed[ix/2] |= (index & 0x0F) << (4 * uint(1-ix%2))
+				}
+			}
+		} else {
+			ci.Format = compressedImagePaletted8
+			raw = make([]byte, 0, width*height)
+			for iy := 0; iy < height; iy++ {
+				raw = append(raw, img.Pix[iy*img.Stride:iy*img.Stride+width]...)
+			}
+		}
+
+	case *image.RGBA:
+		ci.Format = compressedImageRGBA
+		rowLen := img.Rect.Dx() * 4
+		raw = make([]byte, 0, rowLen*img.Rect.Dy())
+		for iy := 0; iy < img.Rect.Dy(); iy++ {
+			raw = append(raw, img.Pix[iy*img.Stride:iy*img.Stride+rowLen]...)
+		}
+
+	default:
+		return nil, fmt.Errorf("Incompatible image type %T", img)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create compressor: %v", err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, fmt.Errorf("Can't compress image data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("Can't compress image data: %v", err)
+	}
+
+	// Copy into a slice that has exactly the needed capacity
+	ci.Data = append([]byte(nil), buf.Bytes()...)
+
+	return ci, nil
+}
+
+// Decompresses and unpacks the image.
+// The result doesn't share any memory with the compressed image.
+func (ci *compressedImage) decompress() (image.Image, error) {
+	width, height := ci.Rect.Dx(), ci.Rect.Dy()
+
+	var rawLen int
+	switch ci.Format {
+	case compressedImagePaletted4:
+		rawLen = (width + 1) / 2 * height
+	case compressedImagePaletted8:
+		rawLen = width * height
+	case compressedImageRGBA:
+		rawLen = width * 4 * height
+	default:
+		return nil, fmt.Errorf("Unknown format %v", ci.Format)
+	}
+
+	raw := make([]byte, rawLen)
+	r := flate.NewReader(bytes.NewReader(ci.Data))
+	defer r.Close()
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("Can't decompress image data: %v", err)
+	}
+
+	switch ci.Format {
+	case compressedImagePaletted4:
+		img := image.NewPaletted(ci.Rect, append(color.Palette{}, ci.Palette...))
+		rowLen := (width + 1) / 2
+		for iy := 0; iy < height; iy++ {
+			packed := raw[iy*rowLen : iy*rowLen+rowLen]
+			row := img.Pix[iy*img.Stride : iy*img.Stride+width]
+			for ix := range row {
+				row[ix] = (packed[ix/2] >> (4 * uint(1-ix%2))) & 0x0F
+			}
+		}
+		return img, nil
+
+	case compressedImagePaletted8:
+		img := image.NewPaletted(ci.Rect, append(color.Palette{}, ci.Palette...))
+		copy(img.Pix, raw)
+		return img, nil
+
+	default:
+		img := image.NewRGBA(ci.Rect)
+		copy(img.Pix, raw)
+		return img, nil
+	}
+}
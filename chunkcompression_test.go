@@ -0,0 +1,153 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_compressImage(t *testing.T) {
+	palette256 := color.Palette{}
+	for i := 0; i < 256; i++ {
+		palette256 = append(palette256, color.RGBA{uint8(i), uint8(255 - i), 0, 255})
+	}
+
+	tests := []struct {
+		name   string
+		img    image.Image
+		format compressedImageFormat
+	}{
+		{"Paletted 16 colors", image.NewPaletted(image.Rect(-10, 5, 54, 69), pixelcanvasioPalette), compressedImagePaletted4},
+		{"Paletted odd width", image.NewPaletted(image.Rect(0, 0, 33, 7), pixelcanvasioPalette), compressedImagePaletted4},
+		{"Paletted 256 colors", image.NewPaletted(image.Rect(0, 0, 64, 64), palette256), compressedImagePaletted8},
+		{"RGBA", image.NewRGBA(image.Rect(3, 3, 20, 40)), compressedImageRGBA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Fill with random data
+			switch img := tt.img.(type) {
+			case *image.Paletted:
+				for i := range img.Pix {
+					img.Pix[i] = uint8(rand.Intn(len(img.Palette)))
+				}
+			case *image.RGBA:
+				rand.Read(img.Pix)
+			}
+
+			ci, err := compressImage(tt.img)
+			if err != nil {
+				t.Fatalf("compressImage() failed: %v", err)
+			}
+			if ci.Format != tt.format {
+				t.Errorf("compressImage() format = %v, want %v", ci.Format, tt.format)
+			}
+
+			img, err := ci.decompress()
+			if err != nil {
+				t.Fatalf("decompress() failed: %v", err)
+			}
+			if !compareImages(tt.img, img) {
+				t.Errorf("Decompressed image differs from the original")
+			}
+		})
+	}
+
+	// Sub images have a stride that differs from their width
+	img := image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(len(img.Palette)))
+	}
+	subImg := img.SubImage(image.Rect(5, 7, 20, 30))
+	ci, err := compressImage(subImg)
+	if err != nil {
+		t.Fatalf("compressImage() failed: %v", err)
+	}
+	result, err := ci.decompress()
+	if err != nil {
+		t.Fatalf("decompress() failed: %v", err)
+	}
+	if !compareImages(subImg, result) {
+		t.Errorf("Decompressed sub image differs from the original")
+	}
+}
+
+func Test_chunkCompression(t *testing.T) {
+	chu := newChunk(image.Rect(0, 0, 64, 64))
+	img := image.NewPaletted(chu.Rect, pixelcanvasioPalette)
+	img.SetColorIndex(1, 2, 3)
+	chu.signalDownload()
+	if _, err := chu.setImage(img); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+
+	// Recently changed chunks are kept uncompressed
+	if got := chu.getQueryState(true, canvasOptions{}); got != chunkKeep {
+		t.Errorf("getQueryState() = %v, want %v", got, chunkKeep)
+	}
+
+	chu.LastChangeTime = time.Now().Add(-chunkCompressDuration - time.Second)
+	if got := chu.getQueryState(true, canvasOptions{}); got != chunkCompress {
+		t.Fatalf("getQueryState() = %v, want %v", got, chunkCompress)
+	}
+
+	if err := chu.compress(); err != nil {
+		t.Fatalf("compress() failed: %v", err)
+	}
+	if !chu.isCompressed() {
+		t.Fatalf("Chunk is not compressed")
+	}
+	if got := chu.getQueryState(true, canvasOptions{}); got != chunkKeep {
+		t.Errorf("getQueryState() of compressed chunk = %v, want %v", got, chunkKeep)
+	}
+
+	// Reading doesn't decompress the chunk
+	if index, err := chu.getPixelIndex(image.Point{1, 2}); err != nil || index != 3 {
+		t.Errorf("getPixelIndex() = %v, %v, want 3", index, err)
+	}
+	if col, err := chu.getPixel(image.Point{1, 2}); err != nil || col != pixelcanvasioPalette[3] {
+		t.Errorf("getPixel() = %v, %v, want %v", col, err, pixelcanvasioPalette[3])
+	}
+	cpy, valid, _, err := chu.getImageCopy(true)
+	if err != nil || !valid {
+		t.Fatalf("getImageCopy() = %v, %v", valid, err)
+	}
+	if !compareImages(cpy, img) {
+		t.Errorf("Image copy differs from the original")
+	}
+	if !chu.isCompressed() {
+		t.Errorf("Chunk got decompressed by reading")
+	}
+
+	// Writing decompresses the chunk
+	if err := chu.setPixel(image.Point{4, 5}, pixelcanvasioPalette[6]); err != nil {
+		t.Fatalf("setPixel() failed: %v", err)
+	}
+	if chu.isCompressed() {
+		t.Errorf("Chunk is still compressed after setPixel()")
+	}
+	if index, err := chu.getPixelIndex(image.Point{4, 5}); err != nil || index != 6 {
+		t.Errorf("getPixelIndex() = %v, %v, want 6", index, err)
+	}
+	if index, err := chu.getPixelIndex(image.Point{1, 2}); err != nil || index != 3 {
+		t.Errorf("getPixelIndex() = %v, %v, want 3", index, err)
+	}
+}
@@ -0,0 +1,107 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// How the pixels of a canvas are stored
+type canvasColorModelType uint8
+
+const (
+	canvasColorModelAny       canvasColorModelType = iota // Paletted and RGBA images are kept as they are, everything else is stored as RGBA. Used for replays, where the game is unknown
+	canvasColorModelIndexed                               // All chunks are paletted images with the palette of the model
+	canvasColorModelTrueColor                             // All chunks are RGBA images
+)
+
+// Color model of a canvas, declared by the connection that creates it
+type canvasColorModel struct {
+	Type    canvasColorModelType
+	Palette color.Palette // Only used by indexed color models
+}
+
+// Returns an indexed color model with the given palette.
+// Games with more than 256 colors have to use the true color model.
+func newCanvasColorModelIndexed(palette color.Palette) (canvasColorModel, error) {
+	if len(palette) == 0 || len(palette) > 256 {
+		return canvasColorModel{}, fmt.Errorf("Palette has %v colors, it needs to have between 1 and 256 colors", len(palette))
+	}
+
+	return canvasColorModel{
+		Type:    canvasColorModelIndexed,
+		Palette: append(color.Palette{}, palette...),
+	}, nil
+}
+
+func (cm canvasColorModel) String() string {
+	switch cm.Type {
+	case canvasColorModelAny:
+		return "any"
+	case canvasColorModelIndexed:
+		return fmt.Sprintf("indexed with %v colors", len(cm.Palette))
+	case canvasColorModelTrueColor:
+		return "true color"
+	}
+
+	return fmt.Sprintf("unknown (%v)", cm.Type)
+}
+
+// Returns whether the image is already stored in the format of the color model
+func (cm canvasColorModel) isNative(img image.Image) bool {
+	switch img := img.(type) {
+	case *image.Paletted:
+		return cm.Type == canvasColorModelAny || (cm.Type == canvasColorModelIndexed && isPaletteEqual(img.Palette, cm.Palette))
+	case *image.RGBA:
+		return cm.Type == canvasColorModelAny || cm.Type == canvasColorModelTrueColor
+	}
+
+	return false
+}
+
+// Creates an empty image with the format of the color model
+func (cm canvasColorModel) newImage(rect image.Rectangle) draw.Image {
+	if cm.Type == canvasColorModelIndexed {
+		return image.NewPaletted(rect, append(color.Palette{}, cm.Palette...))
+	}
+
+	return image.NewRGBA(rect)
+}
+
+// Returns the image in the format of the color model.
+// Images that are already in that format are returned as they are, everything else is converted into a new image.
+// When converting to an indexed model, colors are mapped to the nearest palette color.
+func (cm canvasColorModel) convertImage(img image.Image) (image.Image, error) {
+	if cm.isNative(img) {
+		return img, nil
+	}
+
+	switch cm.Type {
+	case canvasColorModelAny, canvasColorModelIndexed, canvasColorModelTrueColor:
+	default:
+		return nil, fmt.Errorf("Unknown color model %v", cm.Type)
+	}
+
+	rect := img.Bounds()
+	newImg := cm.newImage(rect)
+	draw.Draw(newImg, rect, img, rect.Min, draw.Src)
+
+	return newImg, nil
+}
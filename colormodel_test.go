@@ -0,0 +1,137 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_canvasColorModel_convertImage(t *testing.T) {
+	palette64 := color.Palette{}
+	for i := 0; i < 64; i++ {
+		palette64 = append(palette64, color.RGBA{uint8(i * 4), uint8(i * 4), uint8(i * 4), 255}) // Grayscale, white maps to the last color
+	}
+	indexed64, err := newCanvasColorModelIndexed(palette64)
+	if err != nil {
+		t.Fatalf("newCanvasColorModelIndexed() failed: %v", err)
+	}
+	if _, err := newCanvasColorModelIndexed(make(color.Palette, 257)); err == nil {
+		t.Errorf("newCanvasColorModelIndexed() accepted a palette with 257 colors")
+	}
+
+	rect := image.Rect(0, 0, 8, 8)
+	paletted := image.NewPaletted(rect, pixelcanvasioPalette)
+	nrgba := image.NewNRGBA(rect)
+	nrgba.Set(1, 1, palette64[40])
+
+	tests := []struct {
+		name       string
+		model      canvasColorModel
+		img        image.Image
+		wantType   string
+		wantSame   bool
+		wantPixel  color.Color
+		wantPixelX int
+	}{
+		{"Any keeps paletted", canvasColorModel{}, paletted, "*image.Paletted", true, pixelcanvasioPalette[0], 0},
+		{"Any converts NRGBA", canvasColorModel{}, nrgba, "*image.RGBA", false, palette64[40], 1},
+		{"Indexed keeps same palette", pixelcanvasioColorModel, paletted, "*image.Paletted", true, pixelcanvasioPalette[0], 0},
+		{"Indexed converts other palette", indexed64, paletted, "*image.Paletted", false, palette64[63], 0},
+		{"Indexed converts NRGBA", indexed64, nrgba, "*image.Paletted", false, palette64[40], 1},
+		{"True color converts paletted", canvasColorModel{Type: canvasColorModelTrueColor}, paletted, "*image.RGBA", false, pixelcanvasioPalette[0], 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.model.convertImage(tt.img)
+			if err != nil {
+				t.Fatalf("convertImage() failed: %v", err)
+			}
+			if typ := fmt.Sprintf("%T", got); typ != tt.wantType {
+				t.Errorf("convertImage() returned %v, want %v", typ, tt.wantType)
+			}
+			if (got == tt.img) != tt.wantSame {
+				t.Errorf("convertImage() returned the original image: %v, want %v", got == tt.img, tt.wantSame)
+			}
+			if col := color.RGBAModel.Convert(got.At(tt.wantPixelX, tt.wantPixelX)); col != color.RGBAModel.Convert(tt.wantPixel) {
+				t.Errorf("Pixel is %v, want %v", col, tt.wantPixel)
+			}
+		})
+	}
+}
+
+func Test_canvasColorModels(t *testing.T) {
+	palette64 := color.Palette{}
+	for i := 0; i < 64; i++ {
+		palette64 = append(palette64, color.RGBA{uint8(i * 4), uint8(i), 0, 255})
+	}
+	indexed64, _ := newCanvasColorModelIndexed(palette64)
+	rect := image.Rect(0, 0, 64, 64)
+
+	// Indexed canvas with more than 16 colors, fed with a true color image
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{ColorModel: indexed64})
+	defer can.Close()
+	rgba := image.NewRGBA(rect)
+	rgba.Set(1, 2, palette64[50])
+	can.signalDownload(rect)
+	if err := can.setImage(rgba, false, false); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+	if index, err := can.getPixelIndex(image.Point{1, 2}); err != nil || index != 50 {
+		t.Errorf("getPixelIndex() = %v, %v, want %v", index, err, 50)
+	}
+	if err := can.setPixel(image.Point{3, 3}, palette64[60]); err != nil {
+		t.Errorf("setPixel() failed: %v", err)
+	}
+	if index, err := can.getPixelIndex(image.Point{3, 3}); err != nil || index != 60 {
+		t.Errorf("getPixelIndex() = %v, %v, want %v", index, err, 60)
+	}
+
+	// True color canvas, fed with a paletted image and free RGB pixels
+	can2, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{ColorModel: canvasColorModel{Type: canvasColorModelTrueColor}})
+	defer can2.Close()
+	can2.signalDownload(rect)
+	if err := can2.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+	freeColor := color.RGBA{12, 34, 56, 255}
+	if err := can2.setPixel(image.Point{5, 5}, freeColor); err != nil {
+		t.Errorf("setPixel() failed: %v", err)
+	}
+	if col, err := can2.getPixel(image.Point{5, 5}); err != nil || col != freeColor {
+		t.Errorf("getPixel() = %v, %v, want %v", col, err, freeColor)
+	}
+}
+
+func Test_remoteProtocolHelloWithoutColorModel(t *testing.T) {
+	hello, err := remoteEncodeHello(remoteMessageHello{remoteProtocolVersion, pixelSize{64, 64}, image.Point{}, image.Rect(-5, -5, 5, 5), "test", "Test", canvasColorModel{}})
+	if err != nil {
+		t.Fatalf("Can't encode hello message: %v", err)
+	}
+
+	// Older servers end the message after the name
+	msg, err := remoteDecodeMessage(hello[:len(hello)-3])
+	if err != nil {
+		t.Fatalf("Can't decode hello message: %v", err)
+	}
+	if got := msg.(remoteMessageHello).ColorModel; got.Type != canvasColorModelAny || got.Palette != nil {
+		t.Errorf("Got color model %v, want %v", got, canvasColorModel{})
+	}
+}
@@ -16,13 +16,21 @@
 
 package main
 
-import "time"
+import (
+	"image"
+	"image/color"
+	"time"
+)
 
 type connection interface {
 	getShortName() string // Return short and filesystem friendly name, also used as internal identifier
 	getName() string      // Return full name for display purposes
 
-	// TODO: Add subscribe and unsubscribe methods
+	// Called by the canvas with the chunk rectangles that are inside or outside of any listener rectangle.
+	// Games that need chunks to be registered can subscribe to them here, all others can ignore this.
+	// These must not block, as they are called from the broadcaster goroutine of the canvas.
+	subscribe(rects []image.Rectangle)
+	unsubscribe(rects []image.Rectangle)
 
 	getOnlinePlayers() int
 	Close()
@@ -36,10 +44,19 @@ type connectionReplay interface {
 	getRecordings() []canvasDiskReaderRecording
 }
 
+// Connections that can place pixels implement this additionally
+type connectionPlacer interface {
+	connection
+
+	// Places a pixel with the given account.
+	// Returns the time until the account can place again, or a *placementError if the game rejected the pixel.
+	placePixel(acc botAccount, pos image.Point, col color.Color) (cooldown time.Duration, err error)
+}
+
 type connectionType struct {
 	Name string
 
-	FunctionNew func() (connection, *canvas)
+	FunctionNew func() (connection, *canvas, error)
 }
 
 var connectionTypes = map[string]connectionType{}
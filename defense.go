@@ -0,0 +1,426 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+const (
+	defenseMaxIncidents = 1000             // Amount of incidents that are kept in memory
+	defenseWorkers      = 4                // Amount of pixels that are repaired at the same time
+	defenseRetryDelay   = 30 * time.Second // Time until a failed repair is tried again
+)
+
+// A pixel of a protected template that was changed to a wrong color
+type defenseIncident struct {
+	Time        time.Time
+	Template    string
+	Position    image.Point
+	OldColor    color.RGBA // Transparent if the pixel wasn't known before
+	NewColor    color.RGBA
+	WantedColor color.RGBA
+}
+
+// A protected template with its image in canvas coordinates
+type defenseTemplate struct {
+	Template botTemplate
+	Image    image.Image
+}
+
+// Watches the protected templates on a canvas, and repairs any pixel that breaks them.
+// Without placement scheduler, incidents are only reported.
+type defender struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas        *canvas
+	Connection    connection          // Gets closed with the defender, can be nil
+	Scheduler     *placementScheduler // Can be nil
+	Templates     []defenseTemplate   // Templates that come first win where they overlap
+	ReactionDelay time.Duration       // Time between a pixel change and its repair
+
+	StateMutex sync.Mutex
+	State      *image.RGBA // Last known colors inside of the template bounds, transparent means unknown
+
+	Queue         *pixelQueue
+	Quit          chan struct{} // Closing this channel stops the workers
+	QuitWaitgroup sync.WaitGroup
+
+	IncidentsMutex sync.Mutex
+	Incidents      []defenseIncident // Newest incident last
+	IncidentFile   *os.File          // Incidents are appended as JSON lines, can be nil
+}
+
+// Starts to watch the given templates on the canvas.
+// Incidents are appended to incidentPath, if it isn't empty.
+func newDefender(can *canvas, templates []defenseTemplate, scheduler *placementScheduler, reactionDelay time.Duration, incidentPath string) (*defender, error) {
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("There are no templates to protect")
+	}
+
+	bounds := image.Rectangle{}
+	for _, tmpl := range templates {
+		bounds = bounds.Union(tmpl.Image.Bounds())
+	}
+
+	d := &defender{
+		Canvas:        can,
+		Scheduler:     scheduler,
+		Templates:     templates,
+		ReactionDelay: reactionDelay,
+		State:         image.NewRGBA(bounds),
+		Queue:         newPixelQueue(),
+		Quit:          make(chan struct{}),
+		Incidents:     []defenseIncident{},
+	}
+
+	if incidentPath != "" {
+		os.MkdirAll(filepath.Dir(incidentPath), 0777)
+		f, err := os.OpenFile(incidentPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open incident log %v: %v", incidentPath, err)
+		}
+		d.IncidentFile = f
+	}
+
+	if scheduler != nil {
+		for i := 0; i < defenseWorkers; i++ {
+			d.QuitWaitgroup.Add(1)
+			go d.repairWorker()
+		}
+	}
+
+	can.subscribeListener(d, false) // Don't let the canvas manage virtual chunks for us
+	can.registerRects(d, []image.Rectangle{bounds})
+
+	return d, nil
+}
+
+// Opens a connection for every game that has templates in the defense section of the configuration, and protects them.
+// Pixels are only placed if defense.place is true and there are accounts.
+func newDefendersFromConfig(c *configdb.Config, ts *templateStore, as *accountStore) []*defender {
+	var names []string
+	place, reactionDelayMilliseconds := false, 0.0
+	if err := c.Get(".defense.templates", &names); err != nil || len(names) == 0 {
+		return nil
+	}
+	c.Get(".defense.place", &place)
+	c.Get(".defense.reactionDelayMilliseconds", &reactionDelayMilliseconds)
+	reactionDelay := time.Duration(reactionDelayMilliseconds * float64(time.Millisecond))
+
+	// Group templates by game
+	games := map[string][]defenseTemplate{}
+	for _, name := range names {
+		tmpl, err := ts.getTemplate(name)
+		if err != nil {
+			log.Errorf("Can't protect template: %v", err)
+			continue
+		}
+		img, err := ts.getImage(tmpl)
+		if err != nil {
+			log.Errorf("Can't protect template %v: %v", name, err)
+			continue
+		}
+		games[tmpl.Game] = append(games[tmpl.Game], defenseTemplate{Template: tmpl, Image: img})
+	}
+
+	defenders := []*defender{}
+	for game, templates := range games {
+		conType, ok := connectionTypes[game]
+		if !ok {
+			log.Errorf("Can't protect templates of %v: Connection type not found", game)
+			continue
+		}
+		con, can, err := conType.FunctionNew()
+		if err != nil {
+			log.Errorf("Can't open connection to %v for defense: %v", game, err)
+			continue
+		}
+
+		var scheduler *placementScheduler
+		if placer, ok := con.(connectionPlacer); ok && place && as != nil {
+			scheduler = newPlacementScheduler(as, placer)
+		} else if place {
+			log.Warnf("Can't place pixels on %v, griefing is only reported", game)
+		}
+
+		d, err := newDefender(can, templates, scheduler, reactionDelay, filepath.Join(wd, "log", "defense-"+game+".jsonl"))
+		if err != nil {
+			log.Errorf("Can't start defense of %v: %v", game, err)
+			con.Close()
+			continue
+		}
+		d.Connection = con
+		defenders = append(defenders, d)
+		log.Infof("Protecting %v templates on %v", len(templates), game)
+	}
+
+	return defenders
+}
+
+// Returns the color the template wants at the given position, and the name of the template.
+// The result is false if no template covers the position.
+func (d *defender) wantedColor(pos image.Point) (color.RGBA, string, bool) {
+	for _, tmpl := range d.Templates {
+		if !pos.In(tmpl.Image.Bounds()) {
+			continue
+		}
+		col := color.RGBAModel.Convert(tmpl.Image.At(pos.X, pos.Y)).(color.RGBA)
+		if col.A == 0 {
+			continue // Transparent pixels of templates don't matter
+		}
+		return col, tmpl.Template.Name, true
+	}
+
+	return color.RGBA{}, "", false
+}
+
+// Stores an incident in memory and in the incident log
+func (d *defender) addIncident(incident defenseIncident) {
+	d.IncidentsMutex.Lock()
+	defer d.IncidentsMutex.Unlock()
+
+	d.Incidents = append(d.Incidents, incident)
+	if len(d.Incidents) > defenseMaxIncidents {
+		d.Incidents = d.Incidents[len(d.Incidents)-defenseMaxIncidents:]
+	}
+
+	if d.IncidentFile != nil {
+		if err := json.NewEncoder(d.IncidentFile).Encode(incident); err != nil {
+			log.Warnf("Can't write incident log: %v", err)
+		}
+	}
+}
+
+// Returns the stored incidents, the newest one last
+func (d *defender) getIncidents() []defenseIncident {
+	d.IncidentsMutex.Lock()
+	defer d.IncidentsMutex.Unlock()
+
+	return append([]defenseIncident{}, d.Incidents...)
+}
+
+// Places queued pixels until the defender is closed
+func (d *defender) repairWorker() {
+	defer d.QuitWaitgroup.Done()
+
+	for {
+		p, ok := d.Queue.pop(d.Quit)
+		if !ok {
+			return
+		}
+
+		// Someone else may have repaired it meanwhile
+		d.StateMutex.Lock()
+		current := d.State.RGBAAt(p.Pos.X, p.Pos.Y)
+		d.StateMutex.Unlock()
+		if current == p.Color {
+			continue
+		}
+
+		if err := d.Scheduler.place(p.Pos, p.Color); err != nil {
+			log.Warnf("Can't repair pixel at %v: %v", p.Pos, err)
+			p.Due = time.Now().Add(defenseRetryDelay)
+			select {
+			case <-d.Quit:
+			default:
+				d.Queue.push(p)
+			}
+		}
+	}
+}
+
+func (d *defender) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	d.ClosedMutex.RLock()
+	defer d.ClosedMutex.RUnlock()
+	if d.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	wanted, name, ok := d.wantedColor(pos)
+	if !ok {
+		return nil
+	}
+	newColor := color.RGBAModel.Convert(col).(color.RGBA)
+
+	d.StateMutex.Lock()
+	oldColor := d.State.RGBAAt(pos.X, pos.Y)
+	d.State.SetRGBA(pos.X, pos.Y, newColor)
+	d.StateMutex.Unlock()
+
+	if newColor == wanted {
+		d.Queue.remove(pos) // Repaired by someone else
+		return nil
+	}
+
+	d.addIncident(defenseIncident{
+		Time:        time.Now(),
+		Template:    name,
+		Position:    pos,
+		OldColor:    oldColor,
+		NewColor:    newColor,
+		WantedColor: wanted,
+	})
+	log.Infof("Template %v griefed at %v: %v -> %v", name, pos, oldColor, newColor)
+
+	if d.Scheduler != nil {
+		d.Queue.push(queuedPixel{Pos: pos, Color: wanted, Priority: pixelPriorityDefense, Due: time.Now().Add(d.ReactionDelay)})
+	}
+
+	return nil
+}
+
+func (d *defender) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	d.ClosedMutex.RLock()
+	defer d.ClosedMutex.RUnlock()
+	if d.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	if !valid {
+		d.StateMutex.Lock()
+		draw.Draw(d.State, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		d.StateMutex.Unlock()
+		return nil
+	}
+
+	// Compare the image with the templates, like single pixels.
+	// Chunks are invalidated before they are downloaded again, so the old colors are unknown and wrong pixels aren't incidents
+	due := time.Now().Add(d.ReactionDelay)
+	rect := img.Bounds().Intersect(d.State.Rect)
+	var repaired []image.Point
+	var repairs []queuedPixel
+	wrong := map[string]int{}
+
+	d.StateMutex.Lock()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			pos := image.Point{x, y}
+			newColor := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			d.State.SetRGBA(x, y, newColor)
+
+			wanted, name, ok := d.wantedColor(pos)
+			if !ok {
+				continue
+			}
+			if newColor == wanted {
+				repaired = append(repaired, pos)
+				continue
+			}
+			wrong[name]++
+			repairs = append(repairs, queuedPixel{Pos: pos, Color: wanted, Priority: pixelPriorityDefense, Due: due})
+		}
+	}
+	d.StateMutex.Unlock()
+
+	for _, pos := range repaired {
+		d.Queue.remove(pos) // Repaired by someone else
+	}
+	for name, count := range wrong {
+		log.Infof("Template %v has %v wrong pixels in the image at %v", name, count, img.Bounds())
+	}
+	if d.Scheduler != nil {
+		for _, p := range repairs {
+			d.Queue.push(p)
+		}
+	}
+
+	return nil
+}
+
+func (d *defender) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	d.ClosedMutex.RLock()
+	defer d.ClosedMutex.RUnlock()
+	if d.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	d.StateMutex.Lock()
+	defer d.StateMutex.Unlock()
+
+	draw.Draw(d.State, rect, image.Transparent, image.Point{}, draw.Src)
+
+	return nil
+}
+
+func (d *defender) handleInvalidateAll() error {
+	return d.handleInvalidateRect(d.State.Rect, nil)
+}
+
+// The chunk contents are still the same, the defender keeps its unknown pixels until they are sent again
+func (d *defender) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (d *defender) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (d *defender) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+func (d *defender) handleSetTime(t time.Time) error {
+	return nil
+}
+
+// Every pixel event has to be handled, otherwise incidents and their old colors would be lost.
+// A large queue keeps the canvas from stalling during short bursts
+func (d *defender) getQueueOptions() canvasListenerQueueOptions {
+	return canvasListenerQueueOptions{
+		Name:     "defense",
+		Size:     10000,
+		Overflow: canvasOverflowBlock,
+	}
+}
+
+// Stops the defense, and closes the connection if the defender owns it
+func (d *defender) Close() {
+	d.ClosedMutex.Lock()
+	if d.Closed {
+		d.ClosedMutex.Unlock()
+		return
+	}
+	d.Closed = true
+	d.ClosedMutex.Unlock()
+
+	d.Canvas.unsubscribeListener(d)
+
+	if d.Scheduler != nil {
+		d.Scheduler.Close() // Stops placements that wait for an account
+	}
+	close(d.Quit)
+	d.QuitWaitgroup.Wait()
+
+	if d.IncidentFile != nil {
+		d.IncidentFile.Close()
+	}
+	if d.Connection != nil {
+		d.Connection.Close()
+	}
+}
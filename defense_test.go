@@ -0,0 +1,159 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a valid white canvas, and a red template on it
+func newTestDefenseCanvas(t *testing.T) (*canvas, defenseTemplate) {
+	canvasRect := image.Rect(0, 0, 64, 64)
+	can, _ := newCanvas(pixelSize{16, 16}, image.Point{}, canvasRect, canvasOptions{})
+	if _, err := can.signalDownload(canvasRect); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	white := image.NewRGBA(canvasRect)
+	draw.Draw(white, canvasRect, image.White, image.Point{}, draw.Src)
+	if err := can.setImage(white, false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+
+	img := image.NewRGBA(image.Rect(10, 10, 14, 14))
+	draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	img.SetRGBA(13, 13, color.RGBA{}) // Transparent pixels aren't protected
+
+	return can, defenseTemplate{Template: botTemplate{Name: "test", Game: "test"}, Image: img}
+}
+
+func Test_defenderReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	incidentPath := filepath.Join(dir, "incidents.jsonl")
+
+	can, tmpl := newTestDefenseCanvas(t)
+	defer can.Close()
+	d, err := newDefender(can, []defenseTemplate{tmpl}, nil, 0, incidentPath)
+	if err != nil {
+		t.Fatalf("Can't create defender: %v", err)
+	}
+
+	black := color.RGBA{0, 0, 0, 255}
+	can.setPixel(image.Point{13, 13}, black) // Transparent in the template
+	can.setPixel(image.Point{20, 20}, black) // Outside of the template
+	can.setPixel(image.Point{11, 12}, black)
+
+	waitFor(t, "incident", func() bool { return len(d.getIncidents()) > 0 })
+	d.Close()
+
+	incidents := d.getIncidents()
+	want := defenseIncident{Template: "test", Position: image.Point{11, 12}, OldColor: color.RGBA{255, 255, 255, 255}, NewColor: black, WantedColor: color.RGBA{255, 0, 0, 255}}
+	if len(incidents) != 1 {
+		t.Fatalf("Got incidents %v, want one", incidents)
+	}
+	if got := incidents[0]; got.Template != want.Template || got.Position != want.Position || got.OldColor != want.OldColor || got.NewColor != want.NewColor || got.WantedColor != want.WantedColor {
+		t.Errorf("Got incident %+v, want %+v", got, want)
+	}
+	if d.Queue.len() != 0 {
+		t.Errorf("Defender without scheduler queued a repair")
+	}
+
+	f, err := os.Open(incidentPath)
+	if err != nil {
+		t.Fatalf("Can't open incident log: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var incident defenseIncident
+		if err := json.Unmarshal(scanner.Bytes(), &incident); err != nil || incident.Position != want.Position {
+			t.Errorf("Invalid incident log line %q: %v", scanner.Text(), err)
+		}
+	}
+	if lines != 1 {
+		t.Errorf("Incident log contains %v lines, want 1", lines)
+	}
+}
+
+func Test_defenderImage(t *testing.T) {
+	can, tmpl := newTestDefenseCanvas(t)
+	defer can.Close()
+
+	// Without accounts all repairs fail, so the wrong pixels stay queued
+	as, _ := newTestAccountStore(t)
+	placer := &testPlacer{Results: map[string][]error{}, Placed: map[string]int{}}
+	d, err := newDefender(can, []defenseTemplate{tmpl}, newPlacementScheduler(as, placer), 0, "")
+	if err != nil {
+		t.Fatalf("Can't create defender: %v", err)
+	}
+	defer d.Close()
+
+	// The canvas is white, so all 15 pixels of the template are wrong
+	waitFor(t, "queued repairs", func() bool { return d.Queue.len() == 15 })
+
+	// Download the chunk again, meanwhile someone else repaired a pixel
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	img.SetRGBA(10, 10, color.RGBA{255, 0, 0, 255})
+	if err := can.invalidateRect(img.Rect); err != nil {
+		t.Fatalf("Can't invalidate rect: %v", err)
+	}
+	if _, err := can.signalDownload(img.Rect); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	waitFor(t, "removed repair", func() bool { return d.Queue.len() == 14 })
+
+	if incidents := d.getIncidents(); len(incidents) != 0 {
+		t.Errorf("Got incidents %+v, want none as the old colors weren't known", incidents)
+	}
+}
+
+func Test_defenderRepair(t *testing.T) {
+	can, tmpl := newTestDefenseCanvas(t)
+	defer can.Close()
+
+	as, _ := newTestAccountStore(t, botAccount{Name: "a", Game: "test"})
+	placer := &testPlacer{Results: map[string][]error{}, Placed: map[string]int{}}
+	d, err := newDefender(can, []defenseTemplate{tmpl}, newPlacementScheduler(as, placer), 0, "")
+	if err != nil {
+		t.Fatalf("Can't create defender: %v", err)
+	}
+	defer d.Close()
+
+	can.setPixel(image.Point{10, 10}, color.RGBA{0, 0, 0, 255})
+
+	waitFor(t, "repair", func() bool {
+		placer.Lock()
+		defer placer.Unlock()
+		return placer.Placed["a"] == 1
+	})
+}
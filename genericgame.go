@@ -0,0 +1,550 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+	"github.com/gorilla/websocket"
+)
+
+// Pixel data formats of chunks
+const (
+	genericFormat4Bit = "4bit" // Two palette indices per byte, the high nibble is the left pixel
+	genericFormat8Bit = "8bit" // One palette index per byte
+	genericFormatPNG  = "png"  // PNG image, colors are mapped to the nearest palette color
+)
+
+// Description of a simple game, as stored in the generic.games section of the configuration
+type genericGameConfig struct {
+	Name string // Display name
+
+	ChunkURL   string          // Template of the chunk URL. {x} and {y} are replaced by the chunk coordinates, {minX}, {minY}, {maxX} and {maxY} by the pixel rectangle
+	ChunkSize  pixelSize       // Size of a single downloaded chunk
+	Origin     image.Point     // Positive values move the chunk grid into negative direction
+	CanvasRect image.Rectangle // Usable area of the canvas
+	Format     string          // One of "4bit", "8bit" or "png"
+	Palette    []string        // Colors in the form "#RRGGBB"
+
+	WebsocketURL string              // Optional, without it the canvas isn't updated after the download
+	PixelMessage genericPixelMessage // Layout of binary pixel messages of the websocket
+
+	Proxy string // Name of the proxy used for all requests, empty for direct connections
+}
+
+// Layout of a binary websocket message that contains a single pixel change.
+// The pixel position is ChunkX * ChunkSize.X + X - Origin.X, and respectively for Y.
+type genericPixelMessage struct {
+	Opcode *uint8 // Value of the first byte, messages with a different one are ignored. Optional
+	Length int    // Exact length of the message
+
+	ChunkSize pixelSize   // Size of the chunks the chunk coordinates refer to. Defaults to the chunk size of the game
+	Origin    image.Point // Defaults to zero
+
+	X, Y           genericMessageField
+	ChunkX, ChunkY *genericMessageField // Optional
+	Color          genericMessageField
+}
+
+// Integer inside of a binary message
+type genericMessageField struct {
+	Offset       int  // Byte offset
+	Size         int  // Amount of bytes, 1 to 4
+	LittleEndian bool // Defaults to big endian
+	Shift        uint // Right shift that is applied after reading the bytes
+	Bits         uint // Amount of bits that are used after shifting, zero means all remaining bits
+	Signed       bool // If the value is two's complement
+}
+
+// Connection to a game described by a genericGameConfig
+type connectionGeneric struct {
+	ShortName string
+	Config    genericGameConfig
+
+	Client *http.Client      // Uses the proxy of the game, if there is one
+	Dialer *websocket.Dialer // Uses the proxy of the game, if there is one
+
+	Canvas *canvas
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+
+	MetricsCollectorID int
+}
+
+var genericSingletons = map[string]*refCountingSingleton{} // One singleton per game
+var genericSingletonsMutex sync.Mutex
+
+// Registers a connection type for every game in the generic.games section of the configuration.
+// Games can't replace built-in connection types.
+func registerGenericConnectionTypes(c *configdb.Config) {
+	games := map[string]genericGameConfig{}
+	if err := c.Get(".generic.games", &games); err != nil {
+		log.Debugf("No generic games configured: %v", err)
+		return
+	}
+
+	for shortName, gc := range games {
+		if _, ok := connectionTypes[shortName]; ok {
+			log.Errorf("Can't register generic game %q: There is already a connection type with that name", shortName)
+			continue
+		}
+		if err := gc.validate(); err != nil {
+			log.Errorf("Can't register generic game %q: %v", shortName, err)
+			continue
+		}
+
+		shortName, gc := shortName, gc
+		connectionTypes[shortName] = connectionType{
+			Name: gc.Name,
+			FunctionNew: func() (connection, *canvas, error) {
+				return newGeneric(shortName, gc)
+			},
+		}
+	}
+}
+
+// Returns an error if the game description can't be used
+func (gc genericGameConfig) validate() error {
+	if gc.ChunkURL == "" {
+		return fmt.Errorf("ChunkURL is missing")
+	}
+	if gc.ChunkSize.X <= 0 || gc.ChunkSize.Y <= 0 {
+		return fmt.Errorf("Invalid chunk size %v", gc.ChunkSize)
+	}
+	if gc.CanvasRect.Empty() {
+		return fmt.Errorf("Canvas rectangle %v is empty", gc.CanvasRect)
+	}
+	switch gc.Format {
+	case genericFormat4Bit:
+		if gc.ChunkSize.X%2 != 0 {
+			return fmt.Errorf("Chunk width %v must be even for the format %q", gc.ChunkSize.X, gc.Format)
+		}
+		if len(gc.Palette) > 16 {
+			return fmt.Errorf("The format %q supports at most 16 colors, got %v", gc.Format, len(gc.Palette))
+		}
+	case genericFormat8Bit, genericFormatPNG:
+	default:
+		return fmt.Errorf("Unknown format %q", gc.Format)
+	}
+	if _, err := gc.palette(); err != nil {
+		return err
+	}
+
+	if gc.WebsocketURL != "" {
+		m := gc.PixelMessage
+		if m.Length <= 0 {
+			return fmt.Errorf("Invalid pixel message length %v", m.Length)
+		}
+		fields := map[string]*genericMessageField{"X": &m.X, "Y": &m.Y, "Color": &m.Color, "ChunkX": m.ChunkX, "ChunkY": m.ChunkY}
+		for name, f := range fields {
+			if f == nil {
+				continue
+			}
+			if f.Offset < 0 || f.Size < 1 || f.Size > 4 || f.Offset+f.Size > m.Length {
+				return fmt.Errorf("Pixel message field %v doesn't fit into the message", name)
+			}
+			if f.Shift >= uint(f.Size*8) || f.Shift+f.Bits > uint(f.Size*8) {
+				return fmt.Errorf("Pixel message field %v uses more bits than it has", name)
+			}
+		}
+		if (m.ChunkX == nil) != (m.ChunkY == nil) {
+			return fmt.Errorf("Pixel message needs either both or none of ChunkX and ChunkY")
+		}
+	}
+
+	return nil
+}
+
+// Returns the parsed palette of the game
+func (gc genericGameConfig) palette() (color.Palette, error) {
+	palette := color.Palette{}
+	for _, hex := range gc.Palette {
+		col, err := parseHexColor(hex)
+		if err != nil {
+			return nil, err
+		}
+		palette = append(palette, col)
+	}
+	if len(palette) == 0 || len(palette) > 256 {
+		return nil, fmt.Errorf("Palette must contain 1 to 256 colors, got %v", len(palette))
+	}
+
+	return palette, nil
+}
+
+// Returns the unclipped pixel rectangle of the chunk that contains the given position
+func (gc genericGameConfig) chunkRect(pos image.Point) image.Rectangle {
+	coord := gc.ChunkSize.getChunkCoord(pos, gc.Origin)
+	min := image.Point{coord.X*gc.ChunkSize.X - gc.Origin.X, coord.Y*gc.ChunkSize.Y - gc.Origin.Y}
+	return image.Rectangle{min, min.Add(image.Point(gc.ChunkSize))}
+}
+
+// Returns the URL of the chunk with the given unclipped pixel rectangle
+func (gc genericGameConfig) chunkURL(rect image.Rectangle) string {
+	coord := gc.ChunkSize.getChunkCoord(rect.Min, gc.Origin)
+	return strings.NewReplacer(
+		"{x}", strconv.Itoa(coord.X),
+		"{y}", strconv.Itoa(coord.Y),
+		"{minX}", strconv.Itoa(rect.Min.X),
+		"{minY}", strconv.Itoa(rect.Min.Y),
+		"{maxX}", strconv.Itoa(rect.Max.X),
+		"{maxY}", strconv.Itoa(rect.Max.Y),
+	).Replace(gc.ChunkURL)
+}
+
+// Decodes chunk data of the configured format.
+// Empty data of the 4bit and 8bit formats means that the chunk is filled with the first color.
+// Indices outside of the palette are mapped to the first color.
+func (gc genericGameConfig) decodeChunk(raw []byte, rect image.Rectangle, palette color.Palette) (*image.Paletted, error) {
+	img := image.NewPaletted(rect, palette)
+
+	switch gc.Format {
+	case genericFormat4Bit:
+		if len(raw) == 0 {
+			return img, nil
+		}
+		if len(raw) != len(img.Pix)/2 {
+			return nil, fmt.Errorf("Chunk data has the wrong length (%v, expected %v)", len(raw), len(img.Pix)/2)
+		}
+		for i, b := range raw {
+			img.Pix[i*2], img.Pix[i*2+1] = b>>4, b&0x0F
+		}
+
+	case genericFormat8Bit:
+		if len(raw) == 0 {
+			return img, nil
+		}
+		if len(raw) != len(img.Pix) {
+			return nil, fmt.Errorf("Chunk data has the wrong length (%v, expected %v)", len(raw), len(img.Pix))
+		}
+		copy(img.Pix, raw)
+
+	case genericFormatPNG:
+		src, err := png.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode PNG: %v", err)
+		}
+		if src.Bounds().Size() != rect.Size() {
+			return nil, fmt.Errorf("PNG has the wrong size (%v, expected %v)", src.Bounds().Size(), rect.Size())
+		}
+		draw.Draw(img, rect, src, src.Bounds().Min, draw.Src)
+		return img, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown format %q", gc.Format)
+	}
+
+	for i, index := range img.Pix {
+		if int(index) >= len(palette) {
+			img.Pix[i] = 0
+		}
+	}
+
+	return img, nil
+}
+
+// Reads the field from the given message
+func (f genericMessageField) read(data []byte) int {
+	var value uint64
+	for i := 0; i < f.Size; i++ {
+		b := uint64(data[f.Offset+i])
+		if f.LittleEndian {
+			value |= b << (8 * uint(i))
+		} else {
+			value = value<<8 | b
+		}
+	}
+
+	bits := f.Bits
+	if bits == 0 {
+		bits = uint(f.Size*8) - f.Shift
+	}
+	value = (value >> f.Shift) & (1<<bits - 1)
+
+	if f.Signed && value&(1<<(bits-1)) != 0 {
+		return int(int64(value) - 1<<bits)
+	}
+	return int(value)
+}
+
+// Decodes a pixel message. The result is false if the message doesn't match the layout
+func (m genericPixelMessage) decode(data []byte) (pos image.Point, colorIndex int, ok bool) {
+	if len(data) != m.Length || (m.Opcode != nil && data[0] != *m.Opcode) {
+		return image.Point{}, 0, false
+	}
+
+	pos = image.Point{m.X.read(data), m.Y.read(data)}
+	if m.ChunkX != nil && m.ChunkY != nil {
+		pos = pos.Add(image.Point{m.ChunkX.read(data) * m.ChunkSize.X, m.ChunkY.read(data) * m.ChunkSize.Y})
+	}
+
+	return pos.Sub(m.Origin), m.Color.read(data), true
+}
+
+// Opens a connection to the game with the given short name and description
+func newGeneric(shortName string, gc genericGameConfig) (connection, *canvas, error) {
+	if err := gc.validate(); err != nil {
+		return nil, nil, fmt.Errorf("Invalid description of %v: %v", shortName, err)
+	}
+	if gc.PixelMessage.ChunkSize == (pixelSize{}) {
+		gc.PixelMessage.ChunkSize = gc.ChunkSize
+	}
+
+	genericSingletonsMutex.Lock()
+	singleton, ok := genericSingletons[shortName]
+	if !ok {
+		singleton = &refCountingSingleton{}
+		genericSingletons[shortName] = singleton
+	}
+	genericSingletonsMutex.Unlock()
+
+	var initErr error
+
+	// Init function. It isn't called if there is already an instance for this game
+	init := func() interface{} {
+		con := &connectionGeneric{
+			ShortName:     shortName,
+			Config:        gc,
+			GoroutineQuit: make(chan struct{}),
+		}
+
+		palette, err := gc.palette()
+		if err != nil {
+			initErr = err
+			return nil
+		}
+		if con.Client, err = proxies.httpClient(gc.Proxy, 10*time.Second); err != nil {
+			initErr = fmt.Errorf("Can't use proxy: %v", err)
+			return nil
+		}
+		con.Dialer, _ = proxies.websocketDialer(gc.Proxy)
+		colorModel, err := newCanvasColorModelIndexed(palette)
+		if err != nil {
+			initErr = fmt.Errorf("Invalid palette: %v", err)
+			return nil
+		}
+
+		options := canvasOptionsFromConfig()
+		options.ColorModel = colorModel
+		con.Canvas, con.ChunkDownloadChan = newCanvas(gc.ChunkSize, gc.Origin, gc.CanvasRect, options)
+		con.MetricsCollectorID = metricsRegisterConnection(shortName, con, con.Canvas)
+		metricsLabels := metricLabels("connection", shortName)
+
+		// Goroutine that downloads the requested chunks
+		con.QuitWaitgroup.Add(1)
+		go func() {
+			defer con.QuitWaitgroup.Done()
+
+			downloadWaitgroup := sync.WaitGroup{}   // To wait until all downloads are finished
+			downloadLimit := make(chan struct{}, 3) // Limit maximum amount of simultaneous downloads to 3
+			defer downloadWaitgroup.Wait()
+
+			for {
+				select {
+				case chu := <-con.ChunkDownloadChan:
+					// Check if the chunk still needs to be downloaded
+					if chu.getQueryState(false, con.Canvas.Options) != chunkDownload {
+						continue
+					}
+					if _, err := con.Canvas.signalDownload(chu.Rect); err != nil {
+						log.Warnf("Can't signal download of %v: %v", chu.Rect, err)
+						continue
+					}
+					downloadWaitgroup.Add(1)
+					go func(rect image.Rectangle) {
+						downloadLimit <- struct{}{}
+						defer downloadWaitgroup.Done()
+						defer func() { <-downloadLimit }()
+
+						startTime := time.Now()
+						if err := con.downloadChunk(rect); err != nil {
+							log.Errorf("Can't download chunk at %v: %v", rect, err)
+							metricChunkDownloadFailures.add(metricsLabels, 1)
+							con.Canvas.failDownload(rect)
+							return
+						}
+						metricChunkDownloadDuration.observe(metricsLabels, time.Now().Sub(startTime).Seconds())
+					}(chu.Rect)
+				case <-con.GoroutineQuit:
+					return
+				}
+			}
+		}()
+
+		// Main goroutine that handles the websocket connection (It will always try to reconnect)
+		if gc.WebsocketURL != "" {
+			con.QuitWaitgroup.Add(1)
+			go func() {
+				defer con.QuitWaitgroup.Done()
+
+				waitTime := 0 * time.Second
+				for {
+					select {
+					case <-con.GoroutineQuit:
+						return
+					case <-time.After(waitTime):
+					}
+
+					// Any following connection attempt should be delayed a few seconds
+					if waitTime > 0 {
+						metricWebsocketReconnects.add(metricsLabels, 1)
+					}
+					waitTime = 5 * time.Second
+
+					c, _, err := con.Dialer.Dial(gc.WebsocketURL, nil)
+					if err != nil {
+						log.Errorf("Failed to connect to websocket server %v: %v", gc.WebsocketURL, err)
+						continue
+					}
+
+					con.handleSession(c)
+
+					// Pixels were missed while disconnected
+					con.Canvas.invalidateAll()
+				}
+			}()
+		}
+
+		return con
+	}
+
+	// Create or reuse instance of connectionGeneric
+	obj := singleton.get(init)
+	if obj == nil {
+		return nil, nil, initErr // The singleton will call init again on the next try
+	}
+	con := obj.(*connectionGeneric)
+
+	return con, con.Canvas, nil
+}
+
+// Downloads a single chunk, and sets it as image of the canvas
+func (con *connectionGeneric) downloadChunk(rect image.Rectangle) error {
+	// Chunks at the border of the canvas are clipped, but the game still sends them completely
+	fullRect := con.Config.chunkRect(rect.Min)
+
+	r, err := con.Client.Get(con.Config.chunkURL(fullRect))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Chunk request failed: %v", r.Status)
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("Can't read chunk data: %v", err)
+	}
+
+	img, err := con.Config.decodeChunk(raw, fullRect, con.Canvas.Options.ColorModel.Palette)
+	if err != nil {
+		return err
+	}
+
+	return con.Canvas.setImage(img.SubImage(rect), false, true)
+}
+
+// Handles a single websocket connection until it is closed.
+func (con *connectionGeneric) handleSession(c *websocket.Conn) {
+	log.Debugf("Connected to %v", con.Config.WebsocketURL)
+	defer log.Debugf("Disconnected from %v", con.Config.WebsocketURL)
+
+	// Wait for and handle external close events, or connection errors
+	quitChannel := make(chan struct{})
+	defer close(quitChannel)
+	go func() {
+		select {
+		case <-con.GoroutineQuit:
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		case <-quitChannel:
+		}
+		c.Close()
+	}()
+
+	palette := con.Canvas.Options.ColorModel.Palette
+
+	// Handle events
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			log.Warnf("Websocket connection error: %v", err)
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		pos, colorIndex, ok := con.Config.PixelMessage.decode(data)
+		if !ok || colorIndex < 0 || colorIndex >= len(palette) {
+			continue
+		}
+		if err := con.Canvas.setPixel(pos, palette[colorIndex]); err != nil {
+			log.Debugf("Couldn't draw pixel at %v with color %v: %v", pos, colorIndex, err)
+		}
+	}
+}
+
+func (con *connectionGeneric) getShortName() string {
+	return con.ShortName
+}
+
+func (con *connectionGeneric) getName() string {
+	if con.Config.Name == "" {
+		return con.ShortName
+	}
+	return con.Config.Name
+}
+
+// Generic games send all pixel changes, there is nothing to subscribe to
+func (con *connectionGeneric) subscribe(rects []image.Rectangle)   {}
+func (con *connectionGeneric) unsubscribe(rects []image.Rectangle) {}
+
+func (con *connectionGeneric) getOnlinePlayers() int {
+	return 0 // Not supported
+}
+
+// Closes connection and canvas
+func (con *connectionGeneric) Close() {
+	genericSingletonsMutex.Lock()
+	singleton := genericSingletons[con.ShortName]
+	genericSingletonsMutex.Unlock()
+
+	if singleton.release(con) {
+		// Stop goroutines gracefully
+		close(con.GoroutineQuit)
+
+		con.QuitWaitgroup.Wait()
+
+		metricsUnregisterCollector(con.MetricsCollectorID)
+		con.Canvas.Close()
+	}
+}
@@ -0,0 +1,198 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Dadido3/configdb"
+	"github.com/gorilla/websocket"
+)
+
+func Test_genericMessageField(t *testing.T) {
+	tests := []struct {
+		field genericMessageField
+		data  []byte
+		want  int
+	}{
+		{genericMessageField{Offset: 1, Size: 2}, []byte{0, 0x12, 0x34}, 0x1234},
+		{genericMessageField{Offset: 1, Size: 2, LittleEndian: true}, []byte{0, 0x12, 0x34}, 0x3412},
+		{genericMessageField{Offset: 0, Size: 2, Signed: true}, []byte{0xFF, 0xFE}, -2},
+		{genericMessageField{Offset: 0, Size: 2, Bits: 4}, []byte{0xAB, 0xCD}, 0xD},
+		{genericMessageField{Offset: 0, Size: 2, Shift: 4, Bits: 6}, []byte{0xAB, 0xCD}, 0x3C},
+		{genericMessageField{Offset: 0, Size: 1, Shift: 4, Signed: true}, []byte{0xF0}, -1},
+		{genericMessageField{Offset: 0, Size: 4, Signed: true}, []byte{0x80, 0, 0, 0}, -1 << 31},
+	}
+
+	for _, test := range tests {
+		if got := test.field.read(test.data); got != test.want {
+			t.Errorf("%+v.read(%v) = %v, want %v", test.field, test.data, got, test.want)
+		}
+	}
+}
+
+func Test_genericGameConfigDecodeChunk(t *testing.T) {
+	palette := color.Palette{color.RGBA{255, 255, 255, 255}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	rect := image.Rect(-2, 0, 2, 2)
+
+	img, err := genericGameConfig{Format: genericFormat4Bit}.decodeChunk([]byte{0x12, 0x00, 0x0F, 0x21}, rect, palette)
+	if err != nil {
+		t.Fatalf("Can't decode 4bit chunk: %v", err)
+	}
+	if want := []uint8{1, 2, 0, 0, 0, 0, 2, 1}; !bytes.Equal(img.Pix, want) {
+		t.Errorf("4bit chunk decoded as %v, want %v", img.Pix, want)
+	}
+
+	img, err = genericGameConfig{Format: genericFormat8Bit}.decodeChunk(nil, rect, palette)
+	if err != nil || !bytes.Equal(img.Pix, make([]uint8, 8)) {
+		t.Errorf("Empty 8bit chunk decoded as %v, %v", img, err)
+	}
+	if _, err := (genericGameConfig{Format: genericFormat8Bit}).decodeChunk([]byte{1, 2}, rect, palette); err == nil {
+		t.Errorf("8bit chunk with wrong length was accepted")
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	src.Set(1, 1, color.RGBA{0, 0, 250, 255})
+	buf := &bytes.Buffer{}
+	png.Encode(buf, src)
+	img, err = genericGameConfig{Format: genericFormatPNG}.decodeChunk(buf.Bytes(), rect, palette)
+	if err != nil {
+		t.Fatalf("Can't decode PNG chunk: %v", err)
+	}
+	if img.ColorIndexAt(-1, 1) != 2 {
+		t.Errorf("PNG pixel decoded as %v, want %v", img.ColorIndexAt(-1, 1), 2)
+	}
+}
+
+func Test_genericGameConfigValidate(t *testing.T) {
+	valid := genericGameConfig{
+		ChunkURL:   "http://localhost/{x}/{y}",
+		ChunkSize:  pixelSize{16, 16},
+		CanvasRect: image.Rect(0, 0, 64, 64),
+		Format:     genericFormat8Bit,
+		Palette:    []string{"#FFFFFF", "#000000"},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Valid game description was rejected: %v", err)
+	}
+
+	invalid := []func(gc *genericGameConfig){
+		func(gc *genericGameConfig) { gc.ChunkURL = "" },
+		func(gc *genericGameConfig) { gc.ChunkSize = pixelSize{} },
+		func(gc *genericGameConfig) { gc.Format = "jpeg" },
+		func(gc *genericGameConfig) { gc.Palette = []string{"#FFF"} },
+		func(gc *genericGameConfig) {
+			gc.WebsocketURL = "ws://localhost"
+			gc.PixelMessage = genericPixelMessage{Length: 2, X: genericMessageField{Offset: 1, Size: 2}}
+		},
+	}
+	for i, modify := range invalid {
+		gc := valid
+		modify(&gc)
+		if err := gc.validate(); err == nil {
+			t.Errorf("Invalid game description %v was accepted", i)
+		}
+	}
+}
+
+func Test_newGeneric(t *testing.T) {
+	conns := make(chan *websocket.Conn, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunks/1.-1.bin", func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 8*8)
+		chunk[1*8+2] = 1 // Red at 2, 1 inside of the chunk
+		w.Write(chunk)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- c
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Same message layout as PixelCanvas.io, but with 8x8 chunks
+	c, err := configdb.New([]configdb.Storage{configdb.UseDummyStorage(".generic.games.testgame", map[string]interface{}{
+		"Name":         "Test game",
+		"ChunkURL":     srv.URL + "/chunks/{x}.{y}.bin",
+		"ChunkSize":    map[string]interface{}{"X": 8, "Y": 8},
+		"CanvasRect":   map[string]interface{}{"Min": map[string]interface{}{"X": -16, "Y": -16}, "Max": map[string]interface{}{"X": 16, "Y": 16}},
+		"Format":       "8bit",
+		"Palette":      []interface{}{"#FFFFFF", "#FF0000", "#0000FF"},
+		"WebsocketURL": "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+		"PixelMessage": map[string]interface{}{
+			"Opcode": 0xC1,
+			"Length": 7,
+			"ChunkX": map[string]interface{}{"Offset": 1, "Size": 2, "Signed": true},
+			"ChunkY": map[string]interface{}{"Offset": 3, "Size": 2, "Signed": true},
+			"Color":  map[string]interface{}{"Offset": 5, "Size": 2, "Bits": 4},
+			"X":      map[string]interface{}{"Offset": 5, "Size": 2, "Shift": 4, "Bits": 6},
+			"Y":      map[string]interface{}{"Offset": 5, "Size": 2, "Shift": 10, "Bits": 6},
+		},
+	})})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+	defer c.Close()
+
+	registerGenericConnectionTypes(c)
+	defer delete(connectionTypes, "testgame")
+	conType, ok := connectionTypes["testgame"]
+	if !ok {
+		t.Fatalf("Connection type wasn't registered")
+	}
+	if conType.Name != "Test game" {
+		t.Errorf("Connection type has the name %q, want %q", conType.Name, "Test game")
+	}
+
+	con, can, err := conType.FunctionNew()
+	if err != nil {
+		t.Fatalf("Can't open connection: %v", err)
+	}
+	defer con.Close()
+
+	rect := image.Rect(8, -8, 16, 0)
+	l := &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l, true)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{rect})
+	waitFor(t, "chunk download", func() bool { return can.isValid(rect) })
+
+	if col, err := can.getPixel(image.Point{10, -7}); err != nil || col != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("getPixel() = %v, %v, want red", col, err)
+	}
+
+	// Blue pixel at 3, 4 inside of chunk 1, -1
+	ws := <-conns
+	defer ws.Close()
+	mixed := uint16(2 | 3<<4 | 4<<10)
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0xC1, 0, 1, 0xFF, 0xFF, uint8(mixed >> 8), uint8(mixed)})
+
+	waitFor(t, "pixel message", func() bool {
+		col, _ := can.getPixel(image.Point{11, -4})
+		return col == color.RGBA{0, 0, 255, 255}
+	})
+}
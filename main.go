@@ -41,6 +41,9 @@ var log = logrus.New()
 var wd string // Initial working directory (Executable directory)
 var version *semver.Version
 var conf *configdb.Config
+var accounts *accountStore   // Accounts used to place pixels, nil without configuration
+var proxies *proxyManager    // Proxies used by connections and accounts, nil without configuration
+var templates *templateStore // Templates that are protected, tracked and shown in canvas windows, nil without configuration
 
 func init() {
 	var err error
@@ -75,14 +78,99 @@ func main() {
 	log.SetOutput(io.MultiWriter(colorable.NewColorableStdout(), f)) // TODO: Separate formatting for logfiles
 	log.SetLevel(logrus.TraceLevel)
 
+	// Command line tools, that run without the UI
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			if err := cliDiff(os.Args[2:]); err != nil {
+				log.Errorf("Can't create diff: %v", err)
+			}
+			return
+		}
+	}
+
 	storages := []configdb.Storage{configdb.UseJSONFile("config.json")}
 	conf, err = configdb.New(storages)
 	if err != nil {
 		log.Errorf("Can't load configuration: %v", err)
 	}
 
+	if conf != nil {
+		if proxies, err = newProxyManagerFromConfig(conf); err != nil {
+			log.Errorf("Can't load proxies: %v", err)
+		} else {
+			defer proxies.Close()
+		}
+		registerGenericConnectionTypes(conf)
+		accounts = newAccountStore(conf)
+		accounts.Proxies = proxies
+		accounts.Captchas = newCaptchaBrokerFromConfig(conf)
+	}
+
+	if conf != nil {
+		templates = newTemplateStore(conf, filepath.Join(wd, "templates"))
+	}
+
+	// Command line tools, that need the configuration
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "progress":
+			if err := cliProgress(os.Args[2:], templates, accounts); err != nil {
+				log.Errorf("Can't get progress: %v", err)
+			}
+			return
+		}
+	}
+
 	log.Infof("D3pixelbot %v started", version)
 
+	// Protect templates against griefing
+	var defenders []*defender
+	if conf != nil {
+		defenders = newDefendersFromConfig(conf, templates, accounts)
+		for _, d := range defenders {
+			defer d.Close()
+		}
+	}
+
+	// Start remote server if an address is configured
+	var serverAddress string
+	if conf != nil && conf.Get(".server.address", &serverAddress) == nil && serverAddress != "" {
+		var certFile, keyFile string
+		conf.Get(".server.certFile", &certFile)
+		conf.Get(".server.keyFile", &keyFile)
+
+		srv := newRemoteServer()
+		srv.Templates = templates
+		if templates != nil {
+			srv.Progress = newTemplateTrackers(templates)
+		}
+		srv.Accounts = accounts
+		srv.Defenders = defenders
+
+		var metricsEnabled bool
+		if conf.Get(".server.metrics", &metricsEnabled) == nil && metricsEnabled {
+			srv.enableMetrics()
+		}
+
+		// Keep tokens in sync with the configuration
+		conf.RegisterCallback([]string{".server.tokens"}, func(c *configdb.Config, modified, added, removed []string) {
+			tokens := []remoteToken{}
+			if err := c.Get(".server.tokens", &tokens); err != nil {
+				log.Warnf("Can't read tokens from configuration: %v", err)
+			}
+			srv.setTokens(tokens)
+		})
+		if err := srv.listen(serverAddress, certFile, keyFile); err != nil {
+			log.Errorf("Can't start remote server: %v", err)
+		} else {
+			defer srv.Close()
+		}
+		if srv.Progress != nil {
+			defer srv.Progress.Close()
+		}
+	}
+
 	/*pFile, err := os.Create("cpu.pprof")
 	if err != nil {
 		log.Panicf(err)
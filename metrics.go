@@ -0,0 +1,334 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Counters and histograms that are updated all over the application.
+// Everything is exported in the Prometheus text format.
+var (
+	metricChunkDownloadDuration = newMetricHistogram("d3pixelbot_chunk_download_duration_seconds", "Time it took to download, decode and set a chunk image.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+	metricChunkDownloadFailures = newMetricCounter("d3pixelbot_chunk_download_failures_total", "Amount of chunk downloads that failed.")
+	metricWebsocketReconnects   = newMetricCounter("d3pixelbot_websocket_reconnects_total", "Amount of attempts to reconnect to a game's websocket server.")
+	metricRecordingBytes        = newMetricCounter("d3pixelbot_recording_bytes_written_total", "Amount of compressed bytes written to recording files.")
+
+	metricListenerDroppedEvents   = newMetricCounter("d3pixelbot_listener_dropped_events_total", "Amount of canvas events that were dropped because a listener queue overflowed.")
+	metricListenerCoalescedEvents = newMetricCounter("d3pixelbot_listener_coalesced_events_total", "Amount of canvas events that were merged into newer events because a listener queue overflowed.")
+)
+
+// Metrics that are reported by collectors. All of them have to be declared here
+var metricCollected = map[string]metricDescription{
+	"d3pixelbot_online_players":               {"gauge", "Amount of online players reported by the game."},
+	"d3pixelbot_chunks":                       {"gauge", "Amount of chunks of a canvas, by state."},
+	"d3pixelbot_compressed_chunks":            {"gauge", "Amount of chunks of a canvas that are stored compressed."},
+	"d3pixelbot_chunk_request_queue_length":   {"gauge", "Amount of chunk requests waiting to be handled by the connection."},
+	"d3pixelbot_listener_queue_length":        {"gauge", "Amount of events waiting to be handled by a listener."},
+	"d3pixelbot_canvas_listener_queue_length": {"gauge", "Amount of canvas events queued for listeners, by listener name."},
+	"d3pixelbot_pixel_events_total":           {"counter", "Amount of pixel changes a canvas has received."},
+	"d3pixelbot_stream_clients":               {"gauge", "Amount of connected stream clients."},
+	"d3pixelbot_api_connections":              {"gauge", "Amount of connections opened via the API."},
+}
+
+type metricDescription struct {
+	Type, Help string
+}
+
+// Metrics that are only counted up, grouped by labels
+type metricCounter struct {
+	sync.Mutex
+
+	Name, Help string
+	Values     map[string]float64 // Label string to value
+}
+
+func newMetricCounter(name, help string) *metricCounter {
+	return &metricCounter{
+		Name:   name,
+		Help:   help,
+		Values: map[string]float64{},
+	}
+}
+
+func (m *metricCounter) add(labels string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Values[labels] += value
+}
+
+func (m *metricCounter) get(labels string) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Values[labels]
+}
+
+func (m *metricCounter) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", m.Name, m.Help, m.Name)
+	for _, labels := range metricSortedKeys(m.Values) {
+		fmt.Fprintf(w, "%v%v %v\n", m.Name, metricLabelBraces(labels), metricFormatFloat(m.Values[labels]))
+	}
+}
+
+// Metrics that count observations in buckets, grouped by labels
+type metricHistogram struct {
+	sync.Mutex
+
+	Name, Help string
+	Buckets    []float64 // Upper bounds of the buckets, sorted in increasing order
+	Series     map[string]*metricHistogramSeries
+}
+
+type metricHistogramSeries struct {
+	Counts []uint64 // Amount of observations per bucket, not cumulative
+	Sum    float64
+	Count  uint64
+}
+
+func newMetricHistogram(name, help string, buckets []float64) *metricHistogram {
+	return &metricHistogram{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+		Series:  map[string]*metricHistogramSeries{},
+	}
+}
+
+func (m *metricHistogram) observe(labels string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	series, ok := m.Series[labels]
+	if !ok {
+		series = &metricHistogramSeries{Counts: make([]uint64, len(m.Buckets))}
+		m.Series[labels] = series
+	}
+
+	for i, upperBound := range m.Buckets {
+		if value <= upperBound {
+			series.Counts[i]++
+			break
+		}
+	}
+	series.Sum += value
+	series.Count++
+}
+
+func (m *metricHistogram) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", m.Name, m.Help, m.Name)
+	labelsList := []string{}
+	for labels := range m.Series {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Strings(labelsList)
+
+	for _, labels := range labelsList {
+		series := m.Series[labels]
+		cumulative := uint64(0)
+		for i, upperBound := range m.Buckets {
+			cumulative += series.Counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", m.Name, metricLabelBraces(metricJoinLabels(labels, metricLabels("le", metricFormatFloat(upperBound)))), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", m.Name, metricLabelBraces(metricJoinLabels(labels, metricLabels("le", "+Inf"))), series.Count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.Name, metricLabelBraces(labels), metricFormatFloat(series.Sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.Name, metricLabelBraces(labels), series.Count)
+	}
+}
+
+// A single value, as it is returned by collectors
+type metricSample struct {
+	Name   string // Has to be declared in metricCollected
+	Labels string
+	Value  float64
+}
+
+// Functions that are called on every scrape to collect values
+var metricCollectors = map[int]func() []metricSample{}
+var metricCollectorsCounter int
+var metricCollectorsMutex sync.Mutex
+
+// Registers a function that returns the current values of something.
+// Returns an ID that has to be passed to metricsUnregisterCollector() later.
+func metricsRegisterCollector(collector func() []metricSample) int {
+	metricCollectorsMutex.Lock()
+	defer metricCollectorsMutex.Unlock()
+
+	metricCollectorsCounter++
+	metricCollectors[metricCollectorsCounter] = collector
+
+	return metricCollectorsCounter
+}
+
+func metricsUnregisterCollector(id int) {
+	metricCollectorsMutex.Lock()
+	defer metricCollectorsMutex.Unlock()
+
+	delete(metricCollectors, id)
+}
+
+// Registers a collector for the usual metrics of a game connection and its canvas.
+// The connection is identified by the given name in all metrics.
+func metricsRegisterConnection(name string, con connection, can *canvas) int {
+	labels := metricLabels("connection", name)
+
+	return metricsRegisterCollector(func() []metricSample {
+		valid, downloading, invalid, compressed := can.getChunkStats()
+		samples := []metricSample{
+			{"d3pixelbot_online_players", labels, float64(con.getOnlinePlayers())},
+			{"d3pixelbot_chunks", metricJoinLabels(labels, metricLabels("state", "valid")), float64(valid)},
+			{"d3pixelbot_chunks", metricJoinLabels(labels, metricLabels("state", "downloading")), float64(downloading)},
+			{"d3pixelbot_chunks", metricJoinLabels(labels, metricLabels("state", "invalid")), float64(invalid)},
+			{"d3pixelbot_compressed_chunks", labels, float64(compressed)},
+			{"d3pixelbot_chunk_request_queue_length", labels, float64(len(can.ChunkRequestChan))},
+			{"d3pixelbot_pixel_events_total", labels, float64(can.getPixelEvents())},
+		}
+		for name, length := range can.getListenerQueueLengths() {
+			samples = append(samples, metricSample{"d3pixelbot_canvas_listener_queue_length", metricJoinLabels(labels, metricLabels("listener", name)), float64(length)})
+		}
+		return samples
+	})
+}
+
+// Writes all metrics in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	metricChunkDownloadDuration.write(w)
+	metricChunkDownloadFailures.write(w)
+	metricWebsocketReconnects.write(w)
+	metricRecordingBytes.write(w)
+	metricListenerDroppedEvents.write(w)
+	metricListenerCoalescedEvents.write(w)
+
+	// Collect values, and group them by name
+	metricCollectorsMutex.Lock()
+	collectors := []func() []metricSample{}
+	for _, collector := range metricCollectors {
+		collectors = append(collectors, collector)
+	}
+	metricCollectorsMutex.Unlock()
+
+	samples := map[string]map[string]float64{}
+	for _, collector := range collectors {
+		for _, sample := range collector() {
+			if _, ok := metricCollected[sample.Name]; !ok {
+				log.Warnf("Metric %v is not declared", sample.Name)
+				continue
+			}
+			if samples[sample.Name] == nil {
+				samples[sample.Name] = map[string]float64{}
+			}
+			samples[sample.Name][sample.Labels] = sample.Value
+		}
+	}
+
+	names := []string{}
+	for name := range metricCollected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, metricCollected[name].Help, name, metricCollected[name].Type)
+		for _, labels := range metricSortedKeys(samples[name]) {
+			fmt.Fprintf(w, "%v%v %v\n", name, metricLabelBraces(labels), metricFormatFloat(samples[name][labels]))
+		}
+	}
+}
+
+// Handles /metrics requests
+func (srv *remoteServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// Returns a label string of the given key value pairs, e.g. `connection="pixelcanvasio",state="valid"`
+func metricLabels(keyValues ...string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(keyValues[i+1])
+		pairs = append(pairs, keyValues[i]+"=\""+value+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+func metricJoinLabels(labels ...string) string {
+	nonEmpty := []string{}
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+func metricLabelBraces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func metricFormatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func metricSortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writer that counts the written bytes into a counter
+type metricCountingWriter struct {
+	Writer  io.Writer
+	Counter *metricCounter
+	Labels  string
+}
+
+func (w *metricCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Counter.add(w.Labels, float64(n))
+	return n, err
+}
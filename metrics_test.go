@@ -0,0 +1,109 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_metricHistogram(t *testing.T) {
+	m := newMetricHistogram("test_duration_seconds", "Test.", []float64{1, 5})
+	m.observe(metricLabels("connection", "a"), 0.5)
+	m.observe(metricLabels("connection", "a"), 2)
+	m.observe(metricLabels("connection", "a"), 10)
+
+	buf := &bytes.Buffer{}
+	m.write(buf)
+
+	want := `# HELP test_duration_seconds Test.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{connection="a",le="1"} 1
+test_duration_seconds_bucket{connection="a",le="5"} 2
+test_duration_seconds_bucket{connection="a",le="+Inf"} 3
+test_duration_seconds_sum{connection="a"} 12.5
+test_duration_seconds_count{connection="a"} 3
+`
+	if buf.String() != want {
+		t.Errorf("Got\n%v\nwant\n%v", buf.String(), want)
+	}
+}
+
+func Test_metricLabels(t *testing.T) {
+	if got, want := metricLabels("a", "x", "b", "quote\" backslash\\ newline\n"), `a="x",b="quote\" backslash\\ newline\n"`; got != want {
+		t.Errorf("metricLabels() = %v, want %v", got, want)
+	}
+}
+
+func Test_metricsEndpoint(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	id := metricsRegisterConnection("metricstest", &testConnection{can}, can)
+	defer metricsUnregisterCollector(id)
+
+	// Create some chunks in different states
+	can.getChunk(chunkCoordinate{0, 0}, true)
+	can.getChunk(chunkCoordinate{1, 0}, true)
+	can.signalDownload(image.Rect(64, 0, 128, 64))
+	can.setPixel(image.Point{1, 1}, pixelcanvasioPalette[1])
+
+	// Counters are global, so they may contain values of earlier test runs
+	failures := metricChunkDownloadFailures.get(metricLabels("connection", "metricstest")) + 2
+	metricChunkDownloadFailures.add(metricLabels("connection", "metricstest"), 2)
+
+	srv := newRemoteServer()
+	srv.enableMetrics()
+	srv.setTokens([]remoteToken{{Name: "Test", Token: "secret", Permissions: []remotePermission{remotePermissionView}}})
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	defer srv.Close()
+
+	resp, err := http.Get(ts.URL + "/metrics?token=secret")
+	if err != nil {
+		t.Fatalf("Can't get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Can't read metrics: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %v: %s", resp.StatusCode, data)
+	}
+
+	for _, want := range []string{
+		"# TYPE d3pixelbot_chunks gauge\n",
+		"d3pixelbot_chunks{connection=\"metricstest\",state=\"downloading\"} 1\n",
+		"d3pixelbot_chunks{connection=\"metricstest\",state=\"invalid\"} 1\n",
+		"d3pixelbot_chunks{connection=\"metricstest\",state=\"valid\"} 0\n",
+		"d3pixelbot_online_players{connection=\"metricstest\"} 42\n",
+		"# TYPE d3pixelbot_pixel_events_total counter\n",
+		"d3pixelbot_pixel_events_total{connection=\"metricstest\"} 1\n",
+		"d3pixelbot_chunk_download_failures_total{connection=\"metricstest\"} " + metricFormatFloat(failures) + "\n",
+		"d3pixelbot_stream_clients 0\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Metrics don't contain %q", want)
+		}
+	}
+}
@@ -14,9 +14,6 @@
     You should have received a copy of the GNU General Public License
     along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
 
-// TODO: Send pixels to game API
-// TODO: Handle captchas, and forward them somewhere
-
 package main
 
 import (
@@ -28,6 +25,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -61,6 +59,8 @@ var pixelcanvasioPalette = []color.Color{
 	color.RGBA{130, 0, 128, 255},
 }
 
+var pixelcanvasioColorModel = canvasColorModel{Type: canvasColorModelIndexed, Palette: pixelcanvasioPalette}
+
 type connectionPixelcanvasio struct {
 	Fingerprint      string
 	OnlinePlayers    uint32 // Must be read atomically
@@ -68,11 +68,17 @@ type connectionPixelcanvasio struct {
 	AuthName, AuthID string
 	NextPixel        time.Time
 
+	Proxy                  string // Name of the proxy used for downloads and the websocket connection, empty for direct connections
+	Client, BigchunkClient *http.Client
+	Dialer                 *websocket.Dialer
+
 	Canvas *canvas
 
 	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
 	QuitWaitgroup     sync.WaitGroup
 	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+
+	MetricsCollectorID int
 }
 
 func init() {
@@ -85,7 +91,9 @@ func init() {
 
 var pixelcanvasioSingleton = &refCountingSingleton{}
 
-func newPixelcanvasio() (connection, *canvas) {
+func newPixelcanvasio() (connection, *canvas, error) {
+	var initErr error
+
 	// Init function. It isn't called if there is already an instance of connectionPixelcanvasio
 	init := func() interface{} {
 
@@ -94,7 +102,31 @@ func newPixelcanvasio() (connection, *canvas) {
 			GoroutineQuit: make(chan struct{}),
 		}
 
-		con.Canvas, con.ChunkDownloadChan = newCanvas(pixelcanvasioChunkCollectionPixelSize, pixelcanvasioChunkOffset, pixelcanvasioCanvasRect)
+		if conf != nil {
+			conf.Get(".pixelcanvasio.proxy", &con.Proxy)
+		}
+		var err error
+		if con.Client, err = proxies.httpClient(con.Proxy, 10*time.Second); err != nil {
+			initErr = fmt.Errorf("Can't use proxy: %v", err)
+			return nil
+		}
+		con.BigchunkClient, _ = proxies.httpClient(con.Proxy, 1*time.Minute)
+		con.Dialer, _ = proxies.websocketDialer(con.Proxy)
+
+		options := canvasOptionsFromConfig()
+		options.ColorModel = pixelcanvasioColorModel
+		con.Canvas, con.ChunkDownloadChan = newCanvas(pixelcanvasioChunkCollectionPixelSize, pixelcanvasioChunkOffset, pixelcanvasioCanvasRect, options)
+		con.MetricsCollectorID = metricsRegisterConnection("pixelcanvasio", con, con.Canvas)
+		metricsLabels := metricLabels("connection", "pixelcanvasio")
+
+		// Show the last known state of the canvas, until the chunks are downloaded again
+		if canvasSnapshotsEnabled() {
+			if snap, err := loadCanvasSnapshotFile(canvasSnapshotPath("pixelcanvasio")); err != nil {
+				log.Debugf("No snapshot restored: %v", err)
+			} else if err := con.Canvas.restoreSnapshot(snap, false); err != nil {
+				log.Warnf("Can't restore snapshot: %v", err)
+			}
+		}
 
 		// Main goroutine that handles queries and timed things
 		con.QuitWaitgroup.Add(1)
@@ -108,24 +140,28 @@ func newPixelcanvasio() (connection, *canvas) {
 				response := &struct {
 					Online int `json:"online"`
 				}{}
-				if err := getJSON("https://pixelcanvas.io/api/online", response); err == nil {
+				if err := getJSON(con.Client, "https://pixelcanvas.io/api/online", response); err == nil {
 					atomic.StoreUint32(&con.OnlinePlayers, uint32(response.Online))
 					log.Debugf("Player amount: %v", response.Online)
 				}
 			}
 			getOnlinePlayers()
 
+			snapshotTicker := time.NewTicker(10 * time.Minute)
+			defer snapshotTicker.Stop()
+
 			for {
 				select {
 				case <-queryTicker.C:
 					getOnlinePlayers()
+				case <-snapshotTicker.C:
+					con.saveSnapshot()
 				case <-con.GoroutineQuit:
 					return
 				}
 			}
 		}()
 
-		myClient := &http.Client{Timeout: 1 * time.Minute}
 		downloadWaitgroup := sync.WaitGroup{}   // To wait until all downloads are finished
 		downloadLimit := make(chan struct{}, 3) // Limit maximum amount of simultaneous downloads to 3
 		handleDownload := func(chu *chunk) error {
@@ -157,9 +193,19 @@ func newPixelcanvasio() (connection, *canvas) {
 				defer func() { <-downloadLimit }()
 
 				startTime := time.Now()
+				totalStartTime := startTime
 				log.Tracef("Download at %v started", cc)
 
-				r, err := myClient.Get(fmt.Sprintf("https://api.pixelcanvas.io/api/bigchunk/%v.%v.bmp", cc.X, cc.Y))
+				// Reset the chunks if the download fails, so they can be downloaded again
+				success := false
+				defer func() {
+					if !success {
+						metricChunkDownloadFailures.add(metricsLabels, 1)
+						con.Canvas.failDownload(ca)
+					}
+				}()
+
+				r, err := con.BigchunkClient.Get(fmt.Sprintf("https://api.pixelcanvas.io/api/bigchunk/%v.%v.bmp", cc.X, cc.Y))
 				if err != nil {
 					log.Errorf("Can't get bigchunk at %v: %v", cc, err)
 					return
@@ -171,38 +217,17 @@ func newPixelcanvasio() (connection, *canvas) {
 					log.Errorf("Error in bigchunk result: %v", err)
 					return
 				}
-				expectedLen := pixelcanvasioChunkSize.X * pixelcanvasioChunkSize.Y * ((pixelcanvasioChunkCollectionSize.X) * (pixelcanvasioChunkCollectionSize.Y)) / 2
-				if len(raw) != expectedLen {
-					log.Errorf("Returned image data has the wrong length (%v, expected %v)", len(raw), expectedLen)
-					log.Errorf("API returned %v", string(raw[:1000]))
-					return
-				}
-
 				downloadTime := time.Now().Sub(startTime).Seconds()
 				startTime = time.Now()
 
-				img := image.NewPaletted(ca, pixelcanvasioPalette)
-				i := 0
-
-				for iy := 0; iy < pixelcanvasioChunkCollectionSize.Y; iy++ {
-					for ix := 0; ix < pixelcanvasioChunkCollectionSize.X; ix++ {
-						c := chunkCoordinate{
-							X: cc.X + ix - pixelcanvasioChunkCollectionRadius,
-							Y: cc.Y + iy - pixelcanvasioChunkCollectionRadius,
-						}
-						for jy := 0; jy < pixelcanvasioChunkSize.Y; jy++ {
-							for jx := 0; jx < pixelcanvasioChunkSize.X; jx += 2 {
-								p := image.Point{
-									X: c.X*pixelcanvasioChunkSize.X + jx,
-									Y: c.Y*pixelcanvasioChunkSize.Y + jy,
-								}
-
-								img.SetColorIndex(p.X, p.Y, (raw[i]>>4)&0x0F) // TODO: Optimize image drawing for receiving
-								img.SetColorIndex(p.X+1, p.Y, raw[i]&0x0F)
-								i++
-							}
-						}
+				img, err := pixelcanvasioDecodeBigchunk(raw, ca)
+				if err != nil {
+					log.Errorf("Can't decode bigchunk at %v: %v", cc, err)
+					if len(raw) > 1000 {
+						raw = raw[:1000]
 					}
+					log.Errorf("API returned %v", string(raw))
+					return
 				}
 
 				drawTime := time.Now().Sub(startTime).Seconds()
@@ -214,7 +239,10 @@ func newPixelcanvasio() (connection, *canvas) {
 					return
 				}
 
+				success = true
+
 				setTime := time.Now().Sub(startTime).Seconds()
+				metricChunkDownloadDuration.observe(metricsLabels, time.Now().Sub(totalStartTime).Seconds())
 				log.Tracef("Times for %v: Download %.3fs, Drawing %.3fs, setImage() %.5fs ", cc, downloadTime, drawTime, setTime)
 
 			}()
@@ -236,6 +264,9 @@ func newPixelcanvasio() (connection, *canvas) {
 				}
 
 				// Any following connection attempt should be delayed a few seconds
+				if waitTime > 0 {
+					metricWebsocketReconnects.add(metricsLabels, 1)
+				}
 				waitTime = 5 * time.Second
 
 				u, err := url.Parse("wss://ws.pixelcanvas.io:8443")
@@ -247,7 +278,7 @@ func newPixelcanvasio() (connection, *canvas) {
 				u.RawQuery = "fingerprint=" + con.Fingerprint
 
 				// Connect to websocket server
-				c, _, err := websocket.DefaultDialer.Dial(u.String(), nil) // TODO: Ping websocket connection and set timeouts
+				c, _, err := con.Dialer.Dial(u.String(), nil) // TODO: Ping websocket connection and set timeouts
 				if err != nil {
 					log.Errorf("Failed to connect to websocket server %v: %v", u.String(), err)
 					continue
@@ -260,7 +291,7 @@ func newPixelcanvasio() (connection, *canvas) {
 						select {
 						case chu := <-con.ChunkDownloadChan:
 							// Check if the chunk still needs to be downloaded
-							if chu.getQueryState(false) == chunkDownload {
+							if chu.getQueryState(false, con.Canvas.Options) == chunkDownload {
 								handleDownload(chu)
 							}
 						case <-chunkDownloaderQuit:
@@ -339,9 +370,13 @@ func newPixelcanvasio() (connection, *canvas) {
 	}
 
 	// Create or reuse instance of connectionPixelcanvasio
-	con := pixelcanvasioSingleton.get(init).(*connectionPixelcanvasio)
+	conInterface := pixelcanvasioSingleton.get(init)
+	if conInterface == nil {
+		return nil, nil, initErr
+	}
+	con := conInterface.(*connectionPixelcanvasio)
 
-	return con, con.Canvas
+	return con, con.Canvas, nil
 }
 
 func (con *connectionPixelcanvasio) getShortName() string {
@@ -352,6 +387,10 @@ func (con *connectionPixelcanvasio) getName() string {
 	return "PixelCanvas.io"
 }
 
+// The game sends all pixel changes, there is nothing to subscribe to
+func (con *connectionPixelcanvasio) subscribe(rects []image.Rectangle)   {}
+func (con *connectionPixelcanvasio) unsubscribe(rects []image.Rectangle) {}
+
 func (con *connectionPixelcanvasio) getOnlinePlayers() int {
 	return int(atomic.LoadUint32(&con.OnlinePlayers))
 }
@@ -364,7 +403,7 @@ func (con *connectionPixelcanvasio) authenticateMe() error {
 		Fingerprint: con.Fingerprint,
 	}
 
-	statusCode, _, body, err := postJSON("https://europe-west1-pixelcanvasv2.cloudfunctions.net/me", "https://pixelcanvas.io/", request)
+	statusCode, _, body, err := postJSON(con.Client, "https://europe-west1-pixelcanvasv2.cloudfunctions.net/me", "https://pixelcanvas.io/", request)
 	if err != nil {
 		return err
 	}
@@ -395,6 +434,89 @@ func (con *connectionPixelcanvasio) authenticateMe() error {
 	return nil
 }
 
+var pixelcanvasioPixelURL = "https://europe-west1-pixelcanvasv2.cloudfunctions.net/pixel"
+
+// Places a pixel with the fingerprint of the given account
+func (con *connectionPixelcanvasio) placePixel(acc botAccount, pos image.Point, col color.Color) (time.Duration, error) {
+	colorIndex := -1
+	r1, g1, b1, a1 := col.RGBA()
+	for i, paletteColor := range pixelcanvasioPalette {
+		if r2, g2, b2, a2 := paletteColor.RGBA(); r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2 {
+			colorIndex = i
+			break
+		}
+	}
+	if colorIndex < 0 {
+		return 0, fmt.Errorf("Color %v isn't part of the palette", col)
+	}
+
+	request := struct {
+		X           int     `json:"x"`
+		Y           int     `json:"y"`
+		Color       int     `json:"color"`
+		Fingerprint string  `json:"fingerprint"`
+		Token       *string `json:"token"`
+		Wasabi      int     `json:"wasabi"`
+	}{
+		X:           pos.X,
+		Y:           pos.Y,
+		Color:       colorIndex,
+		Fingerprint: acc.Fingerprint,
+		Wasabi:      pos.X + pos.Y + 2342,
+	}
+	if acc.Token != "" {
+		request.Token = &acc.Token
+	}
+
+	// Every account can use its own proxy
+	client, err := proxies.httpClient(acc.Proxy, 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+
+	statusCode, _, body, err := postJSON(client, pixelcanvasioPixelURL, "https://pixelcanvas.io/", request)
+	if err != nil {
+		return 0, err
+	}
+
+	response := &struct {
+		Success     bool    `json:"success"`
+		WaitSeconds float64 `json:"waitSeconds"`
+		Errors      []struct {
+			Msg string `json:"msg"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return 0, fmt.Errorf("Invalid response with status code %v: %v", statusCode, err)
+	}
+	wait := time.Duration(response.WaitSeconds * float64(time.Second))
+
+	if statusCode == http.StatusOK && response.Success {
+		return wait, nil
+	}
+
+	messages := []string{}
+	for _, e := range response.Errors {
+		messages = append(messages, e.Msg)
+	}
+	placeErr := &placementError{
+		Reason:  placementErrorOther,
+		Wait:    wait,
+		Message: fmt.Sprintf("Placement failed with status code %v: %v", statusCode, strings.Join(messages, ", ")),
+	}
+	message := strings.ToLower(strings.Join(messages, " "))
+	switch {
+	case strings.Contains(message, "proxy") || strings.Contains(message, "vpn"):
+		placeErr.Reason = placementErrorProxy
+	case strings.Contains(message, "captcha") || strings.Contains(message, "provide a token"): // "You must provide a token" means a reCAPTCHA has to be solved
+		placeErr.Reason = placementErrorCaptcha
+	case wait > 0:
+		placeErr.Reason = placementErrorCooldown
+	}
+
+	return 0, placeErr
+}
+
 // Closes connection and canvas
 func (con *connectionPixelcanvasio) Close() {
 	if pixelcanvasioSingleton.release(con) {
@@ -403,6 +525,50 @@ func (con *connectionPixelcanvasio) Close() {
 
 		con.QuitWaitgroup.Wait()
 
+		con.saveSnapshot()
+		metricsUnregisterCollector(con.MetricsCollectorID)
 		con.Canvas.Close()
 	}
 }
+
+// Decodes the image data of a bigchunk into a paletted image at rect.
+// The data contains all chunks inside of rect in row major order, and each chunk contains its pixels in row major order.
+// Every byte contains two palette indices, the upper nibble is the left pixel.
+func pixelcanvasioDecodeBigchunk(raw []byte, rect image.Rectangle) (*image.Paletted, error) {
+	chunkWidth, chunkHeight := pixelcanvasioChunkSize.X, pixelcanvasioChunkSize.Y
+	if rect.Empty() || rect.Dx()%chunkWidth != 0 || rect.Dy()%chunkHeight != 0 {
+		return nil, fmt.Errorf("Rectangle %v isn't a multiple of the chunk size %v", rect, pixelcanvasioChunkSize)
+	}
+	if expectedLen := rect.Dx() * rect.Dy() / 2; len(raw) != expectedLen {
+		return nil, fmt.Errorf("Image data has the wrong length (%v, expected %v)", len(raw), expectedLen)
+	}
+
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	lineBytes := chunkWidth / 2
+
+	for iy := 0; iy < rect.Dy()/chunkHeight; iy++ {
+		for ix := 0; ix < rect.Dx()/chunkWidth; ix++ {
+			for jy := 0; jy < chunkHeight; jy++ {
+				offset := (iy*chunkHeight+jy)*img.Stride + ix*chunkWidth
+				line := img.Pix[offset : offset+chunkWidth]
+				for jx, b := range raw[:lineBytes] {
+					line[jx*2], line[jx*2+1] = b>>4, b&0x0F
+				}
+				raw = raw[lineBytes:]
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// Stores the current state of the canvas, so it can be shown on the next start
+func (con *connectionPixelcanvasio) saveSnapshot() {
+	if !canvasSnapshotsEnabled() {
+		return
+	}
+
+	if err := con.Canvas.saveSnapshotFile(canvasSnapshotPath("pixelcanvasio")); err != nil {
+		log.Warnf("Can't save snapshot: %v", err)
+	}
+}
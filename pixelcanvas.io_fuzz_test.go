@@ -0,0 +1,48 @@
+//go:build go1.18
+// +build go1.18
+
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// Decodes random data with random lengths and rectangles, which must never panic.
+// Native fuzzing needs Go 1.18 or newer, older toolchains skip this file
+func Fuzz_pixelcanvasioDecodeBigchunk(f *testing.F) {
+	f.Add([]byte{}, uint8(0), uint8(0))
+	f.Add(make([]byte, 2048), uint8(1), uint8(1))
+	f.Add(make([]byte, 2047), uint8(1), uint8(1))
+	f.Add(make([]byte, 4096), uint8(2), uint8(1))
+	f.Add(make([]byte, 4096), uint8(1), uint8(3))
+
+	f.Fuzz(func(t *testing.T, raw []byte, chunksX, chunksY uint8) {
+		rect := image.Rect(-64, 128, -64+int(chunksX%4)*pixelcanvasioChunkSize.X, 128+int(chunksY%4)*pixelcanvasioChunkSize.Y)
+		img, err := pixelcanvasioDecodeBigchunk(raw, rect)
+
+		valid := !rect.Empty() && len(raw) == rect.Dx()*rect.Dy()/2
+		if valid != (err == nil) {
+			t.Fatalf("pixelcanvasioDecodeBigchunk() with %v bytes at %v returned %v", len(raw), rect, err)
+		}
+		if valid && !compareImages(img, pixelcanvasioDecodeBigchunkReference(raw, rect)) {
+			t.Errorf("pixelcanvasioDecodeBigchunk() differs from the reference implementation")
+		}
+	})
+}
@@ -17,9 +17,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -48,7 +53,10 @@ func Test_newPixelcanvasio(t *testing.T) {
 		t.Skip("Skipping testing in CI environment")
 	}
 
-	con, can := newPixelcanvasio()
+	con, can, err := newPixelcanvasio()
+	if err != nil {
+		t.Fatalf("Can't open connection: %v", err)
+	}
 	defer con.Close()
 
 	cdw, err := can.newCanvasDiskWriter("pixelcanvas.io")
@@ -72,3 +80,128 @@ func Test_newPixelcanvasio(t *testing.T) {
 		t.Errorf("Can't save image to disk: %v", err)
 	}
 }
+
+// Reference implementation of the bigchunk decoder, that sets every pixel on its own
+func pixelcanvasioDecodeBigchunkReference(raw []byte, rect image.Rectangle) *image.Paletted {
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	i := 0
+	for iy := 0; iy < rect.Dy()/pixelcanvasioChunkSize.Y; iy++ {
+		for ix := 0; ix < rect.Dx()/pixelcanvasioChunkSize.X; ix++ {
+			for jy := 0; jy < pixelcanvasioChunkSize.Y; jy++ {
+				for jx := 0; jx < pixelcanvasioChunkSize.X; jx += 2 {
+					p := rect.Min.Add(image.Point{ix*pixelcanvasioChunkSize.X + jx, iy*pixelcanvasioChunkSize.Y + jy})
+					img.SetColorIndex(p.X, p.Y, raw[i]>>4)
+					img.SetColorIndex(p.X+1, p.Y, raw[i]&0x0F)
+					i++
+				}
+			}
+		}
+	}
+	return img
+}
+
+func Test_pixelcanvasioDecodeBigchunk(t *testing.T) {
+	size := image.Point(pixelcanvasioChunkCollectionSize.getPixelSize(pixelcanvasioChunkSize))
+	rect := image.Rectangle{Max: size}.Add(image.Point{-size.X, 2 * size.Y})
+	raw := make([]byte, rect.Dx()*rect.Dy()/2)
+	rand.Read(raw)
+
+	img, err := pixelcanvasioDecodeBigchunk(raw, rect)
+	if err != nil {
+		t.Fatalf("pixelcanvasioDecodeBigchunk() failed: %v", err)
+	}
+	if !compareImages(img, pixelcanvasioDecodeBigchunkReference(raw, rect)) {
+		t.Errorf("pixelcanvasioDecodeBigchunk() differs from the reference implementation")
+	}
+
+	if _, err := pixelcanvasioDecodeBigchunk(raw[:len(raw)-1], rect); err == nil {
+		t.Errorf("pixelcanvasioDecodeBigchunk() accepted data that is too short")
+	}
+	if _, err := pixelcanvasioDecodeBigchunk(raw, rect.Inset(1)); err == nil {
+		t.Errorf("pixelcanvasioDecodeBigchunk() accepted a rectangle that isn't a multiple of the chunk size")
+	}
+}
+
+func Benchmark_pixelcanvasioDecodeBigchunk(b *testing.B) {
+	rect := image.Rectangle{Max: image.Point(pixelcanvasioChunkCollectionSize.getPixelSize(pixelcanvasioChunkSize))}
+	raw := make([]byte, rect.Dx()*rect.Dy()/2)
+	rand.Read(raw)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pixelcanvasioDecodeBigchunk(raw, rect)
+	}
+}
+
+func Benchmark_pixelcanvasioDecodeBigchunkReference(b *testing.B) {
+	rect := image.Rectangle{Max: image.Point(pixelcanvasioChunkCollectionSize.getPixelSize(pixelcanvasioChunkSize))}
+	raw := make([]byte, rect.Dx()*rect.Dy()/2)
+	rand.Read(raw)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pixelcanvasioDecodeBigchunkReference(raw, rect)
+	}
+}
+
+func Test_pixelcanvasioPlacePixel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			X, Y, Color, Wasabi int
+			Fingerprint         string
+			Token               *string
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Wasabi != request.X+request.Y+2342 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch request.Fingerprint {
+		case "ok":
+			if request.Color != 5 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"success":true,"waitSeconds":30}`))
+		case "proxy":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"msg":"You are using a Proxy!!!11!one"}]}`))
+		case "wait":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":[{"msg":"You must wait"}],"waitSeconds":12.5}`))
+		case "captcha":
+			if request.Token != nil {
+				w.Write([]byte(`{"success":true,"waitSeconds":30}`))
+				return
+			}
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":[{"msg":"You must provide a token"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	oldURL := pixelcanvasioPixelURL
+	pixelcanvasioPixelURL = srv.URL
+	defer func() { pixelcanvasioPixelURL = oldURL }()
+
+	con := &connectionPixelcanvasio{}
+	red := color.RGBA{229, 0, 0, 255}
+
+	if cooldown, err := con.placePixel(botAccount{Fingerprint: "ok"}, image.Point{-5, 10}, red); err != nil || cooldown != 30*time.Second {
+		t.Errorf("placePixel() = %v, %v, want %v, nil", cooldown, err, 30*time.Second)
+	}
+	if _, err := con.placePixel(botAccount{Fingerprint: "ok"}, image.Point{}, color.RGBA{1, 2, 3, 255}); err == nil {
+		t.Errorf("Color outside of the palette was accepted")
+	}
+	if _, err := con.placePixel(botAccount{Fingerprint: "proxy"}, image.Point{}, red); err == nil || err.(*placementError).Reason != placementErrorProxy {
+		t.Errorf("placePixel() returned %v, want proxy error", err)
+	}
+	if _, err := con.placePixel(botAccount{Fingerprint: "wait"}, image.Point{}, red); err == nil || err.(*placementError).Reason != placementErrorCooldown || err.(*placementError).Wait != 12500*time.Millisecond {
+		t.Errorf("placePixel() returned %#v, want cooldown error", err)
+	}
+	if _, err := con.placePixel(botAccount{Fingerprint: "captcha"}, image.Point{}, red); err == nil || err.(*placementError).Reason != placementErrorCaptcha {
+		t.Errorf("placePixel() returned %#v, want captcha error", err)
+	}
+	if _, err := con.placePixel(botAccount{Fingerprint: "captcha", Token: "solved"}, image.Point{}, red); err != nil {
+		t.Errorf("placePixel() with token returned %v", err)
+	}
+}
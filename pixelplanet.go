@@ -0,0 +1,541 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const pixelplanetDefaultAddress = "https://pixelplanet.fun"
+
+var pixelplanetChunkSize = pixelSize{256, 256}
+
+// Opcodes of the binary websocket protocol
+const (
+	pixelplanetOpcodeRegisterCanvas   uint8 = 0xA0
+	pixelplanetOpcodeRegisterChunk    uint8 = 0xA1
+	pixelplanetOpcodeDeRegisterChunk  uint8 = 0xA2
+	pixelplanetOpcodeOnlineCounter    uint8 = 0xA7
+	pixelplanetOpcodePixelUpdate      uint8 = 0xC1
+	pixelplanetChunkDataProtectedMask uint8 = 0x80 // Bit of the chunk data, that marks protected pixels
+)
+
+// Connection to a single canvas of a PixelPlanet.fun like game
+type connectionPixelplanet struct {
+	URL           string // Base URL of the game, without trailing slash
+	CanvasID      string
+	CanvasNumber  uint8 // Numeric canvas ID, as it is sent over the websocket
+	Info          pixelplanetCanvasInfo
+	OnlinePlayers uint32 // Must be read atomically
+
+	Client *http.Client      // Uses the proxy of the connection, if there is one
+	Dialer *websocket.Dialer // Uses the proxy of the connection, if there is one
+
+	Canvas *canvas
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+
+	SubscribedMutex   sync.Mutex
+	Subscribed        map[image.Rectangle]struct{} // Chunk rectangles that are inside of listener rectangles, they are registered on the websocket
+	SubscriptionsChan chan struct{}                // Signals changes of Subscribed
+
+	MetricsCollectorID int
+}
+
+// Description of a canvas, as returned by the me endpoint
+type pixelplanetCanvasInfo struct {
+	Ident  string     `json:"ident"`
+	Title  string     `json:"title"`
+	Colors [][3]uint8 `json:"colors"`
+	Size   int        `json:"size"` // Width and height of the canvas, the center is at 0, 0
+}
+
+func init() {
+	// Register connection types (all init functions are called from a single thread, thus threadsafe)
+	connectionTypes["pixelplanet"] = connectionType{
+		Name: "PixelPlanet.fun",
+		FunctionNew: func() (connection, *canvas, error) {
+			address, canvasID, proxy := pixelplanetDefaultAddress, "0", ""
+			if conf != nil {
+				conf.Get(".pixelplanet.address", &address)
+				conf.Get(".pixelplanet.canvas", &canvasID)
+				conf.Get(".pixelplanet.proxy", &proxy)
+			}
+			return newPixelplanet(address, canvasID, proxy)
+		},
+	}
+}
+
+var pixelplanetSingletons = map[string]*refCountingSingleton{} // One singleton per URL and canvas
+var pixelplanetSingletonsMutex sync.Mutex
+
+// Returns the info of all canvases of the game at the given base URL
+func pixelplanetGetCanvases(client *http.Client, u string) (map[string]pixelplanetCanvasInfo, error) {
+	var me struct {
+		Canvases map[string]pixelplanetCanvasInfo `json:"canvases"`
+	}
+	if err := getJSON(client, u+"/api/me", &me); err != nil {
+		return nil, err
+	}
+
+	return me.Canvases, nil
+}
+
+// Opens a connection to the canvas with the given ID of the game at the given base URL, e.g. "https://pixelplanet.fun".
+// All requests go through the proxy with the given name, or directly if it's empty.
+func newPixelplanet(u, canvasID, proxy string) (connection, *canvas, error) {
+	u = strings.TrimRight(u, "/")
+	key := u + "#" + canvasID
+
+	pixelplanetSingletonsMutex.Lock()
+	singleton, ok := pixelplanetSingletons[key]
+	if !ok {
+		singleton = &refCountingSingleton{}
+		pixelplanetSingletons[key] = singleton
+	}
+	pixelplanetSingletonsMutex.Unlock()
+
+	var initErr error
+
+	// Init function. It isn't called if there is already an instance for this canvas
+	init := func() interface{} {
+		con := &connectionPixelplanet{
+			URL:               u,
+			CanvasID:          canvasID,
+			GoroutineQuit:     make(chan struct{}),
+			Subscribed:        map[image.Rectangle]struct{}{},
+			SubscriptionsChan: make(chan struct{}, 1),
+		}
+
+		number, err := strconv.ParseUint(canvasID, 10, 8)
+		if err != nil {
+			initErr = fmt.Errorf("Invalid canvas ID %q: %v", canvasID, err)
+			return nil
+		}
+		con.CanvasNumber = uint8(number)
+
+		if con.Client, err = proxies.httpClient(proxy, 10*time.Second); err != nil {
+			initErr = fmt.Errorf("Can't use proxy: %v", err)
+			return nil
+		}
+		con.Dialer, _ = proxies.websocketDialer(proxy)
+
+		canvases, err := pixelplanetGetCanvases(con.Client, u)
+		if err != nil {
+			initErr = fmt.Errorf("Can't get canvases from %v: %v", u, err)
+			return nil
+		}
+		if con.Info, ok = canvases[canvasID]; !ok {
+			initErr = fmt.Errorf("Canvas %q doesn't exist on %v", canvasID, u)
+			return nil
+		}
+		if con.Info.Size <= 0 || con.Info.Size%pixelplanetChunkSize.X != 0 || con.Info.Size/pixelplanetChunkSize.X > 256 {
+			initErr = fmt.Errorf("Unsupported canvas size %v", con.Info.Size)
+			return nil
+		}
+		palette := color.Palette{}
+		for _, col := range con.Info.Colors {
+			palette = append(palette, color.RGBA{col[0], col[1], col[2], 255})
+		}
+		colorModel, err := newCanvasColorModelIndexed(palette)
+		if err != nil {
+			initErr = fmt.Errorf("Invalid palette of canvas %q: %v", canvasID, err)
+			return nil
+		}
+
+		half := con.Info.Size / 2
+		options := canvasOptionsFromConfig()
+		options.ColorModel = colorModel
+		con.Canvas, con.ChunkDownloadChan = newCanvas(pixelplanetChunkSize, image.Point{}, image.Rect(-half, -half, half, half), options)
+		con.MetricsCollectorID = metricsRegisterConnection("pixelplanet:"+key, con, con.Canvas)
+		metricsLabels := metricLabels("connection", "pixelplanet:"+key)
+		con.Canvas.setSubscriber(con)
+
+		// Main goroutine that handles the websocket connection (It will always try to reconnect)
+		con.QuitWaitgroup.Add(1)
+		go func() {
+			defer con.QuitWaitgroup.Done()
+
+			waitTime := 0 * time.Second
+			for {
+				select {
+				case <-con.GoroutineQuit:
+					return
+				case <-time.After(waitTime):
+				}
+
+				// Any following connection attempt should be delayed a few seconds
+				if waitTime > 0 {
+					metricWebsocketReconnects.add(metricsLabels, 1)
+				}
+				waitTime = 5 * time.Second
+
+				wsURL, err := pixelplanetWebsocketURL(u)
+				if err != nil {
+					log.Errorf("Invalid websocket URL: %v", err)
+					continue
+				}
+
+				c, _, err := con.Dialer.Dial(wsURL, nil)
+				if err != nil {
+					log.Errorf("Failed to connect to websocket server %v: %v", wsURL, err)
+					continue
+				}
+
+				con.handleSession(c, metricsLabels)
+
+				// Pixels were missed while disconnected
+				con.Canvas.invalidateAll()
+			}
+		}()
+
+		return con
+	}
+
+	// Create or reuse instance of connectionPixelplanet
+	obj := singleton.get(init)
+	if obj == nil {
+		return nil, nil, initErr // The singleton will call init again on the next try
+	}
+	con := obj.(*connectionPixelplanet)
+
+	return con, con.Canvas, nil
+}
+
+// Returns the websocket URL of the game at the given base URL
+func pixelplanetWebsocketURL(u string) (string, error) {
+	parsed, err := url.Parse(u + "/ws")
+	if err != nil {
+		return "", err
+	}
+	switch parsed.Scheme {
+	case "https":
+		parsed.Scheme = "wss"
+	case "http":
+		parsed.Scheme = "ws"
+	}
+
+	return parsed.String(), nil
+}
+
+// Returns the chunk coordinates used by the game for the chunk at the given pixel position.
+// They start at the top left corner of the canvas.
+func (con *connectionPixelplanet) gameChunk(pos image.Point) (i, j int) {
+	half := con.Info.Size / 2
+	return (pos.X + half) / pixelplanetChunkSize.X, (pos.Y + half) / pixelplanetChunkSize.Y
+}
+
+// Encodes a chunk (de)registration message for the chunk at the given pixel position
+func (con *connectionPixelplanet) encodeChunkMessage(opcode uint8, pos image.Point) []byte {
+	i, j := con.gameChunk(pos)
+	data := []byte{opcode, 0, 0}
+	binary.BigEndian.PutUint16(data[1:], uint16(i<<8|j))
+	return data
+}
+
+// Handles a single websocket connection until it is closed.
+func (con *connectionPixelplanet) handleSession(c *websocket.Conn, metricsLabels string) {
+	log.Debugf("Connected to %v", con.URL)
+	defer log.Debugf("Disconnected from %v", con.URL)
+
+	// Wait for and handle external close events, or connection errors
+	quitChannel := make(chan struct{})
+	defer close(quitChannel)
+	go func() {
+		select {
+		case <-con.GoroutineQuit:
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		case <-quitChannel:
+		}
+		c.Close()
+	}()
+
+	downloadWaitgroup := sync.WaitGroup{}   // To wait until all downloads are finished
+	downloadLimit := make(chan struct{}, 3) // Limit maximum amount of simultaneous downloads to 3
+	defer downloadWaitgroup.Wait()
+
+	// Goroutine that registers the subscribed chunks and downloads the requested ones. It's the only one writing messages
+	writerQuit := make(chan struct{})
+	writerWaitgroup := sync.WaitGroup{}
+	defer writerWaitgroup.Wait()
+	defer close(writerQuit)
+	writerWaitgroup.Add(1)
+	go func() {
+		defer writerWaitgroup.Done()
+
+		send := func(data []byte) bool {
+			c.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+			if err := c.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				log.Warnf("Can't write to %v: %v", con.URL, err)
+				c.Close()
+				return false
+			}
+			return true
+		}
+
+		registered := map[image.Rectangle]struct{}{} // Chunk rectangles that are registered on this websocket connection
+
+		// Registers and deregisters chunks, so that they match the subscribed ones
+		syncRegistrations := func() bool {
+			con.SubscribedMutex.Lock()
+			register, deregister := []image.Rectangle{}, []image.Rectangle{}
+			for rect := range con.Subscribed {
+				if _, ok := registered[rect]; !ok {
+					register = append(register, rect)
+				}
+			}
+			for rect := range registered {
+				if _, ok := con.Subscribed[rect]; !ok {
+					deregister = append(deregister, rect)
+				}
+			}
+			con.SubscribedMutex.Unlock()
+
+			for _, rect := range deregister {
+				if !send(con.encodeChunkMessage(pixelplanetOpcodeDeRegisterChunk, rect.Min)) {
+					return false
+				}
+				delete(registered, rect)
+			}
+			for _, rect := range register {
+				if !send(con.encodeChunkMessage(pixelplanetOpcodeRegisterChunk, rect.Min)) {
+					return false
+				}
+				registered[rect] = struct{}{}
+			}
+			return true
+		}
+
+		if !send([]byte{pixelplanetOpcodeRegisterCanvas, con.CanvasNumber}) || !syncRegistrations() {
+			return
+		}
+
+		for {
+			select {
+			case chu := <-con.ChunkDownloadChan:
+				// Check if the chunk still needs to be downloaded
+				if chu.getQueryState(false, con.Canvas.Options) != chunkDownload {
+					continue
+				}
+				// The canvas subscribes chunks before requesting them, register them before downloading so no pixel is missed
+				if !syncRegistrations() {
+					return
+				}
+				if _, err := con.Canvas.signalDownload(chu.Rect); err != nil {
+					log.Warnf("Can't signal download of %v: %v", chu.Rect, err)
+					continue
+				}
+				downloadWaitgroup.Add(1)
+				go func(rect image.Rectangle) {
+					downloadLimit <- struct{}{}
+					defer downloadWaitgroup.Done()
+					defer func() { <-downloadLimit }()
+
+					startTime := time.Now()
+					if err := con.downloadChunk(rect); err != nil {
+						log.Errorf("Can't download chunk at %v: %v", rect, err)
+						metricChunkDownloadFailures.add(metricsLabels, 1)
+						con.Canvas.failDownload(rect)
+						return
+					}
+					metricChunkDownloadDuration.observe(metricsLabels, time.Now().Sub(startTime).Seconds())
+				}(chu.Rect)
+			case <-con.SubscriptionsChan:
+				if !syncRegistrations() {
+					return
+				}
+			case <-writerQuit:
+				return
+			}
+		}
+	}()
+
+	palette := con.Canvas.Options.ColorModel.Palette
+
+	// Handle events
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			log.Warnf("Websocket connection error: %v", err)
+			return
+		}
+		if len(data) < 1 {
+			continue
+		}
+
+		switch opcode := data[0]; opcode {
+		case pixelplanetOpcodePixelUpdate:
+			if len(data) != 7 {
+				log.Warnf("Pixel update from %v has the wrong length %v", con.URL, len(data))
+				continue
+			}
+			i, j := int(data[1]), int(data[2])
+			offset := int(data[3])<<16 | int(binary.BigEndian.Uint16(data[4:6]))
+			colorIndex := data[6] &^ pixelplanetChunkDataProtectedMask
+			if int(colorIndex) >= len(palette) {
+				continue
+			}
+			half := con.Info.Size / 2
+			pos := image.Point{
+				X: i*pixelplanetChunkSize.X + offset%pixelplanetChunkSize.X - half,
+				Y: j*pixelplanetChunkSize.Y + offset/pixelplanetChunkSize.X - half,
+			}
+			if err := con.Canvas.setPixel(pos, palette[colorIndex]); err != nil {
+				log.Debugf("Couldn't draw pixel at %v with color %v: %v", pos, colorIndex, err)
+			}
+		case pixelplanetOpcodeOnlineCounter:
+			if len(data) >= 3 {
+				atomic.StoreUint32(&con.OnlinePlayers, uint32(binary.BigEndian.Uint16(data[1:3])))
+			}
+		}
+	}
+}
+
+// Downloads a single chunk, and sets it as image of the canvas
+func (con *connectionPixelplanet) downloadChunk(rect image.Rectangle) error {
+	i, j := con.gameChunk(rect.Min)
+	r, err := con.Client.Get(fmt.Sprintf("%v/chunks/%v/%v/%v.bmp", con.URL, con.CanvasID, i, j))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Chunk request failed: %v", r.Status)
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("Can't read chunk data: %v", err)
+	}
+
+	img, err := pixelplanetDecodeChunk(raw, rect, con.Canvas.Options.ColorModel.Palette)
+	if err != nil {
+		return err
+	}
+
+	return con.Canvas.setImage(img, false, true)
+}
+
+// Decodes chunk data, which contains one palette index per pixel in row major order.
+// The highest bit marks protected pixels, and is ignored.
+// Empty data means that the chunk was never drawn on, it's filled with the first color.
+func pixelplanetDecodeChunk(raw []byte, rect image.Rectangle, palette color.Palette) (*image.Paletted, error) {
+	img := image.NewPaletted(rect, palette)
+	if len(raw) == 0 {
+		return img, nil
+	}
+	if len(raw) != len(img.Pix) {
+		return nil, fmt.Errorf("Chunk data has the wrong length (%v, expected %v)", len(raw), len(img.Pix))
+	}
+
+	for i, b := range raw {
+		index := b &^ pixelplanetChunkDataProtectedMask
+		if int(index) >= len(palette) {
+			index = 0
+		}
+		img.Pix[i] = index
+	}
+
+	return img, nil
+}
+
+func (con *connectionPixelplanet) getShortName() string {
+	ident := con.Info.Ident
+	if ident == "" {
+		ident = con.CanvasID
+	}
+	u, err := url.Parse(con.URL)
+	if err != nil || u.Host == "pixelplanet.fun" {
+		return "pixelplanet-" + ident
+	}
+	return "pixelplanet-" + strings.Replace(u.Host, ":", "-", -1) + "-" + ident
+}
+
+func (con *connectionPixelplanet) getName() string {
+	title := con.Info.Title
+	if title == "" {
+		title = "Canvas " + con.CanvasID
+	}
+	u, err := url.Parse(con.URL)
+	if err != nil {
+		return title
+	}
+	return fmt.Sprintf("%v (%v)", title, u.Host)
+}
+
+// Chunks have to be registered on the websocket to receive their pixel changes
+func (con *connectionPixelplanet) subscribe(rects []image.Rectangle) {
+	con.SubscribedMutex.Lock()
+	for _, rect := range rects {
+		con.Subscribed[rect] = struct{}{}
+	}
+	con.SubscribedMutex.Unlock()
+
+	select {
+	case con.SubscriptionsChan <- struct{}{}:
+	default: // There is already a pending signal
+	}
+}
+
+func (con *connectionPixelplanet) unsubscribe(rects []image.Rectangle) {
+	con.SubscribedMutex.Lock()
+	for _, rect := range rects {
+		delete(con.Subscribed, rect)
+	}
+	con.SubscribedMutex.Unlock()
+
+	select {
+	case con.SubscriptionsChan <- struct{}{}:
+	default: // There is already a pending signal
+	}
+}
+
+func (con *connectionPixelplanet) getOnlinePlayers() int {
+	return int(atomic.LoadUint32(&con.OnlinePlayers))
+}
+
+// Closes connection and canvas
+func (con *connectionPixelplanet) Close() {
+	pixelplanetSingletonsMutex.Lock()
+	singleton := pixelplanetSingletons[con.URL+"#"+con.CanvasID]
+	pixelplanetSingletonsMutex.Unlock()
+
+	if singleton.release(con) {
+		// Stop goroutines gracefully
+		close(con.GoroutineQuit)
+
+		con.QuitWaitgroup.Wait()
+
+		metricsUnregisterCollector(con.MetricsCollectorID)
+		con.Canvas.Close()
+	}
+}
@@ -0,0 +1,154 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Local stand-in for a PixelPlanet server with a single 512x512 canvas with the ID 1
+type testPixelplanetServer struct {
+	*httptest.Server
+	Conns  chan *websocket.Conn // Receives every opened websocket connection
+	Chunks map[string][]byte    // Chunk data by path, missing chunks are served empty
+}
+
+func newTestPixelplanetServer() *testPixelplanetServer {
+	srv := &testPixelplanetServer{
+		Conns:  make(chan *websocket.Conn, 10),
+		Chunks: map[string][]byte{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/me", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"canvases":{"1":{"ident":"m","title":"Moon","colors":[[255,255,255],[255,0,0],[0,0,255]],"size":512}}}`))
+	})
+	mux.HandleFunc("/chunks/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(srv.Chunks[r.URL.Path])
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		srv.Conns <- c
+	})
+	srv.Server = httptest.NewServer(mux)
+
+	return srv
+}
+
+func Test_pixelplanetDecodeChunk(t *testing.T) {
+	palette := color.Palette{color.RGBA{255, 255, 255, 255}, color.RGBA{255, 0, 0, 255}}
+	rect := image.Rect(-256, 0, 0, 256)
+
+	img, err := pixelplanetDecodeChunk(nil, rect, palette)
+	if err != nil {
+		t.Fatalf("Can't decode empty chunk: %v", err)
+	}
+	if img.Rect != rect || img.ColorIndexAt(-1, 255) != 0 {
+		t.Errorf("Empty chunk wasn't decoded as blank image")
+	}
+
+	raw := make([]byte, 256*256)
+	raw[1] = 1 | pixelplanetChunkDataProtectedMask // Protected red pixel
+	raw[2] = 5                                     // Unknown color
+	img, err = pixelplanetDecodeChunk(raw, rect, palette)
+	if err != nil {
+		t.Fatalf("Can't decode chunk: %v", err)
+	}
+	if img.ColorIndexAt(-255, 0) != 1 || img.ColorIndexAt(-254, 0) != 0 {
+		t.Errorf("Decoded indices are %v, %v, want 1, 0", img.ColorIndexAt(-255, 0), img.ColorIndexAt(-254, 0))
+	}
+
+	if _, err := pixelplanetDecodeChunk(raw[:100], rect, palette); err == nil {
+		t.Errorf("Chunk data with wrong length was accepted")
+	}
+}
+
+func Test_newPixelplanet(t *testing.T) {
+	srv := newTestPixelplanetServer()
+	defer srv.Close()
+	chunk := make([]byte, 256*256)
+	chunk[2*256+1] = 1 // Red at 1, 2 inside of the chunk
+	srv.Chunks["/chunks/1/1/0.bmp"] = chunk
+
+	if _, _, err := newPixelplanet(srv.URL, "0", ""); err == nil {
+		t.Errorf("Connection to nonexistent canvas succeeded")
+	}
+
+	con, can, err := newPixelplanet(srv.URL, "1", "")
+	if err != nil {
+		t.Fatalf("Can't open connection: %v", err)
+	}
+	defer con.Close()
+
+	if can.Rect != image.Rect(-256, -256, 256, 256) {
+		t.Errorf("Canvas has the rectangle %v, want %v", can.Rect, image.Rect(-256, -256, 256, 256))
+	}
+	if shortName := con.getShortName(); !strings.HasPrefix(shortName, "pixelplanet-127.0.0.1-") || !strings.HasSuffix(shortName, "-m") {
+		t.Errorf("Invalid short name %q", shortName)
+	}
+
+	ws := <-srv.Conns
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, msg, err := ws.ReadMessage(); err != nil || !bytes.Equal(msg, []byte{pixelplanetOpcodeRegisterCanvas, 1}) {
+		t.Fatalf("Got %v, %v, want canvas registration", msg, err)
+	}
+
+	// Request the top right chunk, which is the game chunk 1, 0
+	rect := image.Rect(0, -256, 256, 0)
+	l := &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l, true)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{rect})
+
+	if _, msg, err := ws.ReadMessage(); err != nil || !bytes.Equal(msg, []byte{pixelplanetOpcodeRegisterChunk, 1, 0}) {
+		t.Fatalf("Got %v, %v, want chunk registration", msg, err)
+	}
+	waitFor(t, "chunk download", func() bool { return can.isValid(rect) })
+
+	if col, err := can.getPixel(image.Point{1, -254}); err != nil || col != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("getPixel() = %v, %v, want red", col, err)
+	}
+
+	// Pixel update at 3, -250 to blue, and online counter
+	ws.WriteMessage(websocket.BinaryMessage, []byte{pixelplanetOpcodePixelUpdate, 1, 0, 0, 6, 3, 2})
+	ws.WriteMessage(websocket.BinaryMessage, []byte{pixelplanetOpcodeOnlineCounter, 1, 2})
+
+	waitFor(t, "pixel update", func() bool {
+		col, _ := can.getPixel(image.Point{3, -250})
+		return col == color.RGBA{0, 0, 255, 255}
+	})
+	waitFor(t, "online counter", func() bool { return con.getOnlinePlayers() == 258 })
+
+	// Chunks outside of all listener rectangles are deregistered
+	can.registerRects(l, nil)
+	if _, msg, err := ws.ReadMessage(); err != nil || !bytes.Equal(msg, []byte{pixelplanetOpcodeDeRegisterChunk, 1, 0}) {
+		t.Fatalf("Got %v, %v, want chunk deregistration", msg, err)
+	}
+}
@@ -0,0 +1,124 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync"
+	"time"
+)
+
+// Priorities of queued pixels, higher ones are placed first
+const (
+	pixelPriorityNormal  = 0
+	pixelPriorityDefense = 100 // Griefed pixels of protected templates
+)
+
+// A pixel that waits to be placed
+type queuedPixel struct {
+	Pos      image.Point
+	Color    color.Color
+	Priority int
+	Due      time.Time // The pixel isn't placed before this time
+}
+
+// Queue of pixels that should be placed, ordered by priority and due time.
+// Each position is queued at most once, queueing it again replaces the older entry.
+type pixelQueue struct {
+	sync.Mutex
+
+	Pixels  map[image.Point]queuedPixel
+	Changed chan struct{} // Gets closed and replaced whenever a pixel is queued
+}
+
+func newPixelQueue() *pixelQueue {
+	return &pixelQueue{
+		Pixels:  map[image.Point]queuedPixel{},
+		Changed: make(chan struct{}),
+	}
+}
+
+// Queues a pixel, or replaces the queued pixel at the same position
+func (q *pixelQueue) push(p queuedPixel) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.Pixels[p.Pos] = p
+
+	close(q.Changed)
+	q.Changed = make(chan struct{})
+}
+
+// Removes the queued pixel at the given position, if there is any
+func (q *pixelQueue) remove(pos image.Point) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.Pixels, pos)
+}
+
+func (q *pixelQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.Pixels)
+}
+
+// Waits until a pixel is due, and removes it from the queue.
+// Of all due pixels the one with the highest priority is returned, and of those the one that is due the longest.
+//
+// The result is false if quit got closed.
+func (q *pixelQueue) pop(quit <-chan struct{}) (queuedPixel, bool) {
+	for {
+		q.Lock()
+		now := time.Now()
+		var next *queuedPixel
+		var nextDue time.Time // Earliest due time of all pixels that aren't due yet
+		for _, p := range q.Pixels {
+			if p.Due.After(now) {
+				if nextDue.IsZero() || p.Due.Before(nextDue) {
+					nextDue = p.Due
+				}
+				continue
+			}
+			if next == nil || p.Priority > next.Priority || p.Priority == next.Priority && p.Due.Before(next.Due) {
+				p := p
+				next = &p
+			}
+		}
+		if next != nil {
+			delete(q.Pixels, next.Pos)
+			q.Unlock()
+			return *next, true
+		}
+		changed := q.Changed
+		q.Unlock()
+
+		var wait <-chan time.Time
+		if !nextDue.IsZero() {
+			wait = time.After(nextDue.Sub(now))
+		}
+
+		select {
+		case <-wait:
+		case <-changed:
+		case <-quit:
+			return queuedPixel{}, false
+		}
+	}
+}
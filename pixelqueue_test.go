@@ -0,0 +1,60 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func Test_pixelQueue(t *testing.T) {
+	q := newPixelQueue()
+	now := time.Now()
+
+	q.push(queuedPixel{Pos: image.Point{0, 0}, Color: color.White, Priority: pixelPriorityNormal, Due: now.Add(-2 * time.Second)})
+	q.push(queuedPixel{Pos: image.Point{1, 0}, Color: color.White, Priority: pixelPriorityDefense, Due: now.Add(-time.Second)})
+	q.push(queuedPixel{Pos: image.Point{2, 0}, Color: color.White, Priority: pixelPriorityDefense, Due: now.Add(-2 * time.Second)})
+	q.push(queuedPixel{Pos: image.Point{3, 0}, Color: color.White, Priority: pixelPriorityDefense, Due: now.Add(100 * time.Millisecond)})
+	q.push(queuedPixel{Pos: image.Point{4, 0}, Color: color.White, Priority: pixelPriorityNormal, Due: now})
+	q.remove(image.Point{4, 0})
+
+	// Replacing a pixel keeps only the newer entry
+	q.push(queuedPixel{Pos: image.Point{0, 0}, Color: color.Black, Priority: pixelPriorityNormal, Due: now.Add(-2 * time.Second)})
+	if q.len() != 4 {
+		t.Errorf("Queue contains %v pixels, want %v", q.len(), 4)
+	}
+
+	// Due pixels by priority, then the one that isn't due yet
+	want := []image.Point{{2, 0}, {1, 0}, {0, 0}, {3, 0}}
+	for _, pos := range want {
+		p, ok := q.pop(nil)
+		if !ok || p.Pos != pos {
+			t.Fatalf("pop() = %v, %v, want %v", p.Pos, ok, pos)
+		}
+	}
+	if time.Since(now) < 100*time.Millisecond {
+		t.Errorf("Pixel was returned before it was due")
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+	if _, ok := q.pop(quit); ok {
+		t.Errorf("pop() of an empty queue returned a pixel")
+	}
+}
@@ -0,0 +1,194 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Returns a plain HTTP proxy that forwards requests, and counts them
+func newTestProxy(counter *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(counter, 1)
+		req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+}
+
+// Returns a HTTPS proxy that only supports CONNECT, and counts the tunnels
+func newTestTLSProxy(counter *int32) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(counter, 1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}))
+}
+
+func Test_newProxyManager(t *testing.T) {
+	invalid := [][]botProxy{
+		{{Name: "", URL: "http://localhost:8080"}},
+		{{Name: "a", URL: "ftp://localhost"}},
+		{{Name: "a", URL: "http://localhost:8080"}, {Name: "a", URL: "socks5://localhost:1080"}},
+	}
+	for _, list := range invalid {
+		if pm, err := newProxyManager(list, "", 0); err == nil {
+			pm.Close()
+			t.Errorf("Invalid proxy list %v was accepted", list)
+		}
+	}
+
+	// A nil manager only allows direct connections
+	var pm *proxyManager
+	if !pm.isHealthy("") || pm.isHealthy("a") {
+		t.Errorf("Nil manager reports wrong health")
+	}
+	if _, err := pm.httpClient("", time.Second); err != nil {
+		t.Errorf("Nil manager can't create direct client: %v", err)
+	}
+	if _, err := pm.websocketDialer("a"); err == nil {
+		t.Errorf("Nil manager returned dialer for unknown proxy")
+	}
+}
+
+func Test_proxyManager(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"ok"`))
+	}))
+	defer target.Close()
+
+	var counter int32
+	proxy := newTestProxy(&counter)
+	defer proxy.Close()
+
+	dead := httptest.NewServer(nil)
+	dead.Close()
+
+	pm, err := newProxyManager([]botProxy{
+		{Name: "working", URL: proxy.URL},
+		{Name: "dead", URL: dead.URL},
+	}, target.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("Can't create proxy manager: %v", err)
+	}
+	defer pm.Close()
+
+	// The first health check happens immediately
+	waitFor(t, "health check", func() bool { return !pm.isHealthy("dead") })
+	if !pm.isHealthy("working") {
+		t.Errorf("Working proxy is unhealthy")
+	}
+
+	client, err := pm.httpClient("working", time.Second)
+	if err != nil {
+		t.Fatalf("Can't create client: %v", err)
+	}
+	before := atomic.LoadInt32(&counter)
+	var response string
+	if err := getJSON(client, target.URL, &response); err != nil || response != "ok" {
+		t.Errorf("getJSON() = %q, %v, want %q", response, err, "ok")
+	}
+	if atomic.LoadInt32(&counter) != before+1 {
+		t.Errorf("Request didn't go through the proxy")
+	}
+
+	dialer, err := pm.websocketDialer("working")
+	if err != nil || dialer.Proxy == nil {
+		t.Errorf("Dialer doesn't use the proxy: %v", err)
+	}
+	if _, err := pm.httpClient("unknown", time.Second); err == nil {
+		t.Errorf("Client for unknown proxy was created")
+	}
+}
+
+func Test_proxyManagerWebsocketHTTPS(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("ok"))
+		conn.Close()
+	}))
+	defer target.Close()
+
+	var counter int32
+	proxy := newTestTLSProxy(&counter)
+	defer proxy.Close()
+
+	pm, err := newProxyManager([]botProxy{{Name: "secure", URL: proxy.URL}}, "", 0)
+	if err != nil {
+		t.Fatalf("Can't create proxy manager: %v", err)
+	}
+	defer pm.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(proxy.Certificate())
+	pm.Proxies["secure"].Transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	dialer, err := pm.websocketDialer("secure")
+	if err != nil {
+		t.Fatalf("Can't create dialer: %v", err)
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(target.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Can't connect through the HTTPS proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "ok" {
+		t.Errorf("ReadMessage() = %q, %v, want %q", msg, err, "ok")
+	}
+	if atomic.LoadInt32(&counter) != 1 {
+		t.Errorf("Connection didn't go through the proxy")
+	}
+}
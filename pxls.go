@@ -0,0 +1,412 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const pxlsDefaultAddress = "https://pxls.space"
+
+var pxlsChunkSize = pixelSize{256, 256} // The board is downloaded as a whole, this only affects how the canvas manages it
+
+// Connection to a pxls.space like game.
+// The whole board is downloaded at once, pixel changes are received via websocket.
+type connectionPxls struct {
+	URL           string // Base URL of the game, without trailing slash
+	Info          pxlsInfo
+	OnlinePlayers uint32 // Must be read atomically
+
+	Client *http.Client      // Uses the proxy of the connection, if there is one
+	Dialer *websocket.Dialer // Uses the proxy of the connection, if there is one
+
+	Canvas *canvas
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+
+	MetricsCollectorID int
+}
+
+// Response of the info endpoint
+type pxlsInfo struct {
+	CanvasCode string          `json:"canvasCode"`
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Palette    []pxlsInfoColor `json:"palette"`
+}
+
+// Palette entry of the info endpoint.
+// Older servers send plain hex strings, newer ones objects with name and value.
+type pxlsInfoColor struct {
+	Name  string
+	Color color.RGBA
+}
+
+func (c *pxlsInfoColor) UnmarshalJSON(data []byte) error {
+	var hex string
+	if err := json.Unmarshal(data, &hex); err != nil {
+		var obj struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return fmt.Errorf("Palette entry is neither a string nor an object: %v", err)
+		}
+		c.Name, hex = obj.Name, obj.Value
+	}
+
+	col, err := parseHexColor(hex)
+	if err != nil {
+		return err
+	}
+	c.Color = col
+
+	return nil
+}
+
+// Websocket message, only the fields of the handled types are decoded
+type pxlsMessage struct {
+	Type   string `json:"type"`
+	Pixels []struct {
+		X     int `json:"x"`
+		Y     int `json:"y"`
+		Color int `json:"color"`
+	} `json:"pixels"`
+	Count int `json:"count"`
+}
+
+func init() {
+	// Register connection types (all init functions are called from a single thread, thus threadsafe)
+	connectionTypes["pxls"] = connectionType{
+		Name: "pxls.space",
+		FunctionNew: func() (connection, *canvas, error) {
+			address, proxy := pxlsDefaultAddress, ""
+			if conf != nil {
+				conf.Get(".pxls.address", &address)
+				conf.Get(".pxls.proxy", &proxy)
+			}
+			return newPxls(address, proxy)
+		},
+	}
+}
+
+var pxlsSingletons = map[string]*refCountingSingleton{} // One singleton per URL
+var pxlsSingletonsMutex sync.Mutex
+
+// Returns the palette of the board.
+// The index 0xFF marks pixels outside of the usable area, it's mapped to a transparent color after the palette.
+func (info pxlsInfo) palette() color.Palette {
+	palette := color.Palette{}
+	for _, col := range info.Palette {
+		palette = append(palette, col.Color)
+	}
+
+	return append(palette, color.Transparent)
+}
+
+// Opens a connection to the pxls game at the given base URL, e.g. "https://pxls.space".
+// All requests go through the proxy with the given name, or directly if it's empty.
+func newPxls(u, proxy string) (connection, *canvas, error) {
+	u = strings.TrimRight(u, "/")
+
+	pxlsSingletonsMutex.Lock()
+	singleton, ok := pxlsSingletons[u]
+	if !ok {
+		singleton = &refCountingSingleton{}
+		pxlsSingletons[u] = singleton
+	}
+	pxlsSingletonsMutex.Unlock()
+
+	var initErr error
+
+	// Init function. It isn't called if there is already an instance for this URL
+	init := func() interface{} {
+		con := &connectionPxls{
+			URL:           u,
+			GoroutineQuit: make(chan struct{}),
+		}
+
+		var err error
+		if con.Client, err = proxies.httpClient(proxy, 10*time.Second); err != nil {
+			initErr = fmt.Errorf("Can't use proxy: %v", err)
+			return nil
+		}
+		con.Dialer, _ = proxies.websocketDialer(proxy)
+
+		if err := getJSON(con.Client, u+"/info", &con.Info); err != nil {
+			initErr = fmt.Errorf("Can't get board info from %v: %v", u, err)
+			return nil
+		}
+		if con.Info.Width <= 0 || con.Info.Height <= 0 {
+			initErr = fmt.Errorf("Invalid board size %vx%v from %v", con.Info.Width, con.Info.Height, u)
+			return nil
+		}
+		colorModel, err := newCanvasColorModelIndexed(con.Info.palette())
+		if err != nil {
+			initErr = fmt.Errorf("Invalid palette from %v: %v", u, err)
+			return nil
+		}
+
+		options := canvasOptionsFromConfig()
+		options.ColorModel = colorModel
+		con.Canvas, con.ChunkDownloadChan = newCanvas(pxlsChunkSize, image.Point{}, image.Rect(0, 0, con.Info.Width, con.Info.Height), options)
+		con.MetricsCollectorID = metricsRegisterConnection("pxls:"+u, con, con.Canvas)
+		metricsLabels := metricLabels("connection", "pxls:"+u)
+
+		// Goroutine that downloads the board when any chunk is requested
+		con.QuitWaitgroup.Add(1)
+		go func() {
+			defer con.QuitWaitgroup.Done()
+
+			for {
+				select {
+				case chu := <-con.ChunkDownloadChan:
+					// Check if the chunk still needs to be downloaded
+					if chu.getQueryState(false, con.Canvas.Options) == chunkDownload {
+						startTime := time.Now()
+						if err := con.downloadBoard(); err != nil {
+							log.Errorf("Can't download board of %v: %v", u, err)
+							metricChunkDownloadFailures.add(metricsLabels, 1)
+							con.Canvas.failDownload(con.Canvas.Rect)
+							continue
+						}
+						metricChunkDownloadDuration.observe(metricsLabels, time.Now().Sub(startTime).Seconds())
+					}
+				case <-con.GoroutineQuit:
+					return
+				}
+			}
+		}()
+
+		// Main goroutine that handles the websocket connection (It will always try to reconnect)
+		con.QuitWaitgroup.Add(1)
+		go func() {
+			defer con.QuitWaitgroup.Done()
+
+			waitTime := 0 * time.Second
+			for {
+				select {
+				case <-con.GoroutineQuit:
+					return
+				case <-time.After(waitTime):
+				}
+
+				// Any following connection attempt should be delayed a few seconds
+				if waitTime > 0 {
+					metricWebsocketReconnects.add(metricsLabels, 1)
+				}
+				waitTime = 5 * time.Second
+
+				wsURL, err := pxlsWebsocketURL(u)
+				if err != nil {
+					log.Errorf("Invalid websocket URL: %v", err)
+					continue
+				}
+
+				c, _, err := con.Dialer.Dial(wsURL, nil)
+				if err != nil {
+					log.Errorf("Failed to connect to websocket server %v: %v", wsURL, err)
+					continue
+				}
+
+				con.handleSession(c)
+
+				// Pixels were missed while disconnected
+				con.Canvas.invalidateAll()
+			}
+		}()
+
+		return con
+	}
+
+	// Create or reuse instance of connectionPxls
+	obj := singleton.get(init)
+	if obj == nil {
+		return nil, nil, initErr // The singleton will call init again on the next try
+	}
+	con := obj.(*connectionPxls)
+
+	return con, con.Canvas, nil
+}
+
+// Returns the websocket URL of the game at the given base URL
+func pxlsWebsocketURL(u string) (string, error) {
+	parsed, err := url.Parse(u + "/ws")
+	if err != nil {
+		return "", err
+	}
+	switch parsed.Scheme {
+	case "https":
+		parsed.Scheme = "wss"
+	case "http":
+		parsed.Scheme = "ws"
+	}
+
+	return parsed.String(), nil
+}
+
+// Downloads the whole board, and sets it as the image of the canvas
+func (con *connectionPxls) downloadBoard() error {
+	if _, err := con.Canvas.signalDownload(con.Canvas.Rect); err != nil {
+		return fmt.Errorf("Can't signal download: %v", err)
+	}
+
+	r, err := con.Client.Get(con.URL + "/boarddata")
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Board data request failed: %v", r.Status)
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("Can't read board data: %v", err)
+	}
+
+	img, err := pxlsDecodeBoard(raw, con.Canvas.Rect, con.Canvas.Options.ColorModel.Palette)
+	if err != nil {
+		return err
+	}
+
+	return con.Canvas.setImage(img, false, true)
+}
+
+// Decodes the board data, which contains one palette index per pixel in row major order.
+// Indices outside of the game palette are mapped to the last palette entry, which is transparent.
+func pxlsDecodeBoard(raw []byte, rect image.Rectangle, palette color.Palette) (*image.Paletted, error) {
+	if len(raw) != rect.Dx()*rect.Dy() {
+		return nil, fmt.Errorf("Board data has the wrong length (%v, expected %v)", len(raw), rect.Dx()*rect.Dy())
+	}
+
+	img := image.NewPaletted(rect, palette)
+	transparent := uint8(len(palette) - 1)
+	for i, index := range raw {
+		if index >= transparent {
+			index = transparent
+		}
+		img.Pix[i] = index
+	}
+
+	return img, nil
+}
+
+// Handles a single websocket connection until it is closed.
+func (con *connectionPxls) handleSession(c *websocket.Conn) {
+	log.Debugf("Connected to %v", con.URL)
+	defer log.Debugf("Disconnected from %v", con.URL)
+
+	// Wait for and handle external close events, or connection errors
+	quitChannel := make(chan struct{})
+	defer close(quitChannel)
+	go func() {
+		select {
+		case <-con.GoroutineQuit:
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		case <-quitChannel:
+		}
+		c.Close()
+	}()
+
+	palette := con.Canvas.Options.ColorModel.Palette
+
+	// Handle events
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			log.Warnf("Websocket connection error: %v", err)
+			return
+		}
+
+		var msg pxlsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warnf("Invalid message from %v: %v", con.URL, err)
+			continue
+		}
+
+		switch msg.Type {
+		case "pixel":
+			for _, pixel := range msg.Pixels {
+				if pixel.Color < 0 || pixel.Color >= len(palette)-1 {
+					continue // Pixels that got removed or have an unknown color
+				}
+				pos := image.Point{pixel.X, pixel.Y}
+				if err := con.Canvas.setPixel(pos, palette[pixel.Color]); err != nil {
+					log.Debugf("Couldn't draw pixel at %v with color %v: %v", pos, pixel.Color, err)
+				}
+			}
+		case "users":
+			atomic.StoreUint32(&con.OnlinePlayers, uint32(msg.Count))
+		}
+	}
+}
+
+func (con *connectionPxls) getShortName() string {
+	u, err := url.Parse(con.URL)
+	if err != nil || u.Host == "pxls.space" {
+		return "pxls"
+	}
+	return "pxls-" + strings.Replace(u.Host, ":", "-", -1)
+}
+
+func (con *connectionPxls) getName() string {
+	u, err := url.Parse(con.URL)
+	if err != nil {
+		return con.URL
+	}
+	return u.Host
+}
+
+// The game sends all pixel changes, there is nothing to subscribe to
+func (con *connectionPxls) subscribe(rects []image.Rectangle)   {}
+func (con *connectionPxls) unsubscribe(rects []image.Rectangle) {}
+
+func (con *connectionPxls) getOnlinePlayers() int {
+	return int(atomic.LoadUint32(&con.OnlinePlayers))
+}
+
+// Closes connection and canvas
+func (con *connectionPxls) Close() {
+	pxlsSingletonsMutex.Lock()
+	singleton := pxlsSingletons[con.URL]
+	pxlsSingletonsMutex.Unlock()
+
+	if singleton.release(con) {
+		// Stop goroutines gracefully
+		close(con.GoroutineQuit)
+
+		con.QuitWaitgroup.Wait()
+
+		metricsUnregisterCollector(con.MetricsCollectorID)
+		con.Canvas.Close()
+	}
+}
@@ -0,0 +1,127 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Local stand-in for a pxls server
+type testPxlsServer struct {
+	*httptest.Server
+	Conns chan *websocket.Conn // Receives every opened websocket connection
+}
+
+func newTestPxlsServer(width, height int, board []byte) *testPxlsServer {
+	srv := &testPxlsServer{Conns: make(chan *websocket.Conn, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"canvasCode":"test","width":%d,"height":%d,"palette":[{"name":"White","value":"FFFFFF"},{"name":"Red","value":"FF0000"},"#00FF00"]}`, width, height)
+	})
+	mux.HandleFunc("/boarddata", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(board)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		srv.Conns <- c
+	})
+	srv.Server = httptest.NewServer(mux)
+
+	return srv
+}
+
+func Test_pxlsInfo(t *testing.T) {
+	var info pxlsInfo
+	if err := json.Unmarshal([]byte(`{"width":10,"height":20,"palette":["#010203",{"name":"Blue","value":"0000FF"}]}`), &info); err != nil {
+		t.Fatalf("Can't decode info: %v", err)
+	}
+	palette := info.palette()
+	if len(palette) != 3 || palette[0] != (color.RGBA{1, 2, 3, 255}) || palette[1] != (color.RGBA{0, 0, 255, 255}) || palette[2] != color.Transparent {
+		t.Errorf("palette() = %v", palette)
+	}
+	if info.Palette[1].Name != "Blue" {
+		t.Errorf("Color name is %q, want %q", info.Palette[1].Name, "Blue")
+	}
+
+	if err := json.Unmarshal([]byte(`{"palette":["#12345"]}`), &info); err == nil {
+		t.Errorf("Invalid color was accepted")
+	}
+}
+
+func Test_newPxls(t *testing.T) {
+	width, height := 300, 200
+	board := make([]byte, width*height)
+	board[2*width+1] = 1    // Red at 1, 2
+	board[3*width+4] = 0xFF // Outside of the usable area
+
+	srv := newTestPxlsServer(width, height, board)
+	defer srv.Close()
+
+	con, can, err := newPxls(srv.URL, "")
+	if err != nil {
+		t.Fatalf("Can't open connection: %v", err)
+	}
+	defer con.Close()
+
+	if can.Rect != image.Rect(0, 0, width, height) {
+		t.Errorf("Canvas has the rectangle %v, want %v", can.Rect, image.Rect(0, 0, width, height))
+	}
+	if len(can.Options.ColorModel.Palette) != 4 {
+		t.Errorf("Canvas palette has %v colors, want %v", len(can.Options.ColorModel.Palette), 4)
+	}
+
+	// Request the whole board
+	l := &testRectListener{Chunks: map[image.Rectangle]int{}}
+	can.subscribeListener(l, true)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{can.Rect})
+	waitFor(t, "board download", func() bool { return can.isValid(can.Rect) })
+
+	if col, err := can.getPixel(image.Point{1, 2}); err != nil || col != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("getPixel() = %v, %v, want red", col, err)
+	}
+	if col, err := can.getPixel(image.Point{4, 3}); err != nil || col != color.Transparent {
+		t.Errorf("getPixel() = %v, %v, want transparent", col, err)
+	}
+
+	// Pixel and user count messages from the websocket
+	ws := <-srv.Conns
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"pixel","pixels":[{"x":10,"y":20,"color":2},{"x":11,"y":20,"color":99}]}`))
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"users","count":42}`))
+
+	waitFor(t, "pixel message", func() bool {
+		col, _ := can.getPixel(image.Point{10, 20})
+		return col == color.RGBA{0, 255, 0, 255}
+	})
+	waitFor(t, "user count", func() bool { return con.getOnlinePlayers() == 42 })
+	if col, err := can.getPixel(image.Point{11, 20}); err != nil || col != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Pixel with unknown color was drawn: %v, %v", col, err)
+	}
+}
@@ -0,0 +1,670 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	remoteAPIMaxImagePixels   = 4096 * 4096 // Maximum size of images that can be requested or uploaded via the API
+	remoteAPIMaxTemplateBytes = 32 << 20    // Maximum size of uploaded template files
+)
+
+// A connection that was opened via the API
+type remoteAPIConnection struct {
+	ID         int
+	Connection connection
+	Canvas     *canvas
+	Recorders  map[int]*remoteAPIRecorder
+	Closed     bool // No recorders can be added once this is set
+}
+
+// A recorder that was started via the API
+type remoteAPIRecorder struct {
+	ID         int
+	Rects      []image.Rectangle
+	DiskWriter *canvasDiskWriter
+}
+
+type remoteAPIConnectionInfo struct {
+	ID            int
+	ShortName     string
+	Name          string
+	OnlinePlayers int
+	Recorders     []remoteAPIRecorderInfo
+}
+
+type remoteAPIRecorderInfo struct {
+	ID    int
+	Rects []image.Rectangle
+}
+
+func (apiCon *remoteAPIConnection) info() remoteAPIConnectionInfo {
+	info := remoteAPIConnectionInfo{
+		ID:            apiCon.ID,
+		ShortName:     apiCon.Connection.getShortName(),
+		Name:          apiCon.Connection.getName(),
+		OnlinePlayers: apiCon.Connection.getOnlinePlayers(),
+		Recorders:     []remoteAPIRecorderInfo{},
+	}
+	for _, rec := range apiCon.Recorders {
+		info.Recorders = append(info.Recorders, rec.info())
+	}
+	sort.Slice(info.Recorders, func(i, j int) bool { return info.Recorders[i].ID < info.Recorders[j].ID })
+
+	return info
+}
+
+func (rec *remoteAPIRecorder) info() remoteAPIRecorderInfo {
+	return remoteAPIRecorderInfo{
+		ID:    rec.ID,
+		Rects: rec.Rects,
+	}
+}
+
+func remoteWriteJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func remoteWriteError(w http.ResponseWriter, statusCode int, format string, a ...interface{}) {
+	remoteWriteJSON(w, statusCode, struct {
+		Error string
+	}{
+		Error: fmt.Sprintf(format, a...),
+	})
+}
+
+// Parses an integer from the query of the request
+func remoteQueryInt(r *http.Request, key string) (int, error) {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid or missing parameter %v", key)
+	}
+	return value, nil
+}
+
+// Parses a rectangle given by the query parameters minX, minY, maxX and maxY
+func remoteQueryRect(r *http.Request) (image.Rectangle, error) {
+	var values [4]int
+	for i, key := range []string{"minX", "minY", "maxX", "maxY"} {
+		value, err := remoteQueryInt(r, key)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		values[i] = value
+	}
+
+	return image.Rect(values[0], values[1], values[2], values[3]), nil
+}
+
+// Handles all requests to /api/
+func (srv *remoteServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+
+	switch {
+	case len(segments) == 1 && segments[0] == "connectionTypes":
+		srv.handleAPIConnectionTypes(w, r)
+	case len(segments) == 1 && segments[0] == "connections":
+		srv.handleAPIConnections(w, r)
+	case len(segments) >= 2 && segments[0] == "connections":
+		id, err := strconv.Atoi(segments[1])
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Invalid connection ID %q", segments[1])
+			return
+		}
+		srv.Lock()
+		apiCon, ok := srv.APIConnections[id]
+		srv.Unlock()
+		if !ok {
+			remoteWriteError(w, http.StatusNotFound, "Connection %v not found", id)
+			return
+		}
+		srv.handleAPIConnection(w, r, apiCon, segments[2:])
+	case len(segments) == 1 && segments[0] == "templates":
+		srv.handleAPITemplates(w, r)
+	case len(segments) >= 2 && segments[0] == "templates":
+		srv.handleAPITemplate(w, r, segments[1], segments[2:])
+	case len(segments) == 2 && segments[0] == "defense" && segments[1] == "incidents":
+		srv.handleAPIDefenseIncidents(w, r)
+	case len(segments) == 3 && segments[0] == "accounts" && segments[2] == "enable":
+		srv.handleAPIAccountEnable(w, r, segments[1])
+	case len(segments) == 1 && segments[0] == "captchas":
+		srv.handleAPICaptchas(w, r)
+	case len(segments) == 2 && segments[0] == "captchas":
+		id, err := strconv.Atoi(segments[1])
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Invalid captcha ID %q", segments[1])
+			return
+		}
+		srv.handleAPICaptcha(w, r, id)
+	default:
+		remoteWriteError(w, http.StatusNotFound, "Unknown API endpoint %v", r.URL.Path)
+	}
+}
+
+// GET /api/connectionTypes: Lists all available connection types
+func (srv *remoteServer) handleAPIConnectionTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	type connectionTypeInfo struct {
+		ShortName string
+		Name      string
+	}
+	result := []connectionTypeInfo{}
+	for shortName, conType := range connectionTypes {
+		result = append(result, connectionTypeInfo{shortName, conType.Name})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ShortName < result[j].ShortName })
+
+	remoteWriteJSON(w, http.StatusOK, result)
+}
+
+// GET /api/connections: Lists all connections opened via the API
+//
+// POST /api/connections: Opens a new connection. Body: {"Type": "pixelcanvasio"}
+func (srv *remoteServer) handleAPIConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		srv.Lock()
+		result := []remoteAPIConnectionInfo{}
+		for _, apiCon := range srv.APIConnections {
+			result = append(result, apiCon.info())
+		}
+		srv.Unlock()
+		sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+		remoteWriteJSON(w, http.StatusOK, result)
+
+	case http.MethodPost:
+		var request struct {
+			Type string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't parse request: %v", err)
+			return
+		}
+
+		conType, ok := connectionTypes[request.Type]
+		if !ok {
+			remoteWriteError(w, http.StatusNotFound, "Connection type %v not found", request.Type)
+			return
+		}
+
+		con, can, err := conType.FunctionNew()
+		if err != nil {
+			remoteWriteError(w, http.StatusInternalServerError, "Can't open connection %v: %v", request.Type, err)
+			return
+		}
+
+		srv.Lock()
+		srv.APIIDCounter++
+		apiCon := &remoteAPIConnection{
+			ID:         srv.APIIDCounter,
+			Connection: con,
+			Canvas:     can,
+			Recorders:  map[int]*remoteAPIRecorder{},
+		}
+		srv.APIConnections[apiCon.ID] = apiCon
+		info := apiCon.info()
+		srv.Unlock()
+
+		remoteWriteJSON(w, http.StatusCreated, info)
+
+	default:
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+	}
+}
+
+// Handles everything below /api/connections/{id}
+func (srv *remoteServer) handleAPIConnection(w http.ResponseWriter, r *http.Request, apiCon *remoteAPIConnection, segments []string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		srv.Lock()
+		info := apiCon.info()
+		srv.Unlock()
+		remoteWriteJSON(w, http.StatusOK, info)
+
+	case len(segments) == 0 && r.Method == http.MethodDelete:
+		srv.Lock()
+		_, ok := srv.APIConnections[apiCon.ID]
+		delete(srv.APIConnections, apiCon.ID)
+		var recorders []*remoteAPIRecorder
+		if ok {
+			recorders = apiCon.markClosed()
+		}
+		srv.Unlock()
+		if !ok {
+			remoteWriteError(w, http.StatusNotFound, "Connection %v not found", apiCon.ID)
+			return
+		}
+		apiCon.close(recorders)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(segments) == 1 && segments[0] == "onlinePlayers" && r.Method == http.MethodGet:
+		remoteWriteJSON(w, http.StatusOK, struct {
+			OnlinePlayers int
+		}{
+			OnlinePlayers: apiCon.Connection.getOnlinePlayers(),
+		})
+
+	case len(segments) == 1 && segments[0] == "image" && r.Method == http.MethodGet:
+		rect, err := remoteQueryRect(r)
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		rect = rect.Canon()
+		if rect.Empty() || int64(rect.Dx())*int64(rect.Dy()) > remoteAPIMaxImagePixels {
+			remoteWriteError(w, http.StatusBadRequest, "Rectangle %v is empty or too large", rect)
+			return
+		}
+		onlyValid := r.URL.Query().Get("onlyValid") == "true"
+		img, err := apiCon.Canvas.getImageCopy(rect, onlyValid, !onlyValid)
+		if err != nil {
+			remoteWriteError(w, http.StatusConflict, "Can't get image at %v: %v", rect, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+
+	case len(segments) == 1 && segments[0] == "recorders":
+		srv.handleAPIRecorders(w, r, apiCon)
+
+	case len(segments) == 2 && segments[0] == "recorders":
+		id, err := strconv.Atoi(segments[1])
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Invalid recorder ID %q", segments[1])
+			return
+		}
+		srv.handleAPIRecorder(w, r, apiCon, id)
+
+	default:
+		remoteWriteError(w, http.StatusNotFound, "Unknown API endpoint %v %v", r.Method, r.URL.Path)
+	}
+}
+
+// GET /api/connections/{id}/recorders: Lists all recorders of the connection
+//
+// POST /api/connections/{id}/recorders: Starts a new recorder. Body: {"Rects": [{"Min": {"X": 0, "Y": 0}, "Max": {"X": 100, "Y": 100}}]}
+func (srv *remoteServer) handleAPIRecorders(w http.ResponseWriter, r *http.Request, apiCon *remoteAPIConnection) {
+	switch r.Method {
+	case http.MethodGet:
+		srv.Lock()
+		info := apiCon.info()
+		srv.Unlock()
+		remoteWriteJSON(w, http.StatusOK, info.Recorders)
+
+	case http.MethodPost:
+		var request struct {
+			Rects []image.Rectangle
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't parse request: %v", err)
+			return
+		}
+
+		cdw, err := apiCon.Canvas.newCanvasDiskWriter(apiCon.Connection.getShortName())
+		if err != nil {
+			remoteWriteError(w, http.StatusInternalServerError, "Can't create recorder: %v", err)
+			return
+		}
+		if err := cdw.setListeningRects(request.Rects); err != nil {
+			cdw.Close()
+			remoteWriteError(w, http.StatusInternalServerError, "Can't set recorder rectangles: %v", err)
+			return
+		}
+
+		srv.Lock()
+		if apiCon.Closed {
+			srv.Unlock()
+			cdw.Close()
+			remoteWriteError(w, http.StatusNotFound, "Connection %v not found", apiCon.ID)
+			return
+		}
+		srv.APIIDCounter++
+		rec := &remoteAPIRecorder{
+			ID:         srv.APIIDCounter,
+			Rects:      request.Rects,
+			DiskWriter: cdw,
+		}
+		apiCon.Recorders[rec.ID] = rec
+		srv.Unlock()
+
+		remoteWriteJSON(w, http.StatusCreated, rec.info())
+
+	default:
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+	}
+}
+
+// GET /api/connections/{id}/recorders/{id}: Returns information about a recorder
+//
+// PUT /api/connections/{id}/recorders/{id}: Changes the recorded rectangles. Body: {"Rects": [...]}
+//
+// DELETE /api/connections/{id}/recorders/{id}: Stops a recorder
+func (srv *remoteServer) handleAPIRecorder(w http.ResponseWriter, r *http.Request, apiCon *remoteAPIConnection, id int) {
+	srv.Lock()
+	rec, ok := apiCon.Recorders[id]
+	srv.Unlock()
+	if !ok {
+		remoteWriteError(w, http.StatusNotFound, "Recorder %v not found", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.Lock()
+		info := rec.info()
+		srv.Unlock()
+		remoteWriteJSON(w, http.StatusOK, info)
+
+	case http.MethodPut:
+		var request struct {
+			Rects []image.Rectangle
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't parse request: %v", err)
+			return
+		}
+		if err := rec.DiskWriter.setListeningRects(request.Rects); err != nil {
+			remoteWriteError(w, http.StatusInternalServerError, "Can't set recorder rectangles: %v", err)
+			return
+		}
+		srv.Lock()
+		rec.Rects = request.Rects
+		info := rec.info()
+		srv.Unlock()
+		remoteWriteJSON(w, http.StatusOK, info)
+
+	case http.MethodDelete:
+		srv.Lock()
+		_, ok := apiCon.Recorders[id]
+		delete(apiCon.Recorders, id)
+		srv.Unlock()
+		if !ok {
+			remoteWriteError(w, http.StatusNotFound, "Recorder %v not found", id)
+			return
+		}
+		rec.DiskWriter.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+	}
+}
+
+// GET /api/templates: Lists all templates
+func (srv *remoteServer) handleAPITemplates(w http.ResponseWriter, r *http.Request) {
+	if srv.Templates == nil {
+		remoteWriteError(w, http.StatusServiceUnavailable, "No template storage available")
+		return
+	}
+	if r.Method != http.MethodGet {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	templates, err := srv.Templates.getTemplates()
+	if err != nil {
+		remoteWriteError(w, http.StatusInternalServerError, "Can't get templates: %v", err)
+		return
+	}
+
+	remoteWriteJSON(w, http.StatusOK, templates)
+}
+
+// GET /api/templates/{name}: Returns information about a template
+//
+// GET /api/templates/{name}/image: Returns the image of a template as PNG
+//
+// GET /api/templates/{name}/progress: Returns the progress of a template. The first request starts to watch the template, so it may contain unknown pixels
+//
+// GET /api/templates/{name}/progress/image: Returns the template area as PNG, with wrong pixels highlighted
+//
+// PUT /api/templates/{name}?game=pixelcanvasio&x=0&y=0: Creates or replaces a template. The body has to contain the image
+//
+// DELETE /api/templates/{name}: Removes a template
+func (srv *remoteServer) handleAPITemplate(w http.ResponseWriter, r *http.Request, name string, segments []string) {
+	if srv.Templates == nil {
+		remoteWriteError(w, http.StatusServiceUnavailable, "No template storage available")
+		return
+	}
+
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		tmpl, err := srv.Templates.getTemplate(name)
+		if err != nil {
+			remoteWriteError(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		remoteWriteJSON(w, http.StatusOK, tmpl)
+
+	case len(segments) == 1 && segments[0] == "image" && r.Method == http.MethodGet:
+		tmpl, err := srv.Templates.getTemplate(name)
+		if err != nil {
+			remoteWriteError(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		img, err := srv.Templates.getImage(tmpl)
+		if err != nil {
+			remoteWriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+
+	case len(segments) >= 1 && len(segments) <= 2 && segments[0] == "progress" && r.Method == http.MethodGet:
+		if srv.Progress == nil {
+			remoteWriteError(w, http.StatusServiceUnavailable, "Progress tracking isn't available")
+			return
+		}
+		tr, err := srv.Progress.get(name)
+		if err != nil {
+			remoteWriteError(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		if len(segments) == 2 {
+			if segments[1] != "image" {
+				remoteWriteError(w, http.StatusNotFound, "Unknown API endpoint %v %v", r.Method, r.URL.Path)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			png.Encode(w, tr.overlay())
+			return
+		}
+		var accs []botAccount
+		if srv.Accounts != nil {
+			accs = srv.Accounts.getAccounts()
+		}
+		remoteWriteJSON(w, http.StatusOK, tr.progress(accs))
+
+	case len(segments) == 0 && r.Method == http.MethodPut:
+		x, err := remoteQueryInt(r, "x")
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		y, err := remoteQueryInt(r, "y")
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		game := r.URL.Query().Get("game")
+		if _, ok := connectionTypes[game]; !ok {
+			remoteWriteError(w, http.StatusBadRequest, "Connection type %q not found", game)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, remoteAPIMaxTemplateBytes))
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't read image: %v", err)
+			return
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't decode image: %v", err)
+			return
+		}
+		if int64(config.Width)*int64(config.Height) > remoteAPIMaxImagePixels {
+			remoteWriteError(w, http.StatusRequestEntityTooLarge, "Image with %vx%v pixels is too large", config.Width, config.Height)
+			return
+		}
+		img, _, err := image.Decode(bytes.NewReader(body))
+		if err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't decode image: %v", err)
+			return
+		}
+		tmpl := botTemplate{
+			Name:     name,
+			Game:     game,
+			Position: image.Point{x, y},
+		}
+		if err := srv.Templates.setTemplate(tmpl, img); err != nil {
+			remoteWriteError(w, http.StatusBadRequest, "Can't store template: %v", err)
+			return
+		}
+		if srv.Progress != nil {
+			srv.Progress.remove(name) // The next progress request uses the new template
+		}
+		remoteWriteJSON(w, http.StatusOK, tmpl)
+
+	case len(segments) == 0 && r.Method == http.MethodDelete:
+		if err := srv.Templates.removeTemplate(name); err != nil {
+			remoteWriteError(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		if srv.Progress != nil {
+			srv.Progress.remove(name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		remoteWriteError(w, http.StatusNotFound, "Unknown API endpoint %v %v", r.Method, r.URL.Path)
+	}
+}
+
+// GET /api/defense/incidents: Lists the griefing incidents of all protected templates, the newest ones last
+func (srv *remoteServer) handleAPIDefenseIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	incidents := []defenseIncident{}
+	for _, d := range srv.Defenders {
+		incidents = append(incidents, d.getIncidents()...)
+	}
+	sort.SliceStable(incidents, func(i, j int) bool { return incidents[i].Time.Before(incidents[j].Time) })
+
+	remoteWriteJSON(w, http.StatusOK, incidents)
+}
+
+// POST /api/accounts/{name}/enable: Enables a disabled account again
+func (srv *remoteServer) handleAPIAccountEnable(w http.ResponseWriter, r *http.Request, name string) {
+	if srv.Accounts == nil {
+		remoteWriteError(w, http.StatusServiceUnavailable, "Accounts aren't available")
+		return
+	}
+	if r.Method != http.MethodPost {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	if err := srv.Accounts.enableAccount(name); err != nil {
+		remoteWriteError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/captchas: Lists all captchas that wait for the user
+func (srv *remoteServer) handleAPICaptchas(w http.ResponseWriter, r *http.Request) {
+	if srv.Accounts == nil || srv.Accounts.Captchas == nil {
+		remoteWriteError(w, http.StatusServiceUnavailable, "Captchas aren't forwarded")
+		return
+	}
+	if r.Method != http.MethodGet {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	remoteWriteJSON(w, http.StatusOK, srv.Accounts.Captchas.getPending())
+}
+
+// POST /api/captchas/{id}: Solves a captcha. The body has to contain {"Token": "..."}
+func (srv *remoteServer) handleAPICaptcha(w http.ResponseWriter, r *http.Request, id int) {
+	if srv.Accounts == nil || srv.Accounts.Captchas == nil {
+		remoteWriteError(w, http.StatusServiceUnavailable, "Captchas aren't forwarded")
+		return
+	}
+	if r.Method != http.MethodPost {
+		remoteWriteError(w, http.StatusMethodNotAllowed, "Method %v not allowed", r.Method)
+		return
+	}
+
+	var body struct {
+		Token string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		remoteWriteError(w, http.StatusBadRequest, "Invalid body: %v", err)
+		return
+	}
+	if err := srv.Accounts.solveCaptcha(id, body.Token); err != nil {
+		remoteWriteError(w, http.StatusBadRequest, "Can't solve captcha: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Marks the connection as closed, so that no recorder can be added anymore, and returns its recorders.
+// srv has to be locked
+func (apiCon *remoteAPIConnection) markClosed() []*remoteAPIRecorder {
+	apiCon.Closed = true
+	recorders := []*remoteAPIRecorder{}
+	for _, rec := range apiCon.Recorders {
+		recorders = append(recorders, rec)
+	}
+	apiCon.Recorders = map[int]*remoteAPIRecorder{}
+
+	return recorders
+}
+
+// Stops the given recorders and closes the connection.
+// Don't hold srv's lock, as flushing recorders and closing the connection may take a while
+func (apiCon *remoteAPIConnection) close(recorders []*remoteAPIRecorder) {
+	for _, rec := range recorders {
+		rec.DiskWriter.Close()
+	}
+
+	apiCon.Connection.Close()
+}
@@ -0,0 +1,189 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Dadido3/configdb"
+)
+
+func Test_remoteAPI(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	connectionTypes["test"] = connectionType{
+		Name:        "Test",
+		FunctionNew: func() (connection, *canvas, error) { return &testConnection{can}, can, nil },
+	}
+	defer delete(connectionTypes, "test")
+
+	dir, err := ioutil.TempDir("", "d3pixelbot")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := configdb.New([]configdb.Storage{configdb.UseDummyStorage("", map[string]interface{}{})})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+
+	srv := newRemoteServer()
+	srv.Templates = newTemplateStore(c, dir)
+	srv.setTokens([]remoteToken{{Name: "Test", Token: "secret", Permissions: []remotePermission{remotePermissionAdmin}}})
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	defer srv.Close()
+
+	// Sends a request and decodes the JSON result into v, if v is not nil
+	request := func(method, path, contentType string, body []byte, wantStatus int, v interface{}) []byte {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Can't create request: %v", err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Can't read response of %v %v: %v", method, path, err)
+		}
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%v %v returned %v, want %v: %s", method, path, resp.StatusCode, wantStatus, data)
+		}
+		if v != nil {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatalf("Can't decode response of %v %v: %v", method, path, err)
+			}
+		}
+		return data
+	}
+
+	var types []struct{ ShortName, Name string }
+	request("GET", "/api/connectionTypes", "", nil, http.StatusOK, &types)
+	found := false
+	for _, conType := range types {
+		found = found || conType.ShortName == "test"
+	}
+	if !found {
+		t.Errorf("Connection type test not listed in %v", types)
+	}
+
+	var con remoteAPIConnectionInfo
+	request("POST", "/api/connections", "application/json", []byte(`{"Type": "test"}`), http.StatusCreated, &con)
+	if con.ShortName != "test" || con.OnlinePlayers != 42 {
+		t.Errorf("Got wrong connection info %v", con)
+	}
+	request("POST", "/api/connections", "application/json", []byte(`{"Type": "nonexistent"}`), http.StatusNotFound, nil)
+
+	var cons []remoteAPIConnectionInfo
+	request("GET", "/api/connections", "", nil, http.StatusOK, &cons)
+	if len(cons) != 1 || cons[0].ID != con.ID {
+		t.Errorf("Got wrong connection list %v", cons)
+	}
+
+	var players struct{ OnlinePlayers int }
+	request("GET", "/api/connections/"+strconv.Itoa(con.ID)+"/onlinePlayers", "", nil, http.StatusOK, &players)
+	if players.OnlinePlayers != 42 {
+		t.Errorf("Got %v online players, want 42", players.OnlinePlayers)
+	}
+
+	// Fill a chunk of the canvas, and get a snapshot that overlaps it partially
+	img := image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)
+	img.SetColorIndex(5, 6, 7)
+	can.signalDownload(img.Rect)
+	if err := can.setImage(img, true, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	data := request("GET", "/api/connections/"+strconv.Itoa(con.ID)+"/image?minX=-10&minY=-10&maxX=10&maxY=10", "", nil, http.StatusOK, nil)
+	snapshot, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Can't decode snapshot: %v", err)
+	}
+	if snapshot.Bounds().Size() != (image.Point{20, 20}) {
+		t.Errorf("Snapshot has size %v, want 20x20", snapshot.Bounds().Size())
+	}
+	if !sameColor(snapshot.At(15, 16), pixelcanvasioPalette[7]) { // PNG images always start at 0, 0
+		t.Errorf("Snapshot pixel has color %v, want %v", snapshot.At(15, 16), pixelcanvasioPalette[7])
+	}
+	request("GET", "/api/connections/"+strconv.Itoa(con.ID)+"/image?minX=-10&minY=-10&maxX=10&maxY=10&onlyValid=true", "", nil, http.StatusConflict, nil)
+	request("GET", "/api/connections/"+strconv.Itoa(con.ID)+"/image?minX=0&minY=0&maxX=100000&maxY=100000", "", nil, http.StatusBadRequest, nil)
+
+	request("DELETE", "/api/connections/"+strconv.Itoa(con.ID), "", nil, http.StatusNoContent, nil)
+	request("GET", "/api/connections/"+strconv.Itoa(con.ID), "", nil, http.StatusNotFound, nil)
+
+	// Templates
+	tmplImg := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	tmplImg.Set(1, 1, pixelcanvasioPalette[3])
+	buf := &bytes.Buffer{}
+	png.Encode(buf, tmplImg)
+
+	request("PUT", "/api/templates/test-template?game=test&x=100&y=-50", "image/png", buf.Bytes(), http.StatusOK, nil)
+	request("PUT", "/api/templates/invalid%20name?game=test&x=0&y=0", "image/png", buf.Bytes(), http.StatusBadRequest, nil)
+	request("PUT", "/api/templates/no-game?game=nonexistent&x=0&y=0", "image/png", buf.Bytes(), http.StatusBadRequest, nil)
+	largeBuf := &bytes.Buffer{}
+	png.Encode(largeBuf, image.NewGray(image.Rect(0, 0, 4097, 4096)))
+	request("PUT", "/api/templates/too-large?game=test&x=0&y=0", "image/png", largeBuf.Bytes(), http.StatusRequestEntityTooLarge, nil)
+
+	var templates []botTemplate
+	request("GET", "/api/templates", "", nil, http.StatusOK, &templates)
+	want := botTemplate{Name: "test-template", Game: "test", Position: image.Point{100, -50}}
+	if len(templates) != 1 || templates[0] != want {
+		t.Errorf("Got templates %v, want [%v]", templates, want)
+	}
+
+	data = request("GET", "/api/templates/test-template/image", "", nil, http.StatusOK, nil)
+	tmplResult, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Can't decode template image: %v", err)
+	}
+	if !sameColor(tmplResult.At(1, 1), pixelcanvasioPalette[3]) {
+		t.Errorf("Template image differs from the original")
+	}
+
+	request("DELETE", "/api/templates/test-template", "", nil, http.StatusNoContent, nil)
+	request("GET", "/api/templates/test-template", "", nil, http.StatusNotFound, nil)
+
+	if !strings.HasPrefix(string(request("GET", "/api/nonexistent", "", nil, http.StatusNotFound, nil)), "{") {
+		t.Errorf("Errors aren't returned as JSON")
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
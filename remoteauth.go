@@ -0,0 +1,126 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Permission that a token can grant
+type remotePermission string
+
+const (
+	remotePermissionView   remotePermission = "view"   // View canvases, open connections and list things
+	remotePermissionRecord remotePermission = "record" // Start, change and stop recorders, close connections
+	remotePermissionDraw   remotePermission = "draw"   // Manage templates, track their progress and place pixels
+	remotePermissionAdmin  remotePermission = "admin"  // Everything
+)
+
+// A token that grants access to the remote server, as it is stored in the configuration
+type remoteToken struct {
+	Name        string // Only used for logging
+	Token       string
+	Permissions []remotePermission
+}
+
+// Returns whether the token grants the given permission
+func (tok remoteToken) hasPermission(perm remotePermission) bool {
+	for _, p := range tok.Permissions {
+		if p == perm || p == remotePermissionAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the token that is sent with the request.
+// It can either be sent as "Authorization: Bearer <token>" header, or as "token" query parameter.
+// The latter is needed for websocket clients that can't set headers, like browsers.
+func remoteRequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Returns the permission that is needed for a request.
+// Anything unknown needs admin permissions.
+func remoteRequiredPermission(r *http.Request) remotePermission {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch segments[0] {
+	case "stream", "metrics":
+		return remotePermissionView
+	case "api":
+		if len(segments) < 2 {
+			return remotePermissionAdmin
+		}
+		if r.Method == http.MethodGet {
+			if segments[1] == "templates" && len(segments) >= 4 && segments[3] == "progress" {
+				return remotePermissionDraw // Tracking the progress opens a connection to the game
+			}
+			return remotePermissionView
+		}
+		switch {
+		case segments[1] == "connections" && len(segments) == 3 && r.Method == http.MethodDelete:
+			return remotePermissionRecord // Closing a connection stops all of its recorders
+		case segments[1] == "connections" && len(segments) <= 3:
+			return remotePermissionView // Opening connections is needed to view canvases
+		case segments[1] == "connections" && segments[3] == "recorders":
+			return remotePermissionRecord
+		case segments[1] == "templates":
+			return remotePermissionDraw
+		}
+	}
+
+	return remotePermissionAdmin
+}
+
+// Checks the token of every request, before it's passed to the mux.
+// Without any configured token, all requests are rejected.
+func (srv *remoteServer) handleAuthorized(w http.ResponseWriter, r *http.Request) {
+	requestToken := remoteRequestToken(r)
+	if requestToken == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "No token given", http.StatusUnauthorized)
+		return
+	}
+
+	srv.Lock()
+	tokens := srv.Tokens
+	srv.Unlock()
+
+	perm := remoteRequiredPermission(r)
+	for _, tok := range tokens {
+		if tok.Token == "" || subtle.ConstantTimeCompare([]byte(tok.Token), []byte(requestToken)) != 1 {
+			continue
+		}
+		if !tok.hasPermission(perm) {
+			log.Warnf("Token %q of %v is missing the permission %q for %v %v", tok.Name, r.RemoteAddr, perm, r.Method, r.URL.Path)
+			http.Error(w, "Permission "+string(perm)+" needed", http.StatusForbidden)
+			return
+		}
+		srv.Mux.ServeHTTP(w, r)
+		return
+	}
+
+	log.Warnf("Invalid token from %v for %v %v", r.RemoteAddr, r.Method, r.URL.Path)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Invalid token", http.StatusUnauthorized)
+}
@@ -0,0 +1,110 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_remoteRequiredPermission(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         remotePermission
+	}{
+		{"GET", "/stream/pixelcanvasio", remotePermissionView},
+		{"GET", "/api/connections", remotePermissionView},
+		{"POST", "/api/connections", remotePermissionView},
+		{"DELETE", "/api/connections/1", remotePermissionRecord},
+		{"GET", "/api/connections/1/recorders", remotePermissionView},
+		{"POST", "/api/connections/1/recorders", remotePermissionRecord},
+		{"DELETE", "/api/connections/1/recorders/2", remotePermissionRecord},
+		{"GET", "/api/templates/test/image", remotePermissionView},
+		{"GET", "/api/templates/test/progress", remotePermissionDraw},
+		{"GET", "/api/templates/test/progress/image", remotePermissionDraw},
+		{"PUT", "/api/templates/test", remotePermissionDraw},
+		{"DELETE", "/api/templates/test", remotePermissionDraw},
+		{"POST", "/api/something", remotePermissionAdmin},
+		{"GET", "/", remotePermissionAdmin},
+		{"GET", "/unknown", remotePermissionAdmin},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if got := remoteRequiredPermission(r); got != test.want {
+			t.Errorf("remoteRequiredPermission(%v %v) = %v, want %v", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func Test_remoteAuthorization(t *testing.T) {
+	srv := newRemoteServer()
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	defer srv.Close()
+
+	status := func(method, path, token string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Can't create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v failed: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Without configured tokens, everything is rejected
+	if got := status("GET", "/api/connectionTypes", "anything"); got != http.StatusUnauthorized {
+		t.Errorf("Request without configured tokens returned %v, want %v", got, http.StatusUnauthorized)
+	}
+
+	srv.setTokens([]remoteToken{
+		{Name: "Viewer", Token: "view-token", Permissions: []remotePermission{remotePermissionView}},
+		{Name: "Recorder", Token: "record-token", Permissions: []remotePermission{remotePermissionView, remotePermissionRecord}},
+		{Name: "Admin", Token: "admin-token", Permissions: []remotePermission{remotePermissionAdmin}},
+		{Name: "Empty", Token: "", Permissions: []remotePermission{remotePermissionAdmin}},
+	})
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/connectionTypes", "", http.StatusUnauthorized},
+		{"GET", "/api/connectionTypes", "wrong", http.StatusUnauthorized},
+		{"GET", "/api/connectionTypes", "view-token", http.StatusOK},
+		{"GET", "/api/connectionTypes?token=view-token", "", http.StatusOK},
+		{"POST", "/api/connections/1/recorders", "view-token", http.StatusForbidden},
+		{"POST", "/api/connections/1/recorders", "record-token", http.StatusNotFound}, // Authorized, but the connection doesn't exist
+		{"PUT", "/api/templates/test", "record-token", http.StatusForbidden},
+		{"PUT", "/api/templates/test", "admin-token", http.StatusServiceUnavailable}, // Authorized, but there is no template storage
+	}
+
+	for _, test := range tests {
+		if got := status(test.method, test.path, test.token); got != test.want {
+			t.Errorf("%v %v with token %q returned %v, want %v", test.method, test.path, test.token, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connection to the stream of another D3pixelbot instance
+type connectionRemote struct {
+	URL             string
+	ShortName, Name string // Names of the connection on the remote side. ShortName is validated
+	OnlinePlayers   uint32 // Must be read atomically
+
+	Canvas *canvas
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+
+	MetricsCollectorID int
+}
+
+func init() {
+	// Register connection types (all init functions are called from a single thread, thus threadsafe)
+	connectionTypes["remote"] = connectionType{
+		Name: "Remote D3pixelbot",
+		FunctionNew: func() (connection, *canvas, error) {
+			var address, game, token string
+			if conf == nil {
+				return nil, nil, fmt.Errorf("No configuration loaded")
+			}
+			if err := conf.Get(".remote.address", &address); err != nil {
+				return nil, nil, fmt.Errorf("Can't read remote address from configuration: %v", err)
+			}
+			if err := conf.Get(".remote.game", &game); err != nil {
+				return nil, nil, fmt.Errorf("Can't read remote game from configuration: %v", err)
+			}
+			conf.Get(".remote.token", &token)
+			return newRemote(remoteStreamURL(address, game), token)
+		},
+	}
+}
+
+var remoteSingletons = map[string]*refCountingSingleton{} // One singleton per URL
+var remoteSingletonsMutex sync.Mutex
+
+// Returns the URL of the stream of the given game on a D3pixelbot instance at address.
+// The address can be given with or without scheme, use "wss://" for servers with TLS.
+func remoteStreamURL(address, game string) string {
+	address = strings.TrimRight(address, "/")
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+
+	return address + "/stream/" + url.PathEscape(game)
+}
+
+// Connects to a websocket server and waits for the hello message
+func remoteDial(u, token string) (*websocket.Conn, remoteMessageHello, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	c, resp, err := dialer.Dial(u, header)
+	if err != nil {
+		if resp != nil {
+			return nil, remoteMessageHello{}, fmt.Errorf("Failed to connect to %v: %v (%v)", u, err, resp.Status)
+		}
+		return nil, remoteMessageHello{}, fmt.Errorf("Failed to connect to %v: %v", u, err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		c.Close()
+		return nil, remoteMessageHello{}, fmt.Errorf("Failed to receive hello message from %v: %v", u, err)
+	}
+	msg, err := remoteDecodeMessage(data)
+	if err != nil {
+		c.Close()
+		return nil, remoteMessageHello{}, fmt.Errorf("Failed to decode hello message from %v: %v", u, err)
+	}
+	hello, ok := msg.(remoteMessageHello)
+	if !ok {
+		c.Close()
+		return nil, remoteMessageHello{}, fmt.Errorf("Expected hello message from %v, got %T", u, msg)
+	}
+	if hello.Version != remoteProtocolVersion {
+		c.Close()
+		return nil, remoteMessageHello{}, fmt.Errorf("Unsupported protocol version %v from %v", hello.Version, u)
+	}
+	if !remoteShortNameRegexp.MatchString(hello.ShortName) {
+		c.Close()
+		return nil, remoteMessageHello{}, fmt.Errorf("Invalid short name %q from %v", hello.ShortName, u)
+	}
+
+	return c, hello, nil
+}
+
+// Opens a connection to the stream at the given URL.
+// Connections to the same URL are shared, the token of the first connection is used for all of them.
+func newRemote(u, token string) (connection, *canvas, error) {
+	remoteSingletonsMutex.Lock()
+	singleton, ok := remoteSingletons[u]
+	if !ok {
+		singleton = &refCountingSingleton{}
+		remoteSingletons[u] = singleton
+	}
+	remoteSingletonsMutex.Unlock()
+
+	var initErr error
+
+	// Init function. It isn't called if there is already an instance for this URL
+	init := func() interface{} {
+		c, hello, err := remoteDial(u, token)
+		if err != nil {
+			initErr = err
+			return nil
+		}
+
+		con := &connectionRemote{
+			URL:           u,
+			ShortName:     hello.ShortName,
+			Name:          hello.Name,
+			GoroutineQuit: make(chan struct{}),
+		}
+
+		options := canvasOptionsFromConfig()
+		options.ColorModel = hello.ColorModel
+		con.Canvas, con.ChunkDownloadChan = newCanvas(hello.ChunkSize, hello.Origin, hello.Rect, options)
+		con.MetricsCollectorID = metricsRegisterConnection("remote:"+u, con, con.Canvas)
+
+		// Main goroutine that handles the websocket connection (It will always try to reconnect)
+		con.QuitWaitgroup.Add(1)
+		go func() {
+			defer con.QuitWaitgroup.Done()
+
+			wantedRects := map[image.Rectangle]struct{}{} // Chunk rectangles the canvas has requested, they are registered on the remote side
+
+			for {
+				if c != nil {
+					con.handleSession(c, wantedRects)
+					c = nil
+					con.Canvas.failDownload(con.Canvas.Rect) // Pending downloads will never finish
+					con.Canvas.invalidateAll()
+				}
+
+				select {
+				case <-con.GoroutineQuit:
+					return
+				case <-time.After(5 * time.Second):
+				}
+
+				var newHello remoteMessageHello
+				var err error
+				metricWebsocketReconnects.add(metricLabels("connection", "remote:"+u), 1)
+				c, newHello, err = remoteDial(u, token)
+				if err != nil {
+					log.Errorf("%v", err)
+					c = nil
+					continue
+				}
+				if newHello.ChunkSize != hello.ChunkSize || newHello.Origin != hello.Origin {
+					log.Errorf("Canvas of %v has changed its chunk size or origin, reopen the connection to use it", u)
+					c.Close()
+					c = nil
+				}
+			}
+		}()
+
+		return con
+	}
+
+	// Create or reuse instance of connectionRemote
+	obj := singleton.get(init)
+	if obj == nil {
+		return nil, nil, initErr // The singleton will call init again on the next try
+	}
+	con := obj.(*connectionRemote)
+
+	return con, con.Canvas, nil
+}
+
+// Handles a single websocket connection until it is closed.
+func (con *connectionRemote) handleSession(c *websocket.Conn, wantedRects map[image.Rectangle]struct{}) {
+	log.Debugf("Connected to %v", con.URL)
+	defer log.Debugf("Disconnected from %v", con.URL)
+
+	// Wait for and handle external close events, or connection errors
+	quitChannel := make(chan struct{})
+	defer close(quitChannel)
+	go func() {
+		select {
+		case <-con.GoroutineQuit:
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		case <-quitChannel:
+		}
+		c.Close()
+	}()
+
+	// Goroutine that registers the requested chunks on the remote side. It's the only one writing messages
+	writerQuit := make(chan struct{})
+	writerWaitgroup := sync.WaitGroup{}
+	defer writerWaitgroup.Wait()
+	defer close(writerQuit)
+	writerWaitgroup.Add(1)
+	go func() {
+		defer writerWaitgroup.Done()
+
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		sendRects := func() bool {
+			rects := []image.Rectangle{}
+			for rect := range wantedRects {
+				rects = append(rects, rect)
+			}
+			c.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+			if err := c.WriteMessage(websocket.BinaryMessage, remoteEncodeRegisterRects(rects)); err != nil {
+				log.Warnf("Can't register rectangles at %v: %v", con.URL, err)
+				c.Close()
+				return false
+			}
+			return true
+		}
+
+		if len(wantedRects) > 0 && !sendRects() {
+			return
+		}
+
+		changed := false
+		for {
+			select {
+			case chu := <-con.ChunkDownloadChan:
+				// Check if the chunk still needs to be downloaded
+				if chu.getQueryState(false, con.Canvas.Options) == chunkDownload {
+					if _, ok := wantedRects[chu.Rect]; !ok {
+						wantedRects[chu.Rect] = struct{}{}
+						changed = true
+					}
+				}
+			case <-ticker.C:
+				// Forget chunks that were deleted by the canvas
+				for rect := range wantedRects {
+					if _, err := con.Canvas.getChunk(con.Canvas.ChunkSize.getChunkCoord(rect.Min, con.Canvas.Origin), false); err != nil {
+						delete(wantedRects, rect)
+						changed = true
+					}
+				}
+			case <-writerQuit:
+				return
+			}
+
+			// Send changes, but not more often than the chunk requests arrive
+			if changed && len(con.ChunkDownloadChan) == 0 {
+				if !sendRects() {
+					return
+				}
+				changed = false
+			}
+		}
+	}()
+
+	c.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+	c.SetPingHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+		return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(remoteWriteTimeout))
+	})
+
+	// Handle events
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			log.Warnf("Websocket connection error: %v", err)
+			return
+		}
+		c.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+
+		msg, err := remoteDecodeMessage(data)
+		if err != nil {
+			log.Warnf("Invalid message from %v: %v", con.URL, err)
+			return
+		}
+
+		switch msg := msg.(type) {
+		case canvasEventSetPixel:
+			con.Canvas.setPixel(msg.Pos, msg.Color)
+		case canvasEventInvalidateRect:
+			con.Canvas.invalidateRect(msg.Rect)
+		case canvasEventInvalidateAll:
+			con.Canvas.invalidateAll()
+		case canvasEventRevalidate:
+			con.Canvas.revalidateRect(msg.Rect)
+		case canvasEventSignalDownload:
+			con.Canvas.signalDownload(msg.Rect)
+		case remoteMessageSetImage:
+			// If image is not in sync with the game, ignore it. A valid image will follow later
+			if msg.Valid {
+				con.Canvas.signalDownload(msg.Image.Bounds())
+				con.Canvas.setImage(msg.Image, false, true)
+			}
+		case canvasEventSetTime:
+			con.Canvas.setTime(msg.Time)
+		case remoteMessageOnlinePlayers:
+			atomic.StoreUint32(&con.OnlinePlayers, uint32(msg.Amount))
+		default:
+			log.Warnf("Unexpected message %T from %v", msg, con.URL)
+		}
+	}
+}
+
+// Short names sent by servers are used in file paths and configuration keys, so only a few characters are allowed
+var remoteShortNameRegexp = regexp.MustCompile("^[a-zA-Z0-9\\-\\._]{1,64}$")
+
+// Prefixed, so that recordings of remote streams are stored separately from local ones
+func (con *connectionRemote) getShortName() string {
+	return "remote-" + con.ShortName
+}
+
+func (con *connectionRemote) getName() string {
+	u, err := url.Parse(con.URL)
+	if err != nil {
+		return con.Name
+	}
+	return fmt.Sprintf("%v (via %v)", con.Name, u.Host)
+}
+
+// Chunks are registered on the remote side when they are downloaded, see handleSession
+func (con *connectionRemote) subscribe(rects []image.Rectangle)   {}
+func (con *connectionRemote) unsubscribe(rects []image.Rectangle) {}
+
+func (con *connectionRemote) getOnlinePlayers() int {
+	return int(atomic.LoadUint32(&con.OnlinePlayers))
+}
+
+// Closes connection and canvas
+func (con *connectionRemote) Close() {
+	remoteSingletonsMutex.Lock()
+	singleton := remoteSingletons[con.URL]
+	remoteSingletonsMutex.Unlock()
+
+	if singleton.release(con) {
+		// Stop goroutines gracefully
+		close(con.GoroutineQuit)
+
+		con.QuitWaitgroup.Wait()
+
+		metricsUnregisterCollector(con.MetricsCollectorID)
+		con.Canvas.Close()
+	}
+}
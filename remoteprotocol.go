@@ -0,0 +1,486 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"time"
+)
+
+// Version of the binary websocket protocol used to stream canvases between D3pixelbot instances
+const remoteProtocolVersion = 1
+
+// Opcodes of the binary websocket protocol.
+// They are independent of the data types used in recordings.
+const (
+	remoteOpcodeHello          uint8 = 1
+	remoteOpcodeSetPixel       uint8 = 10
+	remoteOpcodeInvalidateRect uint8 = 20
+	remoteOpcodeInvalidateAll  uint8 = 21
+	remoteOpcodeRevalidateRect uint8 = 22
+	remoteOpcodeSignalDownload uint8 = 25
+	remoteOpcodeSetImage       uint8 = 30
+	remoteOpcodeSetTime        uint8 = 40
+	remoteOpcodeOnlinePlayers  uint8 = 50
+
+	remoteOpcodeRegisterRects uint8 = 100 // Sent from the client to the server
+)
+
+// Image formats used in remoteOpcodeSetImage messages
+const (
+	remoteImageFormatPaletted uint8 = 1 // Palette followed by one index per pixel
+	remoteImageFormatRGBA     uint8 = 2 // 4 bytes per pixel
+)
+
+// First message sent by the server, it describes the streamed canvas
+type remoteMessageHello struct {
+	Version    uint16
+	ChunkSize  pixelSize
+	Origin     image.Point
+	Rect       image.Rectangle
+	ShortName  string
+	Name       string
+	ColorModel canvasColorModel // Older servers don't send it, in that case it's canvasColorModelAny
+}
+
+type remoteMessageSetImage struct {
+	Image image.Image
+	Valid bool
+}
+
+type remoteMessageOnlinePlayers struct {
+	Amount int
+}
+
+type remoteMessageRegisterRects struct {
+	Rects []image.Rectangle
+}
+
+type remoteBinaryRect struct {
+	MinX, MinY, MaxX, MaxY int32
+}
+
+func newRemoteBinaryRect(rect image.Rectangle) remoteBinaryRect {
+	return remoteBinaryRect{
+		MinX: int32(rect.Min.X),
+		MinY: int32(rect.Min.Y),
+		MaxX: int32(rect.Max.X),
+		MaxY: int32(rect.Max.Y),
+	}
+}
+
+func (r remoteBinaryRect) rectangle() image.Rectangle {
+	return image.Rect(int(r.MinX), int(r.MinY), int(r.MaxX), int(r.MaxY))
+}
+
+func remoteWriteString(w io.Writer, s string) error {
+	if len(s) > 0xFFFF {
+		return fmt.Errorf("String is too long (%v bytes)", len(s))
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func remoteReadString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Encodes the hello message, which describes the canvas the server is streaming
+func remoteEncodeHello(msg remoteMessageHello) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := binary.Write(buf, binary.LittleEndian, struct {
+		Opcode                  uint8
+		Version                 uint16
+		ChunkWidth, ChunkHeight uint32
+		OriginX, OriginY        int32
+		Rect                    remoteBinaryRect
+	}{
+		Opcode:      remoteOpcodeHello,
+		Version:     msg.Version,
+		ChunkWidth:  uint32(msg.ChunkSize.X),
+		ChunkHeight: uint32(msg.ChunkSize.Y),
+		OriginX:     int32(msg.Origin.X),
+		OriginY:     int32(msg.Origin.Y),
+		Rect:        newRemoteBinaryRect(msg.Rect),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := remoteWriteString(buf, msg.ShortName); err != nil {
+		return nil, err
+	}
+	if err := remoteWriteString(buf, msg.Name); err != nil {
+		return nil, err
+	}
+
+	// Color model, followed by its palette
+	if len(msg.ColorModel.Palette) > 0xFFFF {
+		return nil, fmt.Errorf("Palette is too long (%v colors)", len(msg.ColorModel.Palette))
+	}
+	buf.WriteByte(uint8(msg.ColorModel.Type))
+	binary.Write(buf, binary.LittleEndian, uint16(len(msg.ColorModel.Palette)))
+	for _, col := range msg.ColorModel.Palette {
+		r, g, b, a := col.RGBA()
+		buf.Write([]byte{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
+	}
+
+	return buf.Bytes(), nil
+}
+
+func remoteEncodeSetPixel(pos image.Point, col color.Color) []byte {
+	r, g, b, a := col.RGBA() // Returns 16 bit per channel
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Opcode     uint8
+		X, Y       int32
+		R, G, B, A uint8
+	}{
+		Opcode: remoteOpcodeSetPixel,
+		X:      int32(pos.X),
+		Y:      int32(pos.Y),
+		R:      uint8(r >> 8),
+		G:      uint8(g >> 8),
+		B:      uint8(b >> 8),
+		A:      uint8(a >> 8),
+	})
+
+	return buf.Bytes()
+}
+
+// Encodes any message that only consists of an opcode and a rectangle
+func remoteEncodeRect(opcode uint8, rect image.Rectangle) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Opcode uint8
+		Rect   remoteBinaryRect
+	}{
+		Opcode: opcode,
+		Rect:   newRemoteBinaryRect(rect),
+	})
+
+	return buf.Bytes()
+}
+
+func remoteEncodeInvalidateAll() []byte {
+	return []byte{remoteOpcodeInvalidateAll}
+}
+
+// Encodes an image.
+// Paletted images are sent as indices with their palette, everything else is converted to RGBA.
+func remoteEncodeSetImage(img image.Image, valid bool) []byte {
+	rect := img.Bounds()
+
+	var validByte uint8
+	if valid {
+		validByte = 1
+	}
+
+	buf := &bytes.Buffer{}
+
+	header := struct {
+		Opcode uint8
+		Valid  uint8
+		Rect   remoteBinaryRect
+		Format uint8
+	}{
+		Opcode: remoteOpcodeSetImage,
+		Valid:  validByte,
+		Rect:   newRemoteBinaryRect(rect),
+	}
+
+	switch img := img.(type) {
+	case *image.Paletted:
+		header.Format = remoteImageFormatPaletted
+		binary.Write(buf, binary.LittleEndian, header)
+		binary.Write(buf, binary.LittleEndian, uint16(len(img.Palette)))
+		for _, col := range img.Palette {
+			r, g, b, a := col.RGBA()
+			buf.Write([]byte{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
+		}
+		for iy := 0; iy < rect.Dy(); iy++ {
+			buf.Write(img.Pix[iy*img.Stride : iy*img.Stride+rect.Dx()])
+		}
+
+	default:
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			rgba = image.NewRGBA(rect)
+			draw.Draw(rgba, rect, img, rect.Min, draw.Src)
+		}
+		header.Format = remoteImageFormatRGBA
+		binary.Write(buf, binary.LittleEndian, header)
+		for iy := 0; iy < rect.Dy(); iy++ {
+			buf.Write(rgba.Pix[iy*rgba.Stride : iy*rgba.Stride+rect.Dx()*4])
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func remoteEncodeSetTime(t time.Time) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Opcode uint8
+		Time   int64
+	}{
+		Opcode: remoteOpcodeSetTime,
+		Time:   t.UnixNano(),
+	})
+
+	return buf.Bytes()
+}
+
+func remoteEncodeOnlinePlayers(amount int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Opcode uint8
+		Amount uint32
+	}{
+		Opcode: remoteOpcodeOnlinePlayers,
+		Amount: uint32(amount),
+	})
+
+	return buf.Bytes()
+}
+
+func remoteEncodeRegisterRects(rects []image.Rectangle) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Opcode uint8
+		Amount uint32
+	}{
+		Opcode: remoteOpcodeRegisterRects,
+		Amount: uint32(len(rects)),
+	})
+	for _, rect := range rects {
+		binary.Write(buf, binary.LittleEndian, newRemoteBinaryRect(rect))
+	}
+
+	return buf.Bytes()
+}
+
+// Decodes a single websocket message into one of the following types:
+//   - remoteMessageHello
+//   - canvasEventSetPixel
+//   - canvasEventInvalidateRect
+//   - canvasEventInvalidateAll
+//   - canvasEventRevalidate
+//   - canvasEventSignalDownload
+//   - remoteMessageSetImage
+//   - canvasEventSetTime
+//   - remoteMessageOnlinePlayers
+//   - remoteMessageRegisterRects
+func remoteDecodeMessage(data []byte) (interface{}, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("Empty message")
+	}
+
+	r := bytes.NewReader(data[1:])
+
+	switch opcode := data[0]; opcode {
+	case remoteOpcodeHello:
+		var dat struct {
+			Version                 uint16
+			ChunkWidth, ChunkHeight uint32
+			OriginX, OriginY        int32
+			Rect                    remoteBinaryRect
+		}
+		if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+			return nil, fmt.Errorf("Can't read hello message: %v", err)
+		}
+		shortName, err := remoteReadString(r)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read hello message: %v", err)
+		}
+		name, err := remoteReadString(r)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read hello message: %v", err)
+		}
+		var colorModel canvasColorModel
+		if r.Len() > 0 {
+			var dat struct {
+				Type       canvasColorModelType
+				PaletteLen uint16
+			}
+			if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+				return nil, fmt.Errorf("Can't read color model: %v", err)
+			}
+			if int(dat.PaletteLen)*4 != r.Len() {
+				return nil, fmt.Errorf("Color model has the wrong length")
+			}
+			colorModel.Type = dat.Type
+			if dat.PaletteLen > 0 {
+				colorModel.Palette = make(color.Palette, dat.PaletteLen)
+				for i := range colorModel.Palette {
+					var col color.RGBA
+					binary.Read(r, binary.LittleEndian, &col)
+					colorModel.Palette[i] = col
+				}
+			}
+		}
+		return remoteMessageHello{
+			Version:    dat.Version,
+			ChunkSize:  pixelSize{int(dat.ChunkWidth), int(dat.ChunkHeight)},
+			Origin:     image.Point{int(dat.OriginX), int(dat.OriginY)},
+			Rect:       dat.Rect.rectangle(),
+			ShortName:  shortName,
+			Name:       name,
+			ColorModel: colorModel,
+		}, nil
+
+	case remoteOpcodeSetPixel:
+		var dat struct {
+			X, Y       int32
+			R, G, B, A uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+			return nil, fmt.Errorf("Can't read pixel message: %v", err)
+		}
+		return canvasEventSetPixel{
+			Pos:   image.Point{int(dat.X), int(dat.Y)},
+			Color: color.RGBA{dat.R, dat.G, dat.B, dat.A},
+		}, nil
+
+	case remoteOpcodeInvalidateRect, remoteOpcodeRevalidateRect, remoteOpcodeSignalDownload:
+		var dat remoteBinaryRect
+		if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+			return nil, fmt.Errorf("Can't read rectangle message: %v", err)
+		}
+		switch opcode {
+		case remoteOpcodeInvalidateRect:
+			return canvasEventInvalidateRect{Rect: dat.rectangle()}, nil
+		case remoteOpcodeRevalidateRect:
+			return canvasEventRevalidate{Rect: dat.rectangle()}, nil
+		default:
+			return canvasEventSignalDownload{Rect: dat.rectangle()}, nil
+		}
+
+	case remoteOpcodeInvalidateAll:
+		return canvasEventInvalidateAll{}, nil
+
+	case remoteOpcodeSetImage:
+		return remoteDecodeSetImage(r)
+
+	case remoteOpcodeSetTime:
+		var binTime int64
+		if err := binary.Read(r, binary.LittleEndian, &binTime); err != nil {
+			return nil, fmt.Errorf("Can't read time message: %v", err)
+		}
+		return canvasEventSetTime{Time: time.Unix(0, binTime)}, nil
+
+	case remoteOpcodeOnlinePlayers:
+		var amount uint32
+		if err := binary.Read(r, binary.LittleEndian, &amount); err != nil {
+			return nil, fmt.Errorf("Can't read online players message: %v", err)
+		}
+		return remoteMessageOnlinePlayers{Amount: int(amount)}, nil
+
+	case remoteOpcodeRegisterRects:
+		var amount uint32
+		if err := binary.Read(r, binary.LittleEndian, &amount); err != nil {
+			return nil, fmt.Errorf("Can't read rectangles message: %v", err)
+		}
+		if int64(amount)*16 != int64(r.Len()) {
+			return nil, fmt.Errorf("Rectangles message has the wrong length")
+		}
+		rects := make([]image.Rectangle, 0, amount)
+		for i := uint32(0); i < amount; i++ {
+			var dat remoteBinaryRect
+			if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+				return nil, fmt.Errorf("Can't read rectangles message: %v", err)
+			}
+			rects = append(rects, dat.rectangle())
+		}
+		return remoteMessageRegisterRects{Rects: rects}, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown opcode %v", opcode)
+	}
+}
+
+func remoteDecodeSetImage(r *bytes.Reader) (remoteMessageSetImage, error) {
+	var dat struct {
+		Valid  uint8
+		Rect   remoteBinaryRect
+		Format uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &dat); err != nil {
+		return remoteMessageSetImage{}, fmt.Errorf("Can't read image message: %v", err)
+	}
+
+	rect := dat.Rect.rectangle()
+	if rect.Empty() {
+		return remoteMessageSetImage{}, fmt.Errorf("Image rectangle %v is empty", rect)
+	}
+	pixels := int64(rect.Dx()) * int64(rect.Dy())
+
+	switch dat.Format {
+	case remoteImageFormatPaletted:
+		var paletteLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &paletteLen); err != nil {
+			return remoteMessageSetImage{}, fmt.Errorf("Can't read image palette: %v", err)
+		}
+		if paletteLen == 0 {
+			return remoteMessageSetImage{}, fmt.Errorf("Image palette is empty")
+		}
+		if int64(paletteLen)*4+pixels != int64(r.Len()) {
+			return remoteMessageSetImage{}, fmt.Errorf("Image message has the wrong length")
+		}
+		palette := make(color.Palette, paletteLen)
+		for i := range palette {
+			var col color.RGBA
+			binary.Read(r, binary.LittleEndian, &col)
+			palette[i] = col
+		}
+		img := image.NewPaletted(rect, palette)
+		io.ReadFull(r, img.Pix)
+		for _, index := range img.Pix {
+			if int(index) >= len(palette) {
+				return remoteMessageSetImage{}, fmt.Errorf("Palette index %v is out of range, the palette has %v colors", index, len(palette))
+			}
+		}
+		return remoteMessageSetImage{Image: img, Valid: dat.Valid != 0}, nil
+
+	case remoteImageFormatRGBA:
+		if pixels*4 != int64(r.Len()) {
+			return remoteMessageSetImage{}, fmt.Errorf("Image message has the wrong length")
+		}
+		img := image.NewRGBA(rect)
+		io.ReadFull(r, img.Pix)
+		return remoteMessageSetImage{Image: img, Valid: dat.Valid != 0}, nil
+	}
+
+	return remoteMessageSetImage{}, fmt.Errorf("Unknown image format %v", dat.Format)
+}
@@ -0,0 +1,418 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"image"
+	"image/color"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	remoteWriteTimeout = 30 * time.Second
+	remotePingInterval = 30 * time.Second
+	remoteReadTimeout  = 90 * time.Second // Must be larger than remotePingInterval
+)
+
+// HTTP server that exposes canvases to other D3pixelbot instances or tools
+type remoteServer struct {
+	sync.Mutex
+
+	Server   *http.Server
+	Mux      *http.ServeMux // Routes without authorization, use Server.Handler to serve requests
+	Upgrader websocket.Upgrader
+	Tokens   []remoteToken // Tokens that grant access to the server
+
+	Clients         map[*remoteStreamClient]struct{} // Currently connected websocket clients
+	ClientWaitgroup sync.WaitGroup
+
+	APIConnections map[int]*remoteAPIConnection // Connections opened via the API
+	APIIDCounter   int                          // Last ID that was given to a connection or recorder
+	Templates      *templateStore               // Can be nil, if there is no template storage
+	Accounts       *accountStore                // Can be nil, it's used to list and solve captchas
+	Defenders      []*defender                  // Defenders whose incidents can be requested
+	Progress       *templateTrackers            // Can be nil, otherwise it's used to compute the progress of templates
+
+	MetricsCollectorID int
+}
+
+// Creates a new server with all its routes.
+// Use listen() to start serving.
+func newRemoteServer() *remoteServer {
+	srv := &remoteServer{
+		Mux: http.NewServeMux(),
+		Upgrader: websocket.Upgrader{
+			EnableCompression: true,
+			CheckOrigin:       func(r *http.Request) bool { return true },
+		},
+		Clients:        map[*remoteStreamClient]struct{}{},
+		APIConnections: map[int]*remoteAPIConnection{},
+	}
+
+	srv.Mux.HandleFunc("/stream/", srv.handleStream)
+	srv.Mux.HandleFunc("/api/", srv.handleAPI)
+
+	srv.Server = &http.Server{
+		Handler: http.HandlerFunc(srv.handleAuthorized),
+	}
+
+	srv.MetricsCollectorID = metricsRegisterCollector(func() []metricSample {
+		srv.Lock()
+		defer srv.Unlock()
+
+		samples := []metricSample{
+			{"d3pixelbot_stream_clients", "", float64(len(srv.Clients))},
+			{"d3pixelbot_api_connections", "", float64(len(srv.APIConnections))},
+		}
+		for cli := range srv.Clients {
+			samples = append(samples, metricSample{"d3pixelbot_listener_queue_length", metricLabels("listener", "stream", "client", cli.Conn.RemoteAddr().String()), float64(len(cli.SendChan))})
+		}
+		return samples
+	})
+
+	return srv
+}
+
+// Adds the /metrics endpoint, which exports metrics in the Prometheus text format
+func (srv *remoteServer) enableMetrics() {
+	srv.Mux.HandleFunc("/metrics", srv.handleMetrics)
+}
+
+// Starts to listen on the given address. The server is run in a goroutine.
+//
+// If certFile and keyFile are given, the server will only accept TLS connections.
+func (srv *remoteServer) listen(address, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("Both a certificate and a key file are needed for TLS")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Can't listen on %v: %v", address, err)
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("Can't load certificate %v: %v", certFile, err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	go func() {
+		if err := srv.Server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Remote server stopped: %v", err)
+		}
+	}()
+
+	if certFile != "" {
+		log.Infof("Remote server listening on %v (TLS)", listener.Addr())
+	} else {
+		log.Infof("Remote server listening on %v", listener.Addr())
+	}
+
+	return nil
+}
+
+// Streams the canvas of a connection type over a websocket connection.
+//
+// The connection is opened (or shared if it's already open) for as long as the client is connected.
+func (srv *remoteServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	shortName := strings.TrimPrefix(r.URL.Path, "/stream/")
+
+	connectionType, ok := connectionTypes[shortName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Connection type %v not found", shortName), http.StatusNotFound)
+		return
+	}
+
+	con, can, err := connectionType.FunctionNew()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't open connection %v: %v", shortName, err), http.StatusInternalServerError)
+		return
+	}
+	defer con.Close()
+
+	c, err := srv.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Can't upgrade connection from %v: %v", r.RemoteAddr, err)
+		return
+	}
+
+	cli := &remoteStreamClient{
+		Conn:       c,
+		Connection: con,
+		Canvas:     can,
+		SendChan:   make(chan []byte, 1000),
+		Quit:       make(chan struct{}),
+	}
+
+	srv.Lock()
+	srv.Clients[cli] = struct{}{}
+	srv.ClientWaitgroup.Add(1)
+	srv.Unlock()
+	defer func() {
+		srv.Lock()
+		delete(srv.Clients, cli)
+		srv.ClientWaitgroup.Done()
+		srv.Unlock()
+	}()
+
+	log.Debugf("Stream client %v connected to %v", r.RemoteAddr, shortName)
+	cli.run()
+	log.Debugf("Stream client %v disconnected from %v", r.RemoteAddr, shortName)
+}
+
+// Replaces the tokens that grant access to the server
+func (srv *remoteServer) setTokens(tokens []remoteToken) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	srv.Tokens = tokens
+}
+
+// Stops the server and disconnects all clients
+func (srv *remoteServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Server.Shutdown(ctx)
+
+	// Hijacked websocket connections aren't closed by Shutdown()
+	srv.Lock()
+	for cli := range srv.Clients {
+		cli.Conn.Close()
+	}
+	srv.Unlock()
+
+	srv.ClientWaitgroup.Wait()
+
+	metricsUnregisterCollector(srv.MetricsCollectorID)
+
+	// Close everything that was opened via the API
+	srv.Lock()
+	closing := map[*remoteAPIConnection][]*remoteAPIRecorder{}
+	for id, apiCon := range srv.APIConnections {
+		closing[apiCon] = apiCon.markClosed()
+		delete(srv.APIConnections, id)
+	}
+	srv.Unlock()
+
+	for apiCon, recorders := range closing {
+		apiCon.close(recorders)
+	}
+}
+
+// A canvas listener that forwards all events to a websocket client
+type remoteStreamClient struct {
+	Conn       *websocket.Conn
+	Connection connection
+	Canvas     *canvas
+
+	SendChan  chan []byte   // Encoded messages that are sent by the writer goroutine
+	Quit      chan struct{} // Closing this channel stops the writer goroutine and makes all handlers return
+	QuitOnce  sync.Once
+	WriterEnd sync.WaitGroup
+}
+
+// Handles the websocket connection until it is closed.
+func (cli *remoteStreamClient) run() {
+	defer cli.Conn.Close()
+
+	hello, err := remoteEncodeHello(remoteMessageHello{
+		Version:    remoteProtocolVersion,
+		ChunkSize:  cli.Canvas.ChunkSize,
+		Origin:     cli.Canvas.Origin,
+		Rect:       cli.Canvas.Rect,
+		ShortName:  cli.Connection.getShortName(),
+		Name:       cli.Connection.getName(),
+		ColorModel: cli.Canvas.Options.ColorModel,
+	})
+	if err != nil {
+		log.Errorf("Can't encode hello message: %v", err)
+		return
+	}
+	cli.Conn.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+	if err := cli.Conn.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+		log.Warnf("Can't send hello message: %v", err)
+		return
+	}
+
+	cli.WriterEnd.Add(1)
+	go cli.writer()
+
+	// Let the canvas manage virtual chunks, so only events inside the registered rectangles are sent
+	if err := cli.Canvas.subscribeListener(cli, true); err != nil {
+		log.Errorf("Can't subscribe to canvas: %v", err)
+		cli.close()
+		cli.WriterEnd.Wait()
+		return
+	}
+
+	cli.Conn.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+	cli.Conn.SetPongHandler(func(string) error {
+		cli.Conn.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+		return nil
+	})
+
+	for {
+		_, data, err := cli.Conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		cli.Conn.SetReadDeadline(time.Now().Add(remoteReadTimeout))
+
+		msg, err := remoteDecodeMessage(data)
+		if err != nil {
+			log.Warnf("Invalid message from stream client: %v", err)
+			break
+		}
+
+		switch msg := msg.(type) {
+		case remoteMessageRegisterRects:
+			cli.Canvas.registerRects(cli, msg.Rects)
+		default:
+			log.Warnf("Unexpected message %T from stream client", msg)
+		}
+	}
+
+	cli.close()
+	cli.Canvas.unsubscribeListener(cli)
+	cli.WriterEnd.Wait()
+}
+
+// Goroutine that writes queued messages and keeps the connection alive
+func (cli *remoteStreamClient) writer() {
+	defer cli.WriterEnd.Done()
+
+	pingTicker := time.NewTicker(remotePingInterval)
+	defer pingTicker.Stop()
+	playerTicker := time.NewTicker(10 * time.Second)
+	defer playerTicker.Stop()
+
+	write := func(data []byte) bool {
+		cli.Conn.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+		if err := cli.Conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			log.Warnf("Can't write to stream client: %v", err)
+			cli.close()
+			cli.Conn.Close() // Stop the reader
+			return false
+		}
+		return true
+	}
+
+	if !write(remoteEncodeOnlinePlayers(cli.Connection.getOnlinePlayers())) {
+		return
+	}
+
+	for {
+		select {
+		case data := <-cli.SendChan:
+			if !write(data) {
+				return
+			}
+		case <-playerTicker.C:
+			if !write(remoteEncodeOnlinePlayers(cli.Connection.getOnlinePlayers())) {
+				return
+			}
+		case <-pingTicker.C:
+			if err := cli.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(remoteWriteTimeout)); err != nil {
+				cli.close()
+				cli.Conn.Close()
+				return
+			}
+		case <-cli.Quit:
+			cli.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+func (cli *remoteStreamClient) close() {
+	cli.QuitOnce.Do(func() {
+		close(cli.Quit)
+	})
+}
+
+// Queues a message. Blocks if the queue is full, but returns as soon as the client is closed.
+func (cli *remoteStreamClient) send(data []byte) error {
+	select {
+	case <-cli.Quit:
+		return fmt.Errorf("Listener is closed")
+	default:
+	}
+
+	select {
+	case cli.SendChan <- data:
+		return nil
+	case <-cli.Quit:
+		return fmt.Errorf("Listener is closed")
+	}
+}
+
+// Slow clients get resynchronized with the current state of their chunks, instead of stalling the canvas
+func (cli *remoteStreamClient) getQueueOptions() canvasListenerQueueOptions {
+	return canvasListenerQueueOptions{
+		Name:     "stream",
+		Overflow: canvasOverflowDropResync,
+	}
+}
+
+func (cli *remoteStreamClient) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	// There is no need to send that data, the client manages its own chunks
+	return nil
+}
+
+func (cli *remoteStreamClient) handleInvalidateAll() error {
+	return cli.send(remoteEncodeInvalidateAll())
+}
+
+func (cli *remoteStreamClient) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cli.send(remoteEncodeRect(remoteOpcodeInvalidateRect, rect))
+}
+
+func (cli *remoteStreamClient) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return cli.send(remoteEncodeSetImage(img, valid))
+}
+
+func (cli *remoteStreamClient) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return cli.send(remoteEncodeSetPixel(pos, color))
+}
+
+func (cli *remoteStreamClient) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return cli.send(remoteEncodeRect(remoteOpcodeSignalDownload, rect))
+}
+
+func (cli *remoteStreamClient) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cli.send(remoteEncodeRect(remoteOpcodeRevalidateRect, rect))
+}
+
+func (cli *remoteStreamClient) handleSetTime(t time.Time) error {
+	return cli.send(remoteEncodeSetTime(t))
+}
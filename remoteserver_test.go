@@ -0,0 +1,304 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connection that doesn't connect to anything, the test itself feeds the canvas
+type testConnection struct {
+	Canvas *canvas
+}
+
+func (con *testConnection) getShortName() string                { return "test" }
+func (con *testConnection) getName() string                     { return "Test" }
+func (con *testConnection) getOnlinePlayers() int               { return 42 }
+func (con *testConnection) subscribe(rects []image.Rectangle)   {}
+func (con *testConnection) unsubscribe(rects []image.Rectangle) {}
+func (con *testConnection) Close()                              {}
+
+// Listener that ignores all events
+type testListener struct{}
+
+func (l *testListener) handleChunksChange(create, remove map[image.Rectangle]int) error { return nil }
+func (l *testListener) handleInvalidateAll() error                                      { return nil }
+func (l *testListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error    { return nil }
+func (l *testListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error   { return nil }
+func (l *testListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return nil
+}
+func (l *testListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testListener) handleSetTime(t time.Time) error                              { return nil }
+
+// Polls condition until it's true, or fails the test after some time
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timeout while waiting for %v", description)
+		}
+	}
+}
+
+func Test_remoteProtocol(t *testing.T) {
+	paletted := image.NewPaletted(image.Rect(-2, -2, 2, 2), pixelcanvasioPalette)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % len(pixelcanvasioPalette))
+	}
+	rgba := image.NewRGBA(image.Rect(10, 20, 13, 22))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i)
+	}
+
+	hello, err := remoteEncodeHello(remoteMessageHello{remoteProtocolVersion, pixelSize{64, 64}, image.Point{1, 2}, image.Rect(-5, -5, 5, 5), "test", "Test", pixelcanvasioColorModel})
+	if err != nil {
+		t.Fatalf("Can't encode hello message: %v", err)
+	}
+
+	tests := []struct {
+		data []byte
+		want interface{}
+	}{
+		{hello, remoteMessageHello{remoteProtocolVersion, pixelSize{64, 64}, image.Point{1, 2}, image.Rect(-5, -5, 5, 5), "test", "Test", pixelcanvasioColorModel}},
+		{remoteEncodeSetPixel(image.Point{-3, 4}, color.RGBA{1, 2, 3, 255}), canvasEventSetPixel{image.Point{-3, 4}, color.RGBA{1, 2, 3, 255}}},
+		{remoteEncodeRect(remoteOpcodeInvalidateRect, image.Rect(1, 2, 3, 4)), canvasEventInvalidateRect{image.Rect(1, 2, 3, 4)}},
+		{remoteEncodeRect(remoteOpcodeRevalidateRect, image.Rect(1, 2, 3, 4)), canvasEventRevalidate{image.Rect(1, 2, 3, 4)}},
+		{remoteEncodeRect(remoteOpcodeSignalDownload, image.Rect(1, 2, 3, 4)), canvasEventSignalDownload{image.Rect(1, 2, 3, 4)}},
+		{remoteEncodeInvalidateAll(), canvasEventInvalidateAll{}},
+		{remoteEncodeSetTime(time.Unix(0, 123456789)), canvasEventSetTime{time.Unix(0, 123456789)}},
+		{remoteEncodeOnlinePlayers(1234), remoteMessageOnlinePlayers{1234}},
+		{remoteEncodeRegisterRects([]image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(-9, -9, 9, 9)}), remoteMessageRegisterRects{[]image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(-9, -9, 9, 9)}}},
+	}
+
+	for _, test := range tests {
+		got, err := remoteDecodeMessage(test.data)
+		if err != nil {
+			t.Errorf("Can't decode %T: %v", test.want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("remoteDecodeMessage() = %v, want %v", got, test.want)
+		}
+	}
+
+	for _, img := range []image.Image{paletted, rgba} {
+		msg, err := remoteDecodeMessage(remoteEncodeSetImage(img, true))
+		if err != nil {
+			t.Errorf("Can't decode %T: %v", img, err)
+			continue
+		}
+		setImage, ok := msg.(remoteMessageSetImage)
+		if !ok {
+			t.Errorf("remoteDecodeMessage() returned %T, want remoteMessageSetImage", msg)
+			continue
+		}
+		if !setImage.Valid || !compareImages(setImage.Image, img) {
+			t.Errorf("Decoded image %v differs from the original", setImage.Image.Bounds())
+		}
+	}
+
+	// Paletted images with an empty palette or indices outside of the palette must not be decoded
+	invalid := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black})
+	invalid.Pix[3] = 1
+	empty := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{})
+	for _, img := range []*image.Paletted{invalid, empty} {
+		if _, err := remoteDecodeMessage(remoteEncodeSetImage(img, true)); err == nil {
+			t.Errorf("Image with palette %v and pixels %v decoded without error", img.Palette, img.Pix)
+		}
+	}
+
+	// Truncated messages must not be decoded
+	for _, test := range tests {
+		if _, err := remoteDecodeMessage(test.data[:len(test.data)-1]); err == nil && len(test.data) > 1 {
+			t.Errorf("Truncated %T message decoded without error", test.want)
+		}
+	}
+}
+
+func Test_remoteServer(t *testing.T) {
+	can, chunkRequests := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer can.Close()
+
+	connectionTypes["test"] = connectionType{
+		Name:        "Test",
+		FunctionNew: func() (connection, *canvas, error) { return &testConnection{can}, can, nil },
+	}
+	defer delete(connectionTypes, "test")
+
+	srv := newRemoteServer()
+	srv.setTokens([]remoteToken{{Name: "Test", Token: "secret", Permissions: []remotePermission{remotePermissionView}}})
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/stream/test?token=secret", nil)
+	if err != nil {
+		t.Fatalf("Can't connect to stream: %v", err)
+	}
+	defer c.Close()
+
+	// Reads messages until one with the wanted type arrives
+	readMessage := func(want interface{}) interface{} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("Can't read message: %v", err)
+			}
+			msg, err := remoteDecodeMessage(data)
+			if err != nil {
+				t.Fatalf("Can't decode message: %v", err)
+			}
+			if reflect.TypeOf(msg) == reflect.TypeOf(want) {
+				return msg
+			}
+		}
+	}
+
+	hello := readMessage(remoteMessageHello{}).(remoteMessageHello)
+	if hello.ChunkSize != can.ChunkSize || hello.Rect != can.Rect || hello.ShortName != "test" {
+		t.Errorf("Got wrong hello message %v", hello)
+	}
+
+	if players := readMessage(remoteMessageOnlinePlayers{}).(remoteMessageOnlinePlayers); players.Amount != 42 {
+		t.Errorf("Got %v online players, want 42", players.Amount)
+	}
+
+	rect := image.Rect(0, 0, 64, 64)
+	if err := c.WriteMessage(websocket.BinaryMessage, remoteEncodeRegisterRects([]image.Rectangle{rect})); err != nil {
+		t.Fatalf("Can't register rectangles: %v", err)
+	}
+
+	// The canvas requests the chunk download after it has handled the rectangles
+	select {
+	case <-chunkRequests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Canvas didn't request any chunk")
+	}
+
+	if _, err := can.signalDownload(rect); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if msg := readMessage(canvasEventSignalDownload{}).(canvasEventSignalDownload); msg.Rect != rect {
+		t.Errorf("Got download signal for %v, want %v", msg.Rect, rect)
+	}
+
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	img.SetColorIndex(5, 6, 7)
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	if msg := readMessage(remoteMessageSetImage{}).(remoteMessageSetImage); !msg.Valid || !compareImages(msg.Image, img) {
+		t.Errorf("Received image differs from the original")
+	}
+
+	if err := can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[3]); err != nil {
+		t.Fatalf("Can't set pixel: %v", err)
+	}
+	if msg := readMessage(canvasEventSetPixel{}).(canvasEventSetPixel); msg.Pos != (image.Point{1, 2}) || msg.Color != pixelcanvasioPalette[3] {
+		t.Errorf("Got pixel %v with color %v", msg.Pos, msg.Color)
+	}
+}
+
+func Test_newRemote(t *testing.T) {
+	srvCan, chunkRequests := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1000, -1000, 1000, 1000), canvasOptions{})
+	defer srvCan.Close()
+
+	connectionTypes["test"] = connectionType{
+		Name:        "Test",
+		FunctionNew: func() (connection, *canvas, error) { return &testConnection{srvCan}, srvCan, nil },
+	}
+	defer delete(connectionTypes, "test")
+
+	srv := newRemoteServer()
+	srv.setTokens([]remoteToken{{Name: "Test", Token: "secret", Permissions: []remotePermission{remotePermissionView}}})
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+
+	if _, _, err := newRemote(remoteStreamURL(strings.TrimPrefix(ts.URL, "http://"), "test"), "wrong"); err == nil {
+		t.Errorf("Connected to remote with invalid token")
+	}
+
+	con, can, err := newRemote(remoteStreamURL(strings.TrimPrefix(ts.URL, "http://"), "test"), "secret")
+	if err != nil {
+		t.Fatalf("Can't connect to remote: %v", err)
+	}
+	defer con.Close()
+
+	if can.ChunkSize != srvCan.ChunkSize || can.Rect != srvCan.Rect || con.getShortName() != "remote-test" {
+		t.Errorf("Canvas properties differ from the remote canvas")
+	}
+
+	// Register a rectangle locally, this has to result in a chunk request on the remote side
+	rect := image.Rect(0, 0, 64, 64)
+	l := &testListener{}
+	can.subscribeListener(l, false)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{rect})
+
+	select {
+	case <-chunkRequests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Remote canvas didn't request any chunk")
+	}
+
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	img.SetColorIndex(5, 6, 7)
+	srvCan.signalDownload(rect)
+	srvCan.setImage(img, false, false)
+	waitFor(t, "valid chunk", func() bool { return can.isValid(rect) })
+
+	if index, err := can.getPixelIndex(image.Point{5, 6}); err != nil || index != 7 {
+		t.Errorf("getPixelIndex() = %v, %v, want 7", index, err)
+	}
+
+	srvCan.setPixel(image.Point{1, 2}, pixelcanvasioPalette[3])
+	waitFor(t, "pixel update", func() bool {
+		index, err := can.getPixelIndex(image.Point{1, 2})
+		return err == nil && index == 3
+	})
+
+	// A disconnect has to invalidate the canvas
+	srv.Close()
+	waitFor(t, "invalidation", func() bool { return !can.isValid(rect) })
+}
+
+func Test_remoteShortNameRegexp(t *testing.T) {
+	for name, want := range map[string]bool{
+		"pixelcanvasio":         true,
+		"pxls-example.com":      true,
+		"":                      false,
+		"../test":               false,
+		"a/b":                   false,
+		"a b":                   false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := remoteShortNameRegexp.MatchString(name); got != want {
+			t.Errorf("remoteShortNameRegexp.MatchString(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -33,24 +33,52 @@ import (
 	"github.com/nfnt/resize"
 )
 
+const sciterTemplateMarkerInterval = time.Second // Interval in which changed wrong pixel markers are sent to the UI
+
+// A template that was stored, its tracker still has to be replaced
+type sciterTemplateChange struct {
+	Template botTemplate
+	Image    image.Image
+}
+
 // A sciter window, showing a canvas
 type sciterCanvas struct {
 	connection connection
 	canvas     *canvas
 
-	handlerChan chan *sciter.Value // Queue of event data, so the main logic doesn't stop while sciter is processing it
-	ClosedMutex sync.RWMutex
-	Closed      bool
+	handlerChan   chan *sciter.Value // Queue of event data, so the main logic doesn't stop while sciter is processing it
+	IndexedImages bool               // Send paletted images as indices and palette, the UI expands them itself. Experimental, as the expansion in TIScript is slow
+	ClosedMutex   sync.RWMutex
+	Closed        bool
+
+	Game             string                           // Connection type of the game, only its templates are shown
+	TemplatesQuit    chan struct{}                    // Closing this channel stops showing templates
+	TemplatesChanged chan struct{}                    // Signals watchTemplates that there are template changes
+	TemplatesMutex   sync.Mutex                       // Protects the fields below
+	Shown            map[string]struct{}              // Templates that were sent to the UI
+	TemplateChanges  map[string]*sciterTemplateChange // Templates whose trackers have to be replaced, nil entries are removed templates
+	Trackers         map[string]*templateTracker      // Trackers of the shown templates, they find wrong pixels
+	MarkerRevisions  map[string]int                   // Tracker revisions of the markers that were sent to the UI
 }
 
-// Opens a new sciter canvas and attaches itself to the given connection and canvas
+// Opens a new sciter canvas and attaches itself to the given connection and canvas.
+// game is the key of the connection type in connectionTypes, it selects the templates that are shown.
 //
 // ONLY CALL FROM MAIN THREAD!
-func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
+func sciterOpenCanvas(con connection, can *canvas, game string) (closedChan chan struct{}) {
 	sca := &sciterCanvas{
-		connection: con,
-		canvas:     can,
-		Closed:     true,
+		connection:       con,
+		canvas:           can,
+		Closed:           true,
+		Game:             game,
+		TemplatesChanged: make(chan struct{}, 1),
+		Shown:            map[string]struct{}{},
+		TemplateChanges:  map[string]*sciterTemplateChange{},
+		Trackers:         map[string]*templateTracker{},
+		MarkerRevisions:  map[string]int{},
+	}
+	if conf != nil {
+		conf.Get(".ui.indexedImages", &sca.IndexedImages)
 	}
 
 	w, err := window.New(sciter.SW_RESIZEABLE|sciter.SW_TITLEBAR|sciter.SW_CONTROLS|sciter.SW_GLASSY|sciter.SW_ENABLE_DEBUG, sciter.NewRect(50, 300, 800, 800))
@@ -123,6 +151,9 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 			}
 		}(sca.handlerChan)
 
+		sca.TemplatesQuit = make(chan struct{})
+		go sca.watchTemplates(sca.TemplatesQuit)
+
 		return nil
 	})
 
@@ -134,20 +165,29 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 
 		// unsubscribeCanvasEvents is non blocking, but an Unsubscribed event is sent to the callback
 		go func() {
-			sca.ClosedMutex.Lock()
-			defer sca.ClosedMutex.Unlock()
+			sca.ClosedMutex.RLock()
+			subscribed := sca.handlerChan != nil
+			sca.ClosedMutex.RUnlock()
 
-			if sca.handlerChan == nil {
+			if !subscribed {
 				log.Errorf("Not subscribed")
 				return
 			}
 
+			// Unsubscribe without holding the lock, as this waits for the handlers of all queued events
 			err := can.unsubscribeListener(sca)
 			if err != nil {
 				log.Errorf("Can't unsubscribe from canvas: %v", err)
 				return
 			}
 
+			sca.ClosedMutex.Lock()
+			defer sca.ClosedMutex.Unlock()
+
+			if sca.handlerChan == nil {
+				return
+			}
+
 			val := sciter.NewValue()
 			val.Set("Type", "Unsubscribed")
 			sca.handlerChan <- val
@@ -155,6 +195,7 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 			close(sca.handlerChan)
 			sca.handlerChan = nil // Goroutine has its own reference to this channel
 			sca.Closed = true
+			close(sca.TemplatesQuit)
 		}()
 
 		return nil
@@ -343,6 +384,14 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 	return closedChan
 }
 
+// The UI only needs the most recent state, so outdated events can be merged if it is too slow
+func (s *sciterCanvas) getQueueOptions() canvasListenerQueueOptions {
+	return canvasListenerQueueOptions{
+		Name:     "ui",
+		Overflow: canvasOverflowCoalesce,
+	}
+}
+
 func (s *sciterCanvas) handleInvalidateAll() error {
 	s.ClosedMutex.RLock()
 	defer s.ClosedMutex.RUnlock()
@@ -415,24 +464,31 @@ func (s *sciterCanvas) handleSetImage(img image.Image, valid bool, vcIDs []int)
 		return fmt.Errorf("Listener is closed")
 	}
 
-	imageArray := imageToBGRAArray(img)
-	headerArray := [12]byte{'B', 'G', 'R', 'A'}
-	binary.BigEndian.PutUint32(headerArray[4:8], uint32(img.Bounds().Dx()))
-	binary.BigEndian.PutUint32(headerArray[8:12], uint32(img.Bounds().Dy()))
-	array := append(headerArray[:], imageArray...)
-
 	val := sciter.NewValue()
 	val.Set("Type", "SetImage")
 	val.Set("X", img.Bounds().Min.X)
 	val.Set("Y", img.Bounds().Min.Y)
 	val.Set("Width", img.Bounds().Dx())
 	val.Set("Height", img.Bounds().Dy())
-	valArray := sciter.NewValue()
-	defer valArray.Release()
-	valArray.SetBytes(array)
-	val.Set("Array", valArray)
+	if paletted, ok := img.(*image.Paletted); ok && s.IndexedImages {
+		indices, palette := imageToIndexedArray(paletted)
+		val.Set("Format", "Indexed")
+		valIndices, valPalette := sciter.NewValue(), sciter.NewValue()
+		defer valIndices.Release()
+		defer valPalette.Release()
+		valIndices.SetBytes(indices)
+		valPalette.SetBytes(palette)
+		val.Set("Indices", valIndices)
+		val.Set("Palette", valPalette)
+	} else {
+		val.Set("Format", "BGRA")
+		valArray := sciter.NewValue()
+		defer valArray.Release()
+		valArray.SetBytes(sciterBGRAArray(img))
+		val.Set("Array", valArray)
+	}
 	val.Set("Valid", valid)
-	valArray = sciter.NewValue()
+	valArray := sciter.NewValue()
 	defer valArray.Release()
 	for k, v := range vcIDs {
 		valArray.SetIndex(k, v)
@@ -559,3 +615,188 @@ func (s *sciterCanvas) handleSetTime(t time.Time) error {
 
 	return nil
 }
+
+// Converts an image into BGRA data with header, as expected by Image.fromBytes of sciter
+func sciterBGRAArray(img image.Image) []byte {
+	headerArray := [12]byte{'B', 'G', 'R', 'A'}
+	binary.BigEndian.PutUint32(headerArray[4:8], uint32(img.Bounds().Dx()))
+	binary.BigEndian.PutUint32(headerArray[8:12], uint32(img.Bounds().Dy()))
+
+	return append(headerArray[:], imageToBGRAArray(img)...)
+}
+
+// Shows the templates of the game, and sends changed wrong pixel markers until quit is closed.
+// Trackers are created and closed here, as that waits for the canvas and must not happen inside of template store or UI locks.
+func (s *sciterCanvas) watchTemplates(quit <-chan struct{}) {
+	if templates == nil {
+		return
+	}
+
+	defer s.closeTrackers()
+	if err := templates.subscribeListener(s); err != nil {
+		log.Tracef("Can't subscribe to templates: %v", err)
+		return
+	}
+	defer templates.unsubscribeListener(s)
+
+	ticker := time.NewTicker(sciterTemplateMarkerInterval)
+	defer ticker.Stop()
+
+	for {
+		s.applyTemplateChanges()
+
+		select {
+		case <-ticker.C:
+			s.sendTemplateMarkers()
+		case <-s.TemplatesChanged:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Replaces or removes the trackers of all changed templates
+func (s *sciterCanvas) applyTemplateChanges() {
+	s.TemplatesMutex.Lock()
+	changes := s.TemplateChanges
+	s.TemplateChanges = map[string]*sciterTemplateChange{}
+	closing := []*templateTracker{}
+	for name := range changes {
+		if tr, ok := s.Trackers[name]; ok {
+			closing = append(closing, tr)
+			delete(s.Trackers, name)
+			delete(s.MarkerRevisions, name)
+		}
+	}
+	s.TemplatesMutex.Unlock()
+
+	for _, tr := range closing {
+		tr.Close()
+	}
+
+	created := map[string]*templateTracker{}
+	for name, change := range changes {
+		if change != nil {
+			created[name] = newTemplateTracker(s.canvas, change.Template, change.Image)
+		}
+	}
+
+	s.TemplatesMutex.Lock()
+	for name, tr := range created {
+		s.Trackers[name] = tr // Markers are sent with the next tick. Newer changes of the template replace the tracker next time
+	}
+	s.TemplatesMutex.Unlock()
+}
+
+// Sends the markers of all templates whose state changed since they were sent last
+func (s *sciterCanvas) sendTemplateMarkers() {
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return
+	}
+
+	s.TemplatesMutex.Lock()
+	defer s.TemplatesMutex.Unlock()
+
+	for name, tr := range s.Trackers {
+		if _, ok := s.TemplateChanges[name]; ok {
+			continue // The tracker is outdated
+		}
+		revision := tr.revision()
+		if sent, ok := s.MarkerRevisions[name]; ok && sent == revision {
+			continue
+		}
+		s.MarkerRevisions[name] = revision
+		s.handlerChan <- sciterTemplateEvent("SetTemplateMarkers", name, tr.overlay())
+	}
+}
+
+// Stops the trackers of all templates
+func (s *sciterCanvas) closeTrackers() {
+	s.TemplatesMutex.Lock()
+	closing := s.Trackers
+	s.Trackers = map[string]*templateTracker{}
+	s.MarkerRevisions = map[string]int{}
+	s.Shown = map[string]struct{}{}
+	s.TemplateChanges = map[string]*sciterTemplateChange{}
+	s.TemplatesMutex.Unlock()
+
+	for _, tr := range closing {
+		tr.Close()
+	}
+}
+
+// Creates an event that contains an image of the template with the given name
+func sciterTemplateEvent(eventType, name string, img image.Image) *sciter.Value {
+	val := sciter.NewValue()
+	val.Set("Type", eventType)
+	val.Set("Name", name)
+	val.Set("X", img.Bounds().Min.X)
+	val.Set("Y", img.Bounds().Min.Y)
+	val.Set("Width", img.Bounds().Dx())
+	val.Set("Height", img.Bounds().Dy())
+	valArray := sciter.NewValue()
+	defer valArray.Release()
+	valArray.SetBytes(sciterBGRAArray(img))
+	val.Set("Array", valArray)
+
+	return val
+}
+
+// Queues a change of a template for watchTemplates. change is nil if the template got removed. TemplatesMutex has to be locked
+func (s *sciterCanvas) queueTemplateChange(name string, change *sciterTemplateChange) {
+	s.TemplateChanges[name] = change
+
+	select {
+	case s.TemplatesChanged <- struct{}{}:
+	default: // There is already a pending signal
+	}
+}
+
+func (s *sciterCanvas) handleSetTemplate(tmpl botTemplate, img image.Image) error {
+	if tmpl.Game != s.Game {
+		return s.handleRemoveTemplate(tmpl.Name) // The template may have belonged to this game before
+	}
+
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	s.TemplatesMutex.Lock()
+	defer s.TemplatesMutex.Unlock()
+
+	s.Shown[tmpl.Name] = struct{}{}
+	s.queueTemplateChange(tmpl.Name, &sciterTemplateChange{Template: tmpl, Image: img})
+
+	s.handlerChan <- sciterTemplateEvent("SetTemplate", tmpl.Name, img)
+
+	return nil
+}
+
+func (s *sciterCanvas) handleRemoveTemplate(name string) error {
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	s.TemplatesMutex.Lock()
+	defer s.TemplatesMutex.Unlock()
+
+	if _, ok := s.Shown[name]; !ok {
+		return nil
+	}
+	delete(s.Shown, name)
+	s.queueTemplateChange(name, nil)
+
+	val := sciter.NewValue()
+	val.Set("Type", "RemoveTemplate")
+	val.Set("Name", name)
+
+	s.handlerChan <- val
+
+	return nil
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Dadido3/go-sciter"
 	gorice "github.com/Dadido3/go-sciter/rice"
@@ -54,9 +55,13 @@ func sciterOpenMain() {
 			return sciter.NewValue(fmt.Sprintf("game %v not found", game))
 		}
 
-		con, can := connectionType.FunctionNew()
+		con, can, err := connectionType.FunctionNew()
+		if err != nil {
+			log.Errorf("Can't open connection to %v: %v", game, err)
+			return sciter.NewValue(fmt.Sprintf("Can't open connection to %v: %v", game, err))
+		}
 
-		closeSignal := sciterOpenCanvas(con, can)
+		closeSignal := sciterOpenCanvas(con, can, game)
 
 		go func() {
 			<-closeSignal
@@ -84,7 +89,11 @@ func sciterOpenMain() {
 			return sciter.NewValue(fmt.Sprintf("game %v not found", game))
 		}
 
-		con, can := connectionType.FunctionNew()
+		con, can, err := connectionType.FunctionNew()
+		if err != nil {
+			log.Errorf("Can't open connection to %v: %v", game, err)
+			return sciter.NewValue(fmt.Sprintf("Can't open connection to %v: %v", game, err))
+		}
 
 		closeSignal := sciterOpenRecorder(con, can)
 
@@ -114,7 +123,7 @@ func sciterOpenMain() {
 			return sciter.NewValue(fmt.Sprintf("Can't open recording of %v: %v", game, err))
 		}
 
-		closeSignal := sciterOpenCanvas(con, can)
+		closeSignal := sciterOpenCanvas(con, can, game)
 
 		go func() {
 			<-closeSignal
@@ -124,6 +133,48 @@ func sciterOpenMain() {
 		return nil
 	})
 
+	// Opens a connection to another D3pixelbot instance, and either shows or records it
+	openRemote := func(record bool, args ...*sciter.Value) *sciter.Value {
+		if len(args) != 3 {
+			log.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+		if !args[0].IsString() || !args[1].IsString() || !args[2].IsString() {
+			log.Errorf("Wrong type of parameters")
+			return sciter.NewValue("Wrong type of parameters")
+		}
+
+		address, game, token := args[0].String(), args[1].String(), args[2].String()
+
+		con, can, err := newRemote(remoteStreamURL(address, game), token)
+		if err != nil {
+			log.Errorf("Can't open connection to %v at %v: %v", game, address, err)
+			return sciter.NewValue(fmt.Sprintf("Can't open connection to %v at %v: %v", game, address, err))
+		}
+
+		var closeSignal chan struct{}
+		if record {
+			closeSignal = sciterOpenRecorder(con, can)
+		} else {
+			closeSignal = sciterOpenCanvas(con, can, game)
+		}
+
+		go func() {
+			<-closeSignal
+			con.Close()
+		}()
+
+		return nil
+	}
+
+	w.DefineFunction("openRemote", func(args ...*sciter.Value) *sciter.Value {
+		return openRemote(false, args...)
+	})
+
+	w.DefineFunction("recordRemote", func(args ...*sciter.Value) *sciter.Value {
+		return openRemote(true, args...)
+	})
+
 	w.DefineFunction("version", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
 			log.Errorf("Wrong number of parameters")
@@ -133,6 +184,60 @@ func sciterOpenMain() {
 		return sciter.NewValue(version.String())
 	})
 
+	// Forwards captcha events to the given callback, starting with all pending captchas
+	w.DefineFunction("subscribeCaptchas", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 1 {
+			log.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+		cbHandler := args[0].Clone() // Always clone, otherwise those are just references to sciter values and will be invalid if used after return
+		if !cbHandler.IsObjectFunction() {
+			log.Errorf("Wrong type of parameters")
+			return sciter.NewValue("Wrong type of parameters")
+		}
+
+		if accounts == nil || accounts.Captchas == nil {
+			return sciter.NewValue("Captchas aren't forwarded")
+		}
+
+		n := &sciterCaptchaNotifier{EventChan: make(chan *sciter.Value, 100)}
+		go func() {
+			for val := range n.EventChan {
+				cbHandler.Invoke(sciter.NewValue(), "[Native Script]", val)
+				val.Release()
+			}
+		}()
+		accounts.Captchas.addNotifier(n)
+		for _, req := range accounts.Captchas.getPending() {
+			n.notifyCaptcha(captchaEventRequired, req) // The UI ignores duplicates, so nothing is missed in between
+		}
+
+		return nil
+	})
+
+	w.DefineFunction("solveCaptcha", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 2 {
+			log.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+		if !args[0].IsInt() || !args[1].IsString() {
+			log.Errorf("Wrong type of parameters")
+			return sciter.NewValue("Wrong type of parameters")
+		}
+
+		id, token := args[0].Int(), args[1].String()
+
+		if accounts == nil {
+			return sciter.NewValue("There are no accounts")
+		}
+		if err := accounts.solveCaptcha(id, token); err != nil {
+			log.Errorf("Can't solve captcha %v: %v", id, err)
+			return sciter.NewValue(fmt.Sprintf("Can't solve captcha %v: %v", id, err))
+		}
+
+		return nil
+	})
+
 	if err := w.LoadFile("rice://ui/main.htm"); err != nil {
 		log.Panic(err)
 	}
@@ -140,3 +245,25 @@ func sciterOpenMain() {
 	w.Show()
 	w.Run()
 }
+
+// Forwards captcha events to the main window
+type sciterCaptchaNotifier struct {
+	EventChan chan *sciter.Value
+}
+
+func (n *sciterCaptchaNotifier) notifyCaptcha(event captchaEventType, req captchaRequest) {
+	val := sciter.NewValue()
+	val.Set("Type", string(event))
+	val.Set("ID", req.ID)
+	val.Set("Account", req.Account)
+	val.Set("Game", req.Game)
+	val.Set("Message", req.Message)
+	val.Set("ExpiresIn", int(req.Expires.Sub(time.Now()).Seconds()))
+
+	select {
+	case n.EventChan <- val:
+	default:
+		log.Warnf("Too many captcha events, the UI may be outdated")
+		val.Release()
+	}
+}
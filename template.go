@@ -0,0 +1,249 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/Dadido3/configdb"
+)
+
+// An image that the bot should draw onto a canvas
+type botTemplate struct {
+	Name     string
+	Game     string      // Short name of the connection type the template is meant for
+	Position image.Point // Canvas coordinate of the upper left corner of the image
+}
+
+// Gets notified about changes of the templates in a template store
+type templateListener interface {
+	handleSetTemplate(tmpl botTemplate, img image.Image) error // img is in canvas coordinates
+	handleRemoveTemplate(name string) error
+}
+
+// Stores templates in the configuration, and their images as PNG files inside a directory.
+//
+// The list of templates is kept in memory, as configuration changes aren't visible immediately.
+type templateStore struct {
+	sync.Mutex
+
+	Config    *configdb.Config
+	Directory string
+	Templates []botTemplate
+	Listeners map[templateListener]struct{}
+}
+
+var templateNameRegexp = regexp.MustCompile("^[a-zA-Z0-9\\-\\._]+$")
+
+// Creates a template store that loads its templates from the given configuration
+func newTemplateStore(c *configdb.Config, directory string) *templateStore {
+	ts := &templateStore{
+		Config:    c,
+		Directory: directory,
+		Templates: []botTemplate{},
+		Listeners: map[templateListener]struct{}{},
+	}
+
+	if err := c.Get(".templates", &ts.Templates); err != nil {
+		ts.Templates = []botTemplate{} // No templates stored yet
+	}
+
+	return ts
+}
+
+func (ts *templateStore) imagePath(name string) string {
+	return filepath.Join(ts.Directory, name+".png")
+}
+
+// Returns all stored templates
+func (ts *templateStore) getTemplates() ([]botTemplate, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	return append([]botTemplate{}, ts.Templates...), nil
+}
+
+// Returns the template with the given name
+func (ts *templateStore) getTemplate(name string) (botTemplate, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	for _, tmpl := range ts.Templates {
+		if tmpl.Name == name {
+			return tmpl, nil
+		}
+	}
+
+	return botTemplate{}, fmt.Errorf("Template %v not found", name)
+}
+
+// Stores the given template and its image.
+// An existing template with the same name will be overwritten.
+func (ts *templateStore) setTemplate(tmpl botTemplate, img image.Image) error {
+	if !templateNameRegexp.MatchString(tmpl.Name) {
+		return fmt.Errorf("Invalid template name %q, only letters, digits, '-', '.' and '_' are allowed", tmpl.Name)
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+
+	os.MkdirAll(ts.Directory, 0777)
+	filePath := ts.imagePath(tmpl.Name)
+	f, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", filePath, err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("Can't write image to %v: %v", filePath, err)
+	}
+
+	newTemplates := []botTemplate{tmpl}
+	for _, t := range ts.Templates {
+		if t.Name != tmpl.Name {
+			newTemplates = append(newTemplates, t)
+		}
+	}
+
+	if err := ts.Config.Set(".templates", newTemplates); err != nil {
+		return fmt.Errorf("Can't write configuration: %v", err)
+	}
+	ts.Templates = newTemplates
+
+	// Listeners get the image in canvas coordinates
+	if len(ts.Listeners) > 0 {
+		if img, err := ts.getImage(tmpl); err == nil {
+			ts.notify(func(l templateListener) error { return l.handleSetTemplate(tmpl, img) })
+		} else {
+			log.Warnf("Can't notify listeners about template %v: %v", tmpl.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Removes a template and its image
+func (ts *templateStore) removeTemplate(name string) error {
+	ts.Lock()
+	defer ts.Unlock()
+
+	found := false
+	newTemplates := []botTemplate{}
+	for _, t := range ts.Templates {
+		if t.Name == name {
+			found = true
+			continue
+		}
+		newTemplates = append(newTemplates, t)
+	}
+	if !found {
+		return fmt.Errorf("Template %v not found", name)
+	}
+
+	if err := ts.Config.Set(".templates", newTemplates); err != nil {
+		return fmt.Errorf("Can't write configuration: %v", err)
+	}
+	ts.Templates = newTemplates
+
+	os.Remove(ts.imagePath(name))
+
+	ts.notify(func(l templateListener) error { return l.handleRemoveTemplate(name) })
+
+	return nil
+}
+
+// Subscribes a listener to template changes.
+// The listener gets all stored templates immediately, it isn't subscribed if it returns an error.
+func (ts *templateStore) subscribeListener(l templateListener) error {
+	ts.Lock()
+	defer ts.Unlock()
+
+	for _, tmpl := range ts.Templates {
+		img, err := ts.getImage(tmpl)
+		if err != nil {
+			log.Warnf("Can't send template %v to listener: %v", tmpl.Name, err)
+			continue
+		}
+		if err := l.handleSetTemplate(tmpl, img); err != nil {
+			return err
+		}
+	}
+
+	ts.Listeners[l] = struct{}{}
+
+	return nil
+}
+
+func (ts *templateStore) unsubscribeListener(l templateListener) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	delete(ts.Listeners, l)
+}
+
+// Calls f for every listener, listeners that return an error are unsubscribed. The store has to be locked
+func (ts *templateStore) notify(f func(l templateListener) error) {
+	for l := range ts.Listeners {
+		if err := f(l); err != nil {
+			delete(ts.Listeners, l)
+		}
+	}
+}
+
+// Loads the image of a template.
+// The bounds of the resulting image are in canvas coordinates.
+func (ts *templateStore) getImage(tmpl botTemplate) (image.Image, error) {
+	filePath := ts.imagePath(tmpl.Name)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open file %v: %v", filePath, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decode image %v: %v", filePath, err)
+	}
+
+	// Move image to its position on the canvas
+	offset := tmpl.Position.Sub(img.Bounds().Min)
+	switch img := img.(type) {
+	case *image.Paletted:
+		img.Rect = img.Rect.Add(offset)
+	case *image.RGBA:
+		img.Rect = img.Rect.Add(offset)
+	case *image.NRGBA:
+		img.Rect = img.Rect.Add(offset)
+	default:
+		imgCopy := image.NewNRGBA(img.Bounds().Add(offset))
+		for iy := imgCopy.Rect.Min.Y; iy < imgCopy.Rect.Max.Y; iy++ {
+			for ix := imgCopy.Rect.Min.X; ix < imgCopy.Rect.Max.X; ix++ {
+				imgCopy.Set(ix, iy, img.At(ix-offset.X, iy-offset.Y))
+			}
+		}
+		return imgCopy, nil
+	}
+
+	return img, nil
+}
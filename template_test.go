@@ -0,0 +1,92 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Records template changes
+type testTemplateListener struct {
+	Templates map[string]image.Rectangle // Bounds of the received images
+	Err       error                      // Returned by all handlers
+}
+
+func (l *testTemplateListener) handleSetTemplate(tmpl botTemplate, img image.Image) error {
+	l.Templates[tmpl.Name] = img.Bounds()
+	return l.Err
+}
+
+func (l *testTemplateListener) handleRemoveTemplate(name string) error {
+	delete(l.Templates, name)
+	return l.Err
+}
+
+func Test_templateStoreListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := configdb.New([]configdb.Storage{configdb.UseDummyStorage("", map[string]interface{}{})})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+	ts := newTemplateStore(c, dir)
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	if err := ts.setTemplate(botTemplate{Name: "a", Game: "test", Position: image.Point{10, 20}}, img); err != nil {
+		t.Fatalf("Can't store template: %v", err)
+	}
+
+	// Existing templates are sent on subscription, in canvas coordinates
+	l := &testTemplateListener{Templates: map[string]image.Rectangle{}}
+	if err := ts.subscribeListener(l); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	if want := image.Rect(10, 20, 14, 22); l.Templates["a"] != want {
+		t.Errorf("Listener got template a at %v, want %v", l.Templates["a"], want)
+	}
+
+	if err := ts.setTemplate(botTemplate{Name: "b", Game: "test"}, img); err != nil {
+		t.Fatalf("Can't store template: %v", err)
+	}
+	if err := ts.removeTemplate("a"); err != nil {
+		t.Fatalf("Can't remove template: %v", err)
+	}
+	if _, ok := l.Templates["b"]; !ok || len(l.Templates) != 1 {
+		t.Errorf("Listener has templates %v, want only b", l.Templates)
+	}
+
+	// Listeners that fail are unsubscribed
+	l.Err = fmt.Errorf("Listener is closed")
+	ts.removeTemplate("b")
+	l.Err = nil
+	ts.setTemplate(botTemplate{Name: "c", Game: "test"}, img)
+	if _, ok := l.Templates["c"]; ok {
+		t.Errorf("Failed listener is still subscribed")
+	}
+
+	ts.unsubscribeListener(l)
+}
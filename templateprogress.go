@@ -0,0 +1,442 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"sync"
+	"time"
+)
+
+const templateLossWindow = time.Hour // Time span of templateProgress.LostLastHour
+
+// Colors of the progress overlay
+var (
+	templateOverlayWrong   = color.RGBA{255, 0, 255, 255} // Pixels that don't match the template
+	templateOverlayCorrect = color.RGBA{0, 0, 0, 0}       // Pixels that match the template
+	templateOverlayUnknown = color.RGBA{128, 128, 128, 128}
+)
+
+// Statistics of a template, computed from the canvas state
+type templateProgress struct {
+	Template         string
+	Total            int // Non transparent pixels of the template
+	Correct          int
+	Wrong            int
+	Unknown          int // Pixels whose chunks aren't downloaded yet
+	Percent          float64
+	LostLastHour     int     // Correct pixels that were changed to a wrong color within the last hour
+	EstimatedSeconds float64 // Time until all wrong pixels are placed with the enabled accounts of the game, -1 if unknown
+}
+
+// Watches a template on a canvas to compute its progress
+type templateTracker struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas     *canvas
+	Connection connection // Gets closed with the tracker, can be nil
+	Template   botTemplate
+	Image      image.Image // Template image in canvas coordinates
+
+	StateMutex sync.Mutex
+	State      *image.RGBA // Last known colors inside of the template bounds, transparent means unknown
+	Losses     []time.Time // Times at which correct pixels were changed to a wrong color, oldest first
+	Revision   int         // Incremented whenever the state changes
+}
+
+// Starts to watch the template on the canvas
+func newTemplateTracker(can *canvas, tmpl botTemplate, img image.Image) *templateTracker {
+	tr := &templateTracker{
+		Canvas:   can,
+		Template: tmpl,
+		Image:    img,
+		State:    image.NewRGBA(img.Bounds()),
+		Losses:   []time.Time{},
+	}
+
+	can.subscribeListener(tr, false) // Don't let the canvas manage virtual chunks for us
+	can.registerRects(tr, []image.Rectangle{img.Bounds()})
+
+	return tr
+}
+
+// Opens a connection to the game of the template, and starts to watch the template
+func newTemplateTrackerFromStore(ts *templateStore, name string) (*templateTracker, error) {
+	tmpl, err := ts.getTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := ts.getImage(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	conType, ok := connectionTypes[tmpl.Game]
+	if !ok {
+		return nil, fmt.Errorf("Connection type %v of template %v not found", tmpl.Game, name)
+	}
+	con, can, err := conType.FunctionNew()
+	if err != nil {
+		return nil, fmt.Errorf("Can't open connection to %v: %v", tmpl.Game, err)
+	}
+
+	tr := newTemplateTracker(can, tmpl, img)
+	tr.Connection = con
+
+	return tr, nil
+}
+
+// Returns the color the template wants at the given position, transparent pixels don't matter
+func (tr *templateTracker) wantedColor(pos image.Point) color.RGBA {
+	return color.RGBAModel.Convert(tr.Image.At(pos.X, pos.Y)).(color.RGBA)
+}
+
+// Computes the progress of the template.
+// The estimated time is based on the cooldowns of the given accounts that belong to the game of the template.
+func (tr *templateTracker) progress(accs []botAccount) templateProgress {
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	p := templateProgress{Template: tr.Template.Name, EstimatedSeconds: -1}
+
+	bounds := tr.Image.Bounds()
+	for iy := bounds.Min.Y; iy < bounds.Max.Y; iy++ {
+		for ix := bounds.Min.X; ix < bounds.Max.X; ix++ {
+			wanted := tr.wantedColor(image.Point{ix, iy})
+			if wanted.A == 0 {
+				continue
+			}
+			p.Total++
+			switch current := tr.State.RGBAAt(ix, iy); {
+			case current.A == 0:
+				p.Unknown++
+			case current == wanted:
+				p.Correct++
+			default:
+				p.Wrong++
+			}
+		}
+	}
+	if p.Total > 0 {
+		p.Percent = float64(p.Correct) / float64(p.Total) * 100
+	}
+
+	tr.pruneLosses()
+	p.LostLastHour = len(tr.Losses)
+
+	if eta, ok := estimateCompletion(p.Wrong+p.Unknown, tr.Template.Game, accs); ok {
+		p.EstimatedSeconds = eta.Seconds()
+	}
+
+	return p
+}
+
+// Returns an image of the template area, with all wrong pixels highlighted
+func (tr *templateTracker) overlay() *image.RGBA {
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	bounds := tr.Image.Bounds()
+	img := image.NewRGBA(bounds)
+	for iy := bounds.Min.Y; iy < bounds.Max.Y; iy++ {
+		for ix := bounds.Min.X; ix < bounds.Max.X; ix++ {
+			wanted := tr.wantedColor(image.Point{ix, iy})
+			if wanted.A == 0 {
+				continue
+			}
+			switch current := tr.State.RGBAAt(ix, iy); {
+			case current.A == 0:
+				img.SetRGBA(ix, iy, templateOverlayUnknown)
+			case current == wanted:
+				img.SetRGBA(ix, iy, templateOverlayCorrect)
+			default:
+				img.SetRGBA(ix, iy, templateOverlayWrong)
+			}
+		}
+	}
+
+	return img
+}
+
+// Returns the revision of the state, it changes whenever the overlay may have changed
+func (tr *templateTracker) revision() int {
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	return tr.Revision
+}
+
+// Removes losses that are older than the loss window. The state has to be locked
+func (tr *templateTracker) pruneLosses() {
+	limit := time.Now().Add(-templateLossWindow)
+	i := 0
+	for i < len(tr.Losses) && tr.Losses[i].Before(limit) {
+		i++
+	}
+	tr.Losses = tr.Losses[i:]
+}
+
+// Returns the time the enabled accounts of the game need to place the given amount of pixels.
+// Only accounts with a known cooldown are considered, the result is false if there is none.
+func estimateCompletion(pixels int, game string, accs []botAccount) (time.Duration, bool) {
+	rate := 0.0 // Pixels per second
+	for _, acc := range accs {
+		if acc.Game == game && !acc.Disabled && acc.LastCooldown > 0 {
+			rate += 1 / acc.LastCooldown
+		}
+	}
+	if rate == 0 {
+		return 0, false
+	}
+
+	return time.Duration(float64(pixels) / rate * float64(time.Second)), true
+}
+
+func (tr *templateTracker) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	tr.ClosedMutex.RLock()
+	defer tr.ClosedMutex.RUnlock()
+	if tr.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+	if !pos.In(tr.State.Rect) {
+		return nil
+	}
+
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	wanted := tr.wantedColor(pos)
+	newColor := color.RGBAModel.Convert(col).(color.RGBA)
+	if wanted.A != 0 && tr.State.RGBAAt(pos.X, pos.Y) == wanted && newColor != wanted {
+		tr.Losses = append(tr.Losses, time.Now())
+		tr.pruneLosses()
+	}
+	tr.State.SetRGBA(pos.X, pos.Y, newColor)
+	tr.Revision++
+
+	return nil
+}
+
+func (tr *templateTracker) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	tr.ClosedMutex.RLock()
+	defer tr.ClosedMutex.RUnlock()
+	if tr.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	if valid {
+		draw.Draw(tr.State, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	} else {
+		draw.Draw(tr.State, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+	}
+	tr.Revision++
+
+	return nil
+}
+
+func (tr *templateTracker) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	tr.ClosedMutex.RLock()
+	defer tr.ClosedMutex.RUnlock()
+	if tr.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	tr.StateMutex.Lock()
+	defer tr.StateMutex.Unlock()
+
+	draw.Draw(tr.State, rect, image.Transparent, image.Point{}, draw.Src)
+	tr.Revision++
+
+	return nil
+}
+
+func (tr *templateTracker) handleInvalidateAll() error {
+	return tr.handleInvalidateRect(tr.State.Rect, nil)
+}
+
+// The chunk contents are still the same, the tracker keeps its unknown pixels until they are sent again
+func (tr *templateTracker) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (tr *templateTracker) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (tr *templateTracker) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+func (tr *templateTracker) handleSetTime(t time.Time) error {
+	return nil
+}
+
+// Only the newest state matters, older pixel events can be dropped
+func (tr *templateTracker) getQueueOptions() canvasListenerQueueOptions {
+	return canvasListenerQueueOptions{
+		Name:     "progress",
+		Overflow: canvasOverflowCoalesce,
+	}
+}
+
+// Stops watching the template, and closes the connection if the tracker owns it
+func (tr *templateTracker) Close() {
+	tr.ClosedMutex.Lock()
+	if tr.Closed {
+		tr.ClosedMutex.Unlock()
+		return
+	}
+	tr.Closed = true
+	tr.ClosedMutex.Unlock()
+
+	tr.Canvas.unsubscribeListener(tr)
+
+	if tr.Connection != nil {
+		tr.Connection.Close()
+	}
+}
+
+// Keeps a tracker open for every template whose progress was requested
+type templateTrackers struct {
+	sync.Mutex
+
+	Templates *templateStore
+	Trackers  map[string]*templateTracker
+}
+
+func newTemplateTrackers(ts *templateStore) *templateTrackers {
+	return &templateTrackers{
+		Templates: ts,
+		Trackers:  map[string]*templateTracker{},
+	}
+}
+
+// Returns the tracker of the template with the given name, and starts it if necessary.
+// The connection is opened without holding the lock, as that may take a while.
+func (tt *templateTrackers) get(name string) (*templateTracker, error) {
+	tt.Lock()
+	tr, ok := tt.Trackers[name]
+	tt.Unlock()
+	if ok {
+		return tr, nil
+	}
+
+	tr, err := newTemplateTrackerFromStore(tt.Templates, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tt.Lock()
+	if existing, ok := tt.Trackers[name]; ok {
+		tt.Unlock()
+		tr.Close() // Someone else was faster
+		return existing, nil
+	}
+	tt.Trackers[name] = tr
+	tt.Unlock()
+
+	return tr, nil
+}
+
+// Stops the tracker of the given template, e.g. because the template changed
+func (tt *templateTrackers) remove(name string) {
+	tt.Lock()
+	tr, ok := tt.Trackers[name]
+	delete(tt.Trackers, name)
+	tt.Unlock()
+
+	if ok {
+		tr.Close()
+	}
+}
+
+// Stops all trackers
+func (tt *templateTrackers) Close() {
+	tt.Lock()
+	trackers := tt.Trackers
+	tt.Trackers = map[string]*templateTracker{}
+	tt.Unlock()
+
+	for _, tr := range trackers {
+		tr.Close()
+	}
+}
+
+// Command line tool that prints the progress of a template, and optionally writes its overlay image.
+//
+//	D3pixelbot progress -template my-template -image overlay.png
+func cliProgress(args []string, ts *templateStore, as *accountStore) error {
+	flags := flag.NewFlagSet("progress", flag.ContinueOnError)
+	name := flags.String("template", "", "Name of the template")
+	imagePath := flags.String("image", "", "Optional output path of the overlay image, wrong pixels are highlighted")
+	timeout := flags.Duration("timeout", time.Minute, "Maximum time to wait for the canvas to be downloaded")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if ts == nil {
+		return fmt.Errorf("No configuration loaded")
+	}
+
+	tr, err := newTemplateTrackerFromStore(ts, *name)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	var accs []botAccount
+	if as != nil {
+		accs = as.getAccounts()
+	}
+
+	// Wait until every pixel of the template is known
+	p := tr.progress(accs)
+	for start := time.Now(); p.Unknown > 0 && time.Since(start) < *timeout; p = tr.progress(accs) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if p.Unknown > 0 {
+		log.Warnf("%v pixels of the template are still unknown", p.Unknown)
+	}
+
+	if *imagePath != "" {
+		f, err := os.Create(*imagePath)
+		if err != nil {
+			return fmt.Errorf("Can't create file %v: %v", *imagePath, err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, tr.overlay()); err != nil {
+			return fmt.Errorf("Can't write image to %v: %v", *imagePath, err)
+		}
+	}
+
+	eta := "unknown"
+	if p.EstimatedSeconds >= 0 {
+		eta = (time.Duration(p.EstimatedSeconds) * time.Second).String()
+	}
+	log.Infof("Template %v: %v of %v pixels correct (%.2f%%), %v wrong, %v unknown, %v lost in the last hour, estimated time to complete: %v",
+		p.Template, p.Correct, p.Total, p.Percent, p.Wrong, p.Unknown, p.LostLastHour, eta)
+
+	return nil
+}
@@ -0,0 +1,74 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func Test_templateTracker(t *testing.T) {
+	can, tmpl := newTestDefenseCanvas(t) // White canvas, 4x4 red template with one transparent pixel
+	defer can.Close()
+	tr := newTemplateTracker(can, tmpl.Template, tmpl.Image)
+	defer tr.Close()
+
+	red, black := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 255}
+	can.setPixel(image.Point{10, 10}, red)
+	can.setPixel(image.Point{11, 10}, red)
+	can.setPixel(image.Point{11, 10}, black) // Griefed after it was correct
+	can.setPixel(image.Point{12, 10}, black) // Was never correct
+
+	var p templateProgress
+	waitFor(t, "template progress", func() bool {
+		p = tr.progress(nil)
+		return p.Unknown == 0 && p.LostLastHour == 1
+	})
+	if p.Total != 15 || p.Correct != 1 || p.Wrong != 14 || p.EstimatedSeconds != -1 {
+		t.Errorf("Got progress %+v, want 15 total, 1 correct, 14 wrong and no estimation", p)
+	}
+
+	overlay := tr.overlay()
+	for pos, want := range map[image.Point]color.RGBA{
+		{10, 10}: templateOverlayCorrect,
+		{11, 10}: templateOverlayWrong,
+		{13, 13}: {}, // Transparent in the template
+	} {
+		if got := overlay.RGBAAt(pos.X, pos.Y); got != want {
+			t.Errorf("Overlay at %v is %v, want %v", pos, got, want)
+		}
+	}
+}
+
+func Test_estimateCompletion(t *testing.T) {
+	accs := []botAccount{
+		{Name: "a", Game: "test", LastCooldown: 10},
+		{Name: "b", Game: "test", LastCooldown: 10},
+		{Name: "c", Game: "test", LastCooldown: 1, Disabled: true},
+		{Name: "d", Game: "other", LastCooldown: 1},
+		{Name: "e", Game: "test"}, // Cooldown not known yet
+	}
+
+	if eta, ok := estimateCompletion(10, "test", accs); !ok || eta != 50*time.Second {
+		t.Errorf("estimateCompletion() = %v, %v, want %v", eta, ok, 50*time.Second)
+	}
+	if _, ok := estimateCompletion(10, "none", accs); ok {
+		t.Errorf("estimateCompletion() succeeded without accounts")
+	}
+}
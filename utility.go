@@ -22,15 +22,16 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
-var myClient = &http.Client{Timeout: 10 * time.Second}
-
-func getJSON(url string, target interface{}) error {
-	r, err := myClient.Get(url)
+func getJSON(client *http.Client, url string, target interface{}) error {
+	r, err := client.Get(url)
 	if err != nil {
 		return err
 	}
@@ -39,16 +40,18 @@ func getJSON(url string, target interface{}) error {
 	return json.NewDecoder(r.Body).Decode(target)
 }
 
-func postJSON(url string, origin string, structure interface{}) (statusCode int, headers http.Header, bodyString []byte, err error) {
+func postJSON(client *http.Client, url string, origin string, structure interface{}) (statusCode int, headers http.Header, bodyString []byte, err error) {
 	jsonStr, err := json.Marshal(structure)
 	if err != nil {
 		return 0, nil, nil, err
 	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", origin)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
 
-	resp, err := myClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, nil, nil, err
 	}
@@ -98,6 +101,17 @@ func isPaletteEqual(pal1, pal2 color.Palette) bool {
 	return true
 }
 
+// Parses a color in the form "#RRGGBB", the "#" is optional
+func parseHexColor(hex string) (color.RGBA, error) {
+	digits := strings.TrimPrefix(hex, "#")
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) != 6 {
+		return color.RGBA{}, fmt.Errorf("Invalid color %q", hex)
+	}
+
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
 // Creates a copy of an image
 func copyImage(img image.Image) (image.Image, error) {
 	switch img := img.(type) {
@@ -128,7 +142,7 @@ func copyImage(img image.Image) (image.Image, error) {
 		return imgCopy, nil
 	}
 
-	return nil, fmt.Errorf("Incompatible image type %T", img)
+	return copyImageRGBA(img), nil
 }
 
 // Creates a copy of an image, without copying data outside that image rectangle.
@@ -139,7 +153,7 @@ func copyImageReduced(img image.Image) (image.Image, error) {
 		rect := img.Rect
 		stride := rect.Dx() * 4
 		imgCopy := &image.RGBA{
-			Pix:    make([]uint8, rect.Dx()*stride),
+			Pix:    make([]uint8, rect.Dy()*stride),
 			Stride: stride,
 			Rect:   rect,
 		}
@@ -152,7 +166,7 @@ func copyImageReduced(img image.Image) (image.Image, error) {
 		rect := img.Rect
 		stride := rect.Dx()
 		imgCopy := &image.Paletted{
-			Pix:     make([]uint8, rect.Dx()*stride),
+			Pix:     make([]uint8, rect.Dy()*stride),
 			Stride:  stride,
 			Rect:    rect,
 			Palette: make(color.Palette, len(img.Palette)),
@@ -164,7 +178,17 @@ func copyImageReduced(img image.Image) (image.Image, error) {
 		return imgCopy, nil
 	}
 
-	return nil, fmt.Errorf("Incompatible image type %T", img)
+	return copyImageRGBA(img), nil
+}
+
+// Creates an RGBA copy of any image.
+// Used for image types that don't have a special case in copyImage or copyImageReduced.
+func copyImageRGBA(img image.Image) *image.RGBA {
+	rect := img.Bounds()
+	imgCopy := image.NewRGBA(rect)
+	draw.Draw(imgCopy, rect, img, rect.Min, draw.Src)
+
+	return imgCopy
 }
 
 // Returns the part of the image that is seen by rect.
@@ -175,6 +199,10 @@ func subImage(img image.Image, rect image.Rectangle) (image.Image, error) {
 		return img.SubImage(rect), nil
 	case *image.Paletted:
 		return img.SubImage(rect), nil
+	case interface {
+		SubImage(image.Rectangle) image.Image
+	}:
+		return img.SubImage(rect), nil
 	}
 
 	return nil, fmt.Errorf("Incompatible image type %T", img)
@@ -185,7 +213,8 @@ func subImage(img image.Image, rect image.Rectangle) (image.Image, error) {
 // Will return false in the following cases, even if the image data looks the same from the outside:
 // - Image types differ
 // - Palettes differ
-// - Image type not supported (Only Paletted and RGBA yet)
+//
+// Paletted and RGBA images are compared directly, other types pixel by pixel.
 //
 // Can compare:
 // - Subimages
@@ -233,7 +262,19 @@ func compareImages(a, b image.Image) bool {
 		return true
 	}
 
-	return false
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !a.Bounds().Eq(b.Bounds()) {
+		return false
+	}
+	rect := a.Bounds()
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			if color.RGBA64Model.Convert(a.At(ix, iy)) != color.RGBA64Model.Convert(b.At(ix, iy)) {
+				return false
+			}
+		}
+	}
+
+	return true
 }
 
 // Converts any image to an BGRA array
@@ -251,6 +292,18 @@ func imageToBGRAArray(img image.Image) []byte {
 			}
 		}
 
+		return array
+	case *image.Paletted:
+		lookup := paletteToBGRALookup(img.Palette)
+		array := make([]byte, rect.Dx()*rect.Dy()*4)
+		i := 0
+		for iy := 0; iy < rect.Dy(); iy++ {
+			for _, index := range img.Pix[iy*img.Stride : iy*img.Stride+rect.Dx()] {
+				copy(array[i:i+4], lookup[index][:])
+				i += 4
+			}
+		}
+
 		return array
 	default:
 		array := make([]byte, rect.Dx()*rect.Dy()*4)
@@ -274,3 +327,39 @@ func imageToBGRAArray(img image.Image) []byte {
 	}
 
 }
+
+// Returns a table that maps every possible palette index to its BGRA value.
+// Indices outside of the palette map to transparent black.
+func paletteToBGRALookup(palette color.Palette) *[256][4]byte {
+	lookup := &[256][4]byte{}
+	for i, col := range palette {
+		if i >= len(lookup) {
+			break
+		}
+		r, g, b, a := col.RGBA() // Returns 16 bit per channel
+		lookup[i] = [4]byte{byte(b >> 8), byte(g >> 8), byte(r >> 8), byte(a >> 8)}
+	}
+
+	return lookup
+}
+
+// Returns the palette indices of the image without row padding, and its palette as BGRA array.
+// This is a quarter of the size of imageToBGRAArray, the receiver has to expand it.
+func imageToIndexedArray(img *image.Paletted) (indices, palette []byte) {
+	rect := img.Rect
+	indices = make([]byte, rect.Dx()*rect.Dy())
+	for iy := 0; iy < rect.Dy(); iy++ {
+		copy(indices[iy*rect.Dx():(iy+1)*rect.Dx()], img.Pix[iy*img.Stride:iy*img.Stride+rect.Dx()])
+	}
+
+	lookup := paletteToBGRALookup(img.Palette)
+	palette = make([]byte, 0, len(img.Palette)*4)
+	for i := range img.Palette {
+		if i >= len(lookup) {
+			break
+		}
+		palette = append(palette, lookup[i][:]...)
+	}
+
+	return indices, palette
+}
@@ -17,6 +17,10 @@
 package main
 
 import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
 	"testing"
 )
 
@@ -105,3 +109,107 @@ func Test_divideCeil(t *testing.T) {
 		}
 	}
 }
+
+// Reference implementation of imageToBGRAArray, that works on every image type
+func imageToBGRAArrayGeneric(img image.Image) []byte {
+	rect := img.Bounds()
+	array := make([]byte, 0, rect.Dx()*rect.Dy()*4)
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			r, g, b, a := img.At(ix, iy).RGBA()
+			array = append(array, byte(b>>8), byte(g>>8), byte(r>>8), byte(a>>8))
+		}
+	}
+	return array
+}
+
+func newRandomPaletted(rect image.Rectangle) *image.Paletted {
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(len(img.Palette)))
+	}
+	return img
+}
+
+func Test_imageToBGRAArray(t *testing.T) {
+	paletted := newRandomPaletted(image.Rect(-5, 3, 60, 40))
+	rgba := image.NewRGBA(image.Rect(-5, 3, 60, 40))
+	rand.Read(rgba.Pix)
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"Paletted", paletted},
+		{"Paletted sub image", paletted.SubImage(image.Rect(0, 10, 20, 30))},
+		{"RGBA", rgba},
+		{"RGBA sub image", rgba.SubImage(image.Rect(0, 10, 20, 30))},
+		{"NRGBA", image.NewNRGBA(image.Rect(0, 0, 7, 3))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := imageToBGRAArray(tt.img), imageToBGRAArrayGeneric(tt.img); !bytes.Equal(got, want) {
+				t.Errorf("imageToBGRAArray() differs from the generic implementation")
+			}
+		})
+	}
+}
+
+func Test_imageToIndexedArray(t *testing.T) {
+	img := newRandomPaletted(image.Rect(0, 0, 64, 64)).SubImage(image.Rect(10, 20, 30, 25)).(*image.Paletted)
+
+	indices, palette := imageToIndexedArray(img)
+	if len(indices) != 20*5 || len(palette) != len(pixelcanvasioPalette)*4 {
+		t.Fatalf("imageToIndexedArray() returned %v indices and %v palette bytes", len(indices), len(palette))
+	}
+
+	// Expanding the indices has to result in the same data as imageToBGRAArray
+	expanded := []byte{}
+	for _, index := range indices {
+		expanded = append(expanded, palette[int(index)*4:int(index)*4+4]...)
+	}
+	if !bytes.Equal(expanded, imageToBGRAArray(img)) {
+		t.Errorf("Expanded indices differ from imageToBGRAArray()")
+	}
+
+	// Indices outside of the palette are transparent
+	if lookup := paletteToBGRALookup(color.Palette{color.White}); lookup[0] != [4]byte{255, 255, 255, 255} || lookup[1] != [4]byte{} {
+		t.Errorf("paletteToBGRALookup() = %v, %v", lookup[0], lookup[1])
+	}
+}
+
+// Size of a PixelCanvas.io bigchunk
+var benchmarkImageRect = image.Rect(0, 0, 960, 960)
+
+func Benchmark_imageToBGRAArrayPaletted(b *testing.B) {
+	img := newRandomPaletted(benchmarkImageRect)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		imageToBGRAArray(img)
+	}
+}
+
+func Benchmark_imageToBGRAArrayPalettedGeneric(b *testing.B) {
+	img := newRandomPaletted(benchmarkImageRect)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		imageToBGRAArrayGeneric(img)
+	}
+}
+
+func Benchmark_imageToBGRAArrayRGBA(b *testing.B) {
+	img := image.NewRGBA(benchmarkImageRect)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		imageToBGRAArray(img)
+	}
+}
+
+func Benchmark_imageToIndexedArray(b *testing.B) {
+	img := newRandomPaletted(benchmarkImageRect)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		imageToIndexedArray(img)
+	}
+}